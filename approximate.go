@@ -0,0 +1,249 @@
+package sstable
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/childoftheuniverse/filesystem"
+)
+
+/*
+Err_NoIndexEntries indicates that sizes were to be estimated for a table
+without an index to estimate them from.
+*/
+var Err_NoIndexEntries = errors.New(
+	"No index entries to estimate from")
+
+/*
+Err_NoRecordCounts indicates that numbers of records were to be estimated for
+a table whose index doesn't record them, because it was written by an older
+version of the Writer.
+*/
+var Err_NoRecordCounts = errors.New(
+	"Index holds no record counts")
+
+/*
+tableLayout describes what's known about where the records of a table are
+from its index, without reading any data.
+*/
+type tableLayout struct {
+	// Index entries, sorted by key.
+	entries []IndexEntry
+	// Offsets of the first record and of the end of the data file.
+	start int64
+	end   int64
+	// Estimated number of records, if the index records counts.
+	records      int64
+	have_records bool
+}
+
+/*
+readLayout determines the layout of the table from its index and the size of
+the data file. The in-memory copy of the index is used if there is one;
+otherwise, the index file is read.
+*/
+func (r *Reader) readLayout(ctx context.Context) (*tableLayout, error) {
+	var l = new(tableLayout)
+	var sk filesystem.Seeker
+	var current int64
+	var ok bool
+	var err error
+
+	sk, ok = r.orig_in.(filesystem.Seeker)
+	if !ok {
+		return nil, Err_NotSeeker
+	}
+	if err = r.readHeader(ctx); err != nil {
+		return nil, err
+	}
+	l.start = r.data_start
+
+	// Determine the size of the data file, without disturbing reads.
+	if current, err = sk.Tell(ctx); err != nil {
+		return nil, err
+	}
+	if l.end, err = sk.Seek(ctx, 0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if _, err = sk.Seek(ctx, current, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if l.entries, err = r.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	if len(l.entries) == 0 {
+		if l.end > l.start {
+			return nil, Err_NoIndexEntries
+		}
+		// Empty table.
+		l.have_records = true
+		return l, nil
+	}
+	sort.SliceStable(l.entries, func(i, j int) bool {
+		return l.entries[i].Key < l.entries[j].Key
+	})
+
+	l.records, l.have_records = l.estimateRecords()
+	return l, nil
+}
+
+/*
+estimateRecords estimates the number of records in the table from the
+number of records up to the last indexed one, assuming the records following
+it are of the same average size as those before.
+*/
+func (l *tableLayout) estimateRecords() (int64, bool) {
+	var last = l.entries[len(l.entries)-1]
+	var before = last.Records - 1
+	var following int64
+
+	if last.Records == 0 {
+		return 0, false
+	}
+	if before == 0 || last.Offset <= l.start {
+		return last.Records, true
+	}
+
+	following = int64(float64(l.end-last.Offset)*float64(before)/
+		float64(last.Offset-l.start) + 0.5)
+	if following < 1 {
+		following = 1
+	}
+	return before + following, true
+}
+
+/*
+position estimates the offset of the first record with a key greater than or
+equal to key, and the number of records before it. Unless the key is in the
+index, the position is assumed to be halfway between the surrounding index
+entries. The empty key is at the start of the table.
+*/
+func (l *tableLayout) position(key string) (int64, int64) {
+	var lower_offset, upper_offset = l.start, l.end
+	var lower_records, upper_records = int64(0), l.records
+	var pos int
+
+	if key == "" {
+		return l.start, 0
+	}
+
+	pos = sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].Key >= key
+	})
+	if pos < len(l.entries) {
+		upper_offset = l.entries[pos].Offset
+		upper_records = l.entries[pos].Records - 1
+		if l.entries[pos].Key == key {
+			return upper_offset, upper_records
+		}
+	}
+	if pos > 0 {
+		lower_offset = l.entries[pos-1].Offset
+		lower_records = l.entries[pos-1].Records - 1
+	}
+
+	return (lower_offset + upper_offset) / 2,
+		(lower_records + upper_records) / 2
+}
+
+/*
+between estimates the size and number of records of the range from start up
+to, but not including, end. An empty end stands for the end of the table.
+*/
+func (l *tableLayout) between(start, end string) (int64, int64) {
+	var start_offset, start_records = l.position(start)
+	var end_offset, end_records = l.end, l.records
+
+	if end != "" {
+		end_offset, end_records = l.position(end)
+	}
+	if end_offset < start_offset || end_records < start_records {
+		return 0, 0
+	}
+	return end_offset - start_offset, end_records - start_records
+}
+
+/*
+ApproximateOffsetOf estimates the offset in the data file of the first record
+with a key greater than or equal to key, using only the index: the estimate
+is exact for indexed keys and otherwise off by at most half the distance
+between index entries, or between the last entry and the end of the table.
+
+The data file has to support seeking. Unless the index has been loaded into
+memory, the index file is read on every call.
+*/
+func (r *Reader) ApproximateOffsetOf(ctx context.Context, key string) (
+	int64, error) {
+	var l *tableLayout
+	var offset int64
+	var err error
+
+	if l, err = r.readLayout(ctx); err != nil {
+		return 0, err
+	}
+	offset, _ = l.position(key)
+	return offset, nil
+}
+
+/*
+ApproximateSize estimates the number of bytes taken up by the records with
+keys from start up to, but not including, end, like ApproximateOffsetOf. An
+empty end stands for the end of the table.
+*/
+func (r *Reader) ApproximateSize(ctx context.Context, start, end string) (
+	int64, error) {
+	var l *tableLayout
+	var size int64
+	var err error
+
+	if l, err = r.readLayout(ctx); err != nil {
+		return 0, err
+	}
+	size, _ = l.between(start, end)
+	return size, nil
+}
+
+/*
+ApproximateRecords estimates the number of records with keys from start up
+to, but not including, end, from the record counts in the index. An empty end
+stands for the end of the table. Err_NoRecordCounts is returned for tables
+whose index doesn't hold record counts.
+*/
+func (r *Reader) ApproximateRecords(ctx context.Context, start, end string) (
+	int64, error) {
+	var l *tableLayout
+	var records int64
+	var err error
+
+	if l, err = r.readLayout(ctx); err != nil {
+		return 0, err
+	}
+	if !l.have_records {
+		return 0, Err_NoRecordCounts
+	}
+	_, records = l.between(start, end)
+	return records, nil
+}
+
+/*
+ApproximateRecordCount estimates the number of records in the table from the
+record counts in the index. The count is exact up to the last indexed record;
+the number of records following it is extrapolated from their size.
+Err_NoRecordCounts is returned for tables whose index doesn't hold record
+counts.
+*/
+func (r *Reader) ApproximateRecordCount(ctx context.Context) (int64, error) {
+	var l *tableLayout
+	var err error
+
+	if l, err = r.readLayout(ctx); err != nil {
+		return 0, err
+	}
+	if !l.have_records {
+		return 0, Err_NoRecordCounts
+	}
+	return l.records, nil
+}
@@ -0,0 +1,247 @@
+/*
+Package bulk builds sets of sstables in parallel, for bulk loads which are
+too large to be written through a single Writer.
+
+The input is partitioned by key range by the caller. Every partition is
+written by a goroutine of its own to one or more tables, and once all
+partitions are done, the tables are described by a manifest edit adding them
+to a level, ready to be applied to a manifest.
+*/
+package bulk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Err_OverlappingPartitions indicates that the key ranges of two partitions
+overlap, so their tables can't be part of the same level.
+*/
+var Err_OverlappingPartitions = errors.New(
+	"Overlapping partitions")
+
+/*
+Err_PartitionsOpen indicates that the build was finished while some
+partitions were still being written.
+*/
+var Err_PartitionsOpen = errors.New(
+	"Partitions still open")
+
+/*
+Err_PartitionClosed indicates that a record was written to a partition which
+has already been closed.
+*/
+var Err_PartitionClosed = errors.New(
+	"Partition closed")
+
+/*
+TableWriterFunc creates the writer for the table with the specified number.
+It is called concurrently by all partitions.
+*/
+type TableWriterFunc func(ctx context.Context, number uint64) (
+	*sstable.Writer, error)
+
+/*
+Options configures a build. Fields left at zero take the default values
+listed.
+*/
+type Options struct {
+	// Level the tables are added to by the manifest edit. 0.
+	Level int32
+
+	// Limits beyond which a partition continues in a new table. No limit.
+	MaxTableSize    int64
+	MaxTableRecords int64
+
+	// Allocates the numbers of new tables, e.g. Manifest.NewFileNumber.
+	// Must be safe for concurrent use. Counts up from 1.
+	NewFileNumber func() uint64
+}
+
+/*
+withDefaults fills in the default values for all unset options.
+*/
+func (o Options) withDefaults() Options {
+	if o.NewFileNumber == nil {
+		var mu sync.Mutex
+		var next uint64 = 1
+
+		o.NewFileNumber = func() uint64 {
+			mu.Lock()
+			defer mu.Unlock()
+			next++
+			return next - 1
+		}
+	}
+	return o
+}
+
+/*
+Builder writes the partitions of a bulk load to tables concurrently.
+*/
+type Builder struct {
+	create TableWriterFunc
+	opts   Options
+
+	// mu protects the tables written and the number of open partitions.
+	mu     sync.Mutex
+	tables []*manifest.TableInfo
+	open   int
+}
+
+/*
+NewBuilder creates a builder writing tables using create.
+*/
+func NewBuilder(create TableWriterFunc, opts Options) *Builder {
+	return &Builder{create: create, opts: opts.withDefaults()}
+}
+
+/*
+Partition writes the records of one key range. Records need to be written in
+ascending key order, and key ranges of different partitions must not
+overlap. A partition is not safe for concurrent use, but different partitions
+can be written concurrently.
+*/
+type Partition struct {
+	b       *Builder
+	writer  *sstable.RollingWriter
+	numbers []uint64
+	closed  bool
+}
+
+/*
+NewPartition starts a new partition. Its tables are created when the first
+record is written, so empty partitions don't leave any tables behind.
+*/
+func (b *Builder) NewPartition() *Partition {
+	var p = &Partition{b: b}
+
+	p.writer = sstable.NewRollingWriter(
+		func(ctx context.Context, table int) (*sstable.Writer, error) {
+			var number = b.opts.NewFileNumber()
+			var writer *sstable.Writer
+			var err error
+
+			// Only tables actually created are reported by the rolling
+			// writer, so their numbers must line up.
+			if writer, err = b.create(ctx, number); err != nil {
+				return nil, err
+			}
+			p.numbers = append(p.numbers, number)
+			return writer, nil
+		}, b.opts.MaxTableSize, b.opts.MaxTableRecords)
+
+	b.mu.Lock()
+	b.open++
+	b.mu.Unlock()
+
+	return p
+}
+
+/*
+WriteString appends a record to the partition.
+*/
+func (p *Partition) WriteString(
+	ctx context.Context, key, value string) error {
+	if p.closed {
+		return Err_PartitionClosed
+	}
+	return p.writer.WriteString(ctx, key, value)
+}
+
+/*
+WriteProto encodes the specified protocol buffer and appends it as the value
+of a record to the partition.
+*/
+func (p *Partition) WriteProto(
+	ctx context.Context, key string, value proto.Message) error {
+	if p.closed {
+		return Err_PartitionClosed
+	}
+	return p.writer.WriteProto(ctx, key, value)
+}
+
+/*
+WriteMerge appends a merge record holding the specified operands to the
+partition.
+*/
+func (p *Partition) WriteMerge(
+	ctx context.Context, key string, operands ...string) error {
+	if p.closed {
+		return Err_PartitionClosed
+	}
+	return p.writer.WriteMerge(ctx, key, operands...)
+}
+
+/*
+Close finishes the tables of the partition and hands them to the builder.
+Tables are handed over even if closing fails, so that Finish reports them
+and their files can be removed.
+*/
+func (p *Partition) Close(ctx context.Context) error {
+	var shards []sstable.Shard
+	var i int
+	var err error
+
+	if p.closed {
+		return Err_PartitionClosed
+	}
+	p.closed = true
+
+	shards, err = p.writer.Close(ctx)
+
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+	for i = range shards {
+		p.b.tables = append(p.b.tables, &manifest.TableInfo{
+			Number:      p.numbers[i],
+			Level:       p.b.opts.Level,
+			SmallestKey: []byte(shards[i].FirstKey),
+			LargestKey:  []byte(shards[i].LastKey),
+			Size:        shards[i].Size,
+		})
+	}
+	p.b.open--
+
+	return err
+}
+
+/*
+Finish returns a manifest edit adding all tables written by the partitions,
+once all of them have been closed. The tables are sorted by key.
+
+If the key ranges of the partitions overlap, Err_OverlappingPartitions is
+returned along with the edit, so the tables can be removed.
+*/
+func (b *Builder) Finish() (*manifest.Edit, error) {
+	var edit = new(manifest.Edit)
+	var i int
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open > 0 {
+		return nil, Err_PartitionsOpen
+	}
+
+	edit.Added = append(edit.Added, b.tables...)
+	sort.Slice(edit.Added, func(i, j int) bool {
+		return string(edit.Added[i].SmallestKey) <
+			string(edit.Added[j].SmallestKey)
+	})
+	for i = 1; i < len(edit.Added); i++ {
+		if string(edit.Added[i].SmallestKey) <=
+			string(edit.Added[i-1].LargestKey) {
+			return edit, Err_OverlappingPartitions
+		}
+	}
+
+	return edit, nil
+}
@@ -0,0 +1,178 @@
+package bulk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/childoftheuniverse/filesystem-internal"
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+// memTables keeps the data files of tables in memory.
+type memTables struct {
+	mu    sync.Mutex
+	files map[uint64]*internal.AnonymousFile
+}
+
+func newMemTables() *memTables {
+	return &memTables{files: make(map[uint64]*internal.AnonymousFile)}
+}
+
+func (m *memTables) create(ctx context.Context, number uint64) (
+	*sstable.Writer, error) {
+	var out = internal.NewAnonymousFile()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[number] = out
+	return sstable.NewWriter(ctx, out), nil
+}
+
+// count reads all records of a table.
+func (m *memTables) count(t *testing.T, number uint64) int {
+	var ctx = context.Background()
+	var reader *sstable.Reader
+	var records int
+	var err error
+
+	reader = sstable.NewReader(m.files[number])
+
+	for {
+		if _, _, err = reader.ReadNextString(ctx); err != nil {
+			break
+		}
+		records++
+	}
+	return records
+}
+
+// Build tables from four partitions written concurrently.
+func TestBuilder(t *testing.T) {
+	var ctx = context.Background()
+	var tables = newMemTables()
+	var b = NewBuilder(tables.create, Options{Level: 1, MaxTableRecords: 10})
+	var wg sync.WaitGroup
+	var edit *manifest.Edit
+	var info *manifest.TableInfo
+	var errs = make([]error, 4)
+	var total int
+	var i int
+	var err error
+
+	for i = 0; i < 4; i++ {
+		var p = b.NewPartition()
+
+		wg.Add(1)
+		go func(i int) {
+			var j int
+			var err error
+
+			defer wg.Done()
+			for j = 0; j < 25; j++ {
+				err = p.WriteString(ctx, fmt.Sprintf("%d-%02d", i, j), "value")
+				if err != nil {
+					errs[i] = err
+					break
+				}
+			}
+			if err = p.Close(ctx); errs[i] == nil {
+				errs[i] = err
+			}
+		}(i)
+	}
+
+	// Empty partitions don't create tables.
+	if err = b.NewPartition().Close(ctx); err != nil {
+		t.Error("Error closing empty partition: ", err)
+	}
+
+	wg.Wait()
+	for i = range errs {
+		if errs[i] != nil {
+			t.Fatal("Error writing partition ", i, ": ", errs[i])
+		}
+	}
+
+	if edit, err = b.Finish(); err != nil {
+		t.Fatal("Error finishing build: ", err)
+	}
+	if len(edit.Added) != 12 || string(edit.Added[0].SmallestKey) != "0-00" ||
+		string(edit.Added[0].LargestKey) != "0-09" ||
+		string(edit.Added[11].LargestKey) != "3-24" {
+		t.Error("Unexpected tables: ", edit.Added)
+	}
+	for _, info = range edit.Added {
+		if info.Level != 1 || info.Size == 0 {
+			t.Error("Unexpected table: ", info)
+		}
+		total += tables.count(t, info.Number)
+	}
+	if total != 100 {
+		t.Error("Expected 100 records in tables, got ", total)
+	}
+}
+
+// Partitions which overlap or are left open fail the build.
+func TestBuilderErrors(t *testing.T) {
+	var ctx = context.Background()
+	var tables = newMemTables()
+	var b = NewBuilder(tables.create, Options{})
+	var p, q *Partition
+	var edit *manifest.Edit
+	var err error
+
+	p = b.NewPartition()
+	q = b.NewPartition()
+	if err = p.WriteString(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = p.WriteString(ctx, "c", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = q.WriteString(ctx, "b", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = p.Close(ctx); err != nil {
+		t.Fatal("Error closing partition: ", err)
+	}
+	if err = p.WriteString(ctx, "d", "1"); err != Err_PartitionClosed {
+		t.Error("Expected write to closed partition to fail, got ", err)
+	}
+
+	if _, err = b.Finish(); err != Err_PartitionsOpen {
+		t.Error("Expected open partitions to fail, got ", err)
+	}
+	if err = q.Close(ctx); err != nil {
+		t.Fatal("Error closing partition: ", err)
+	}
+	edit, err = b.Finish()
+	if err != Err_OverlappingPartitions || len(edit.Added) != 2 {
+		t.Error("Expected overlapping partitions to fail, got ", err)
+	}
+
+	// Numbers of tables which failed to be created are skipped.
+	b = NewBuilder(func(ctx context.Context, number uint64) (
+		*sstable.Writer, error) {
+		if number == 1 {
+			return nil, fmt.Errorf("table %d failed", number)
+		}
+		return tables.create(ctx, number)
+	}, Options{})
+	p = b.NewPartition()
+	if err = p.WriteString(ctx, "a", "1"); err == nil {
+		t.Error("Expected failing table creation to fail the write")
+	}
+	if err = p.WriteString(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = p.Close(ctx); err != nil {
+		t.Fatal("Error closing partition: ", err)
+	}
+	edit, err = b.Finish()
+	if err != nil || len(edit.Added) != 1 || edit.Added[0].Number != 2 {
+		t.Error("Unexpected edit: ", edit, ", ", err)
+	}
+}
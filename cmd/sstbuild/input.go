@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+maxTSVLineSize is the maximum length of a line of TSV input.
+*/
+const maxTSVLineSize = 64 << 20
+
+/*
+recordParser extracts records from an input file. next returns io.EOF once
+the input is exhausted.
+*/
+type recordParser interface {
+	next() (string, string, error)
+}
+
+/*
+fieldReader reads the fields of the next line of CSV or TSV input.
+*/
+type fieldReader interface {
+	Read() ([]string, error)
+}
+
+/*
+tsvReader splits lines of TSV input into fields at every tab. Unlike CSV, TSV
+has no quoting, so quotes are just part of the fields.
+*/
+type tsvReader struct {
+	in *bufio.Scanner
+}
+
+func newTSVReader(in io.Reader) *tsvReader {
+	var r = &tsvReader{in: bufio.NewScanner(in)}
+
+	r.in.Buffer(nil, maxTSVLineSize)
+	return r
+}
+
+func (r *tsvReader) Read() ([]string, error) {
+	if !r.in.Scan() {
+		if r.in.Err() != nil {
+			return nil, r.in.Err()
+		}
+		return nil, io.EOF
+	}
+
+	return strings.Split(strings.TrimSuffix(r.in.Text(), "\r"), "\t"), nil
+}
+
+/*
+csvParser extracts records from CSV or TSV input, using the columns
+configured as key and value.
+*/
+type csvParser struct {
+	in                   fieldReader
+	key_col, value_col   int
+	key_name, value_name string
+	header               bool
+	line                 int
+}
+
+/*
+newCSVParser creates a parser for CSV input, or TSV input if comma is a tab.
+Columns are specified by name if the input starts with a header line, and by
+their number, starting from 0, otherwise.
+*/
+func newCSVParser(in io.Reader, comma rune, header bool,
+	key_col, value_col string) (*csvParser, error) {
+	var p = &csvParser{
+		header:     header,
+		key_name:   key_col,
+		value_name: value_col,
+	}
+	var err error
+
+	if comma == '\t' {
+		p.in = newTSVReader(in)
+	} else {
+		var r = csv.NewReader(in)
+
+		r.Comma = comma
+		r.FieldsPerRecord = -1
+		r.ReuseRecord = true
+		p.in = r
+	}
+
+	if header {
+		return p, nil
+	}
+
+	if p.key_col, err = strconv.Atoi(key_col); err != nil || p.key_col < 0 {
+		return nil, fmt.Errorf("invalid key column %q", key_col)
+	}
+	p.value_col, err = strconv.Atoi(value_col)
+	if err != nil || p.value_col < 0 {
+		return nil, fmt.Errorf("invalid value column %q", value_col)
+	}
+	return p, nil
+}
+
+/*
+readHeader determines the numbers of the key and value columns from the
+header line.
+*/
+func (p *csvParser) readHeader() error {
+	var fields []string
+	var i int
+	var err error
+
+	p.header = false
+	p.key_col, p.value_col = -1, -1
+
+	if fields, err = p.in.Read(); err != nil {
+		if err == io.EOF {
+			return errors.New("missing header line")
+		}
+		return err
+	}
+	p.line++
+
+	for i = range fields {
+		if fields[i] == p.key_name && p.key_col < 0 {
+			p.key_col = i
+		}
+		if fields[i] == p.value_name && p.value_col < 0 {
+			p.value_col = i
+		}
+	}
+
+	if p.key_col < 0 {
+		return fmt.Errorf("no key column %q in header", p.key_name)
+	}
+	if p.value_col < 0 {
+		return fmt.Errorf("no value column %q in header", p.value_name)
+	}
+	return nil
+}
+
+func (p *csvParser) next() (string, string, error) {
+	var fields []string
+	var err error
+
+	if p.header {
+		if err = p.readHeader(); err != nil {
+			return "", "", err
+		}
+	}
+
+	if fields, err = p.in.Read(); err != nil {
+		return "", "", err
+	}
+	p.line++
+
+	if p.key_col >= len(fields) || p.value_col >= len(fields) {
+		return "", "", fmt.Errorf("line %d: only %d columns", p.line,
+			len(fields))
+	}
+
+	return fields[p.key_col], fields[p.value_col], nil
+}
+
+/*
+jsonlParser extracts records from JSON Lines input, in which every line holds
+a JSON object. Fields holding strings are used as is, all other fields in
+their JSON encoding.
+*/
+type jsonlParser struct {
+	in                     *bufio.Reader
+	key_field, value_field string
+	line                   int
+}
+
+/*
+newJSONLParser creates a parser for JSON Lines input. If value_field is
+empty, the entire line is used as the value.
+*/
+func newJSONLParser(in io.Reader, key_field, value_field string) *jsonlParser {
+	return &jsonlParser{
+		in:          bufio.NewReader(in),
+		key_field:   key_field,
+		value_field: value_field,
+	}
+}
+
+/*
+jsonField extracts a field from a JSON object.
+*/
+func jsonField(object map[string]json.RawMessage, name string) (
+	string, bool) {
+	var raw json.RawMessage
+	var s string
+	var ok bool
+
+	if raw, ok = object[name]; !ok {
+		return "", false
+	}
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true
+	}
+	return string(raw), true
+}
+
+func (p *jsonlParser) next() (string, string, error) {
+	var object map[string]json.RawMessage
+	var line []byte
+	var key, value string
+	var ok bool
+	var err error
+
+	for len(line) == 0 {
+		line, err = p.in.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		p.line++
+		line = bytes.TrimSpace(line)
+	}
+
+	if err = json.Unmarshal(line, &object); err != nil {
+		return "", "", fmt.Errorf("line %d: %v", p.line, err)
+	}
+
+	if key, ok = jsonField(object, p.key_field); !ok {
+		return "", "", fmt.Errorf("line %d: no field %q", p.line, p.key_field)
+	}
+	if p.value_field == "" {
+		return key, string(line), nil
+	}
+	if value, ok = jsonField(object, p.value_field); !ok {
+		return "", "", fmt.Errorf("line %d: no field %q", p.line,
+			p.value_field)
+	}
+
+	return key, value, nil
+}
@@ -0,0 +1,247 @@
+/*
+Command sstbuild creates an sstable from CSV, TSV or JSON Lines input.
+
+	sstbuild [flags] -out table [input...]
+
+Input is read from the files listed, or from standard input if there are none
+or for an input named "-". For CSV and TSV input, -key and -value select the
+columns holding the key and the value: by name if the input starts with a
+header line (-header), by number starting from 0 otherwise. For JSON Lines
+input, they name fields of the objects; without -value, the entire line is
+used as the value.
+
+Unless the input is known to be sorted by key already (-sorted), records are
+sorted using temporary files in -tmpdir, so inputs larger than memory can be
+handled. Records with the same key are kept in input order.
+
+The table is indexed as selected using -index_type and -n; the index is
+written to -index, or to the table name with .idx appended.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/cliflags"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+/*
+buildOptions describes how to create the table.
+*/
+type buildOptions struct {
+	// Input format: csv, tsv or jsonl.
+	format string
+	header bool
+	key    string
+	value  string
+
+	sorted bool
+	memory int64
+	tmpdir string
+
+	out        string
+	index      string
+	index_type int
+	index_n    int
+}
+
+/*
+openInput opens the named input file, or standard input for "-".
+*/
+func openInput(name string, stdin io.Reader) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	return os.Open(name)
+}
+
+/*
+newParser creates a parser for input in the configured format.
+*/
+func newParser(opts *buildOptions, in io.Reader) (recordParser, error) {
+	switch opts.format {
+	case "csv":
+		return newCSVParser(in, ',', opts.header, opts.key, opts.value)
+	case "tsv":
+		return newCSVParser(in, '\t', opts.header, opts.key, opts.value)
+	case "jsonl":
+		return newJSONLParser(in, opts.key, opts.value), nil
+	}
+	return nil, fmt.Errorf("unknown input format %q", opts.format)
+}
+
+/*
+build creates the table from the records of the inputs, returning the number
+of records written. If building the table fails, the output files are
+removed.
+*/
+func build(ctx context.Context, opts *buildOptions, inputs []string,
+	stdin io.Reader) (int64, error) {
+	var sorter *externalSorter
+	var data, idx *osfile.Writer
+	var writer *sstable.Writer
+	var write func(key, value string) error
+	var count int64
+	var name string
+	var err error
+
+	if data, err = osfile.Create(opts.out); err != nil {
+		return 0, err
+	}
+	if opts.index_type == sstable.IndexType_NONE {
+		writer = sstable.NewWriter(ctx, data)
+	} else {
+		if idx, err = osfile.Create(opts.index); err != nil {
+			data.Close(ctx)
+			os.Remove(opts.out)
+			return 0, err
+		}
+		writer = sstable.NewIndexedWriter(
+			ctx, data, idx, opts.index_type, opts.index_n)
+	}
+
+	write = func(key, value string) error {
+		var err error
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = writer.WriteString(ctx, key, value); err != nil {
+			return fmt.Errorf("writing %q: %v", key, err)
+		}
+		count++
+		return nil
+	}
+
+	if !opts.sorted {
+		sorter = newExternalSorter(opts.tmpdir, opts.memory)
+		defer sorter.close()
+	}
+
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, name = range inputs {
+		if err = readInput(opts, name, stdin, sorter, write); err != nil {
+			break
+		}
+	}
+	if err == nil && sorter != nil {
+		err = sorter.finish(write)
+	}
+
+	if err == nil {
+		err = writer.Close(ctx)
+	} else {
+		data.Close(ctx)
+		if idx != nil {
+			idx.Close(ctx)
+		}
+	}
+	if err != nil {
+		os.Remove(opts.out)
+		if idx != nil {
+			os.Remove(opts.index)
+		}
+		return 0, err
+	}
+
+	return count, nil
+}
+
+/*
+readInput reads all records from the named input and passes them on to the
+sorter, or directly to write if there is no sorter.
+*/
+func readInput(opts *buildOptions, name string, stdin io.Reader,
+	sorter *externalSorter, write func(key, value string) error) error {
+	var in io.ReadCloser
+	var parser recordParser
+	var err error
+
+	if in, err = openInput(name, stdin); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if parser, err = newParser(opts, in); err != nil {
+		return err
+	}
+
+	for {
+		var key, value string
+
+		key, value, err = parser.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		if sorter != nil {
+			err = sorter.add(key, value)
+		} else {
+			err = write(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	var opts buildOptions
+	var index_flags *cliflags.IndexFlags
+	var count int64
+	var ok bool
+	var err error
+
+	flag.StringVar(&opts.format, "format", "csv",
+		"Input format: csv, tsv or jsonl")
+	flag.BoolVar(&opts.header, "header", false,
+		"CSV and TSV input starts with a header line naming the columns")
+	flag.StringVar(&opts.key, "key", "0",
+		"Column or field holding the key")
+	flag.StringVar(&opts.value, "value", "1",
+		"Column or field holding the value")
+	flag.BoolVar(&opts.sorted, "sorted", false,
+		"Input is sorted by key already")
+	flag.Int64Var(&opts.memory, "memory", 256<<20,
+		"Bytes of records to sort in memory before using temporary files")
+	flag.StringVar(&opts.tmpdir, "tmpdir", os.TempDir(),
+		"Directory for temporary files")
+	flag.StringVar(&opts.out, "out", "", "Table to write")
+	flag.StringVar(&opts.index, "index", "",
+		"Index file to write; defaults to the table name with .idx appended")
+	index_flags = cliflags.RegisterIndexFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] -out table [input...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts.index_type, opts.index_n, ok = index_flags.IndexType()
+	if !ok || opts.out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if opts.index == "" {
+		opts.index = opts.out + ".idx"
+	}
+
+	count, err = build(context.Background(), &opts, flag.Args(), os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sstbuild:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "sstbuild: wrote %d records to %s\n", count,
+		opts.out)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+// readTable reads all records of a table, checking the index along the way.
+func readTable(t *testing.T, table, index string) ([]string, []string) {
+	var ctx = context.Background()
+	var data, idx *osfile.Reader
+	var reader *sstable.Reader
+	var keys, values []string
+	var k, v string
+	var err error
+
+	if data, err = osfile.Open(table); err != nil {
+		t.Fatal("Error opening table: ", err)
+	}
+	defer data.Close(ctx)
+	if idx, err = osfile.Open(index); err != nil {
+		t.Fatal("Error opening index: ", err)
+	}
+	defer idx.Close(ctx)
+
+	if reader, err = sstable.NewReaderWithIdx(ctx, data, idx, true); err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	for {
+		k, v, err = reader.ReadNextString(ctx)
+		if err != nil {
+			break
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+
+	return keys, values
+}
+
+// Build tables from unsorted CSV input, spilling to temporary files, and
+// from JSON Lines input.
+func TestBuild(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var csv strings.Builder
+	var opts *buildOptions
+	var keys, values []string
+	var count int64
+	var names []os.DirEntry
+	var i int
+	var err error
+
+	csv.WriteString("value,id\n")
+	for i = 0; i < 100; i++ {
+		fmt.Fprintf(&csv, "\"v%d, quoted\",k%02d\n", i, (i*37)%50)
+	}
+	err = os.WriteFile(filepath.Join(dir, "in.csv"),
+		[]byte(csv.String()), 0644)
+	if err != nil {
+		t.Fatal("Error writing input: ", err)
+	}
+
+	opts = &buildOptions{format: "csv", header: true, key: "id",
+		value: "value", memory: 100, tmpdir: dir,
+		out: filepath.Join(dir, "out.sst"), index: filepath.Join(dir, "out.idx"),
+		index_type: sstable.IndexType_EVERY_N, index_n: 3}
+	count, err = build(ctx, opts, []string{filepath.Join(dir, "in.csv")}, nil)
+	if err != nil || count != 100 {
+		t.Fatal("Error building table: ", count, ", ", err)
+	}
+	if names, err = os.ReadDir(dir); err != nil || len(names) != 3 {
+		t.Error("Expected temporary files to be removed, got ", len(names),
+			" files")
+	}
+
+	keys, values = readTable(t, opts.out, opts.index)
+	if len(keys) != 100 {
+		t.Fatal("Expected 100 records, got ", len(keys))
+	}
+	for i = range keys {
+		if i > 0 && keys[i] < keys[i-1] {
+			t.Error("Keys out of order: ", keys[i], " after ", keys[i-1])
+		}
+	}
+	// k00 is written by records 0 and 50, which keep their order.
+	if keys[0] != "k00" || values[0] != "v0, quoted" ||
+		values[1] != "v50, quoted" {
+		t.Error("Unexpected first records: ", keys[:2], values[:2])
+	}
+
+	// JSON Lines from standard input, sorted already, with the whole line as
+	// the value.
+	opts = &buildOptions{format: "jsonl", key: "id", sorted: true,
+		out: filepath.Join(dir, "json.sst"), index: filepath.Join(dir, "json.idx"),
+		index_type: sstable.IndexType_EVERY_N_BYTES, index_n: 10}
+	count, err = build(ctx, opts, nil, strings.NewReader(
+		"{\"id\": 1, \"x\": true}\n\n{\"id\": \"2\"}"))
+	if err != nil || count != 2 {
+		t.Fatal("Error building table: ", count, ", ", err)
+	}
+	keys, values = readTable(t, opts.out, opts.index)
+	if len(keys) != 2 || keys[0] != "1" || keys[1] != "2" ||
+		values[0] != "{\"id\": 1, \"x\": true}" {
+		t.Error("Unexpected records: ", keys, values)
+	}
+
+	// TSV without a header: quotes are just part of the fields.
+	opts = &buildOptions{format: "tsv", key: "1", value: "0", memory: 100,
+		tmpdir: dir, out: filepath.Join(dir, "tsv.sst"),
+		index: filepath.Join(dir, "tsv.idx"), index_n: 1,
+		index_type: sstable.IndexType_EVERY_N}
+	count, err = build(ctx, opts, nil, strings.NewReader(
+		"\"quoted\" value\tb\r\n\"half\tan \"a\"\n"))
+	if err != nil || count != 2 {
+		t.Fatal("Error building table: ", count, ", ", err)
+	}
+	keys, values = readTable(t, opts.out, opts.index)
+	if len(keys) != 2 || keys[0] != "an \"a\"" || values[0] != "\"half" ||
+		keys[1] != "b" || values[1] != "\"quoted\" value" {
+		t.Error("Unexpected records: ", keys, values)
+	}
+
+	// Unsorted input claimed to be sorted fails, leaving no table behind.
+	count, err = build(ctx, opts, nil, strings.NewReader(
+		"{\"id\": \"b\"}\n{\"id\": \"a\"}\n"))
+	if err == nil {
+		t.Error("Expected unsorted input to fail")
+	}
+	if _, err = os.Stat(opts.out); !os.IsNotExist(err) {
+		t.Error("Expected table to be removed, got ", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+externalSorter sorts records by key, stably, using a bounded amount of memory:
+whenever the records held in memory exceed the limit, they are sorted and
+written to a temporary run file. The runs are merged when the records are
+read back.
+*/
+type externalSorter struct {
+	dir   string
+	limit int64
+
+	keys   []string
+	values []string
+	size   int64
+
+	runs []*os.File
+}
+
+/*
+newExternalSorter creates a sorter keeping up to limit bytes of records in
+memory, and its run files in dir.
+*/
+func newExternalSorter(dir string, limit int64) *externalSorter {
+	return &externalSorter{dir: dir, limit: limit}
+}
+
+/*
+add adds a record to be sorted.
+*/
+func (s *externalSorter) add(key, value string) error {
+	s.keys = append(s.keys, key)
+	s.values = append(s.values, value)
+	s.size += int64(len(key) + len(value))
+
+	if s.size >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+/*
+sortMemory sorts the records held in memory, keeping records with the same
+key in the order they were added.
+*/
+func (s *externalSorter) sortMemory() {
+	var order = make([]int, len(s.keys))
+	var keys = make([]string, len(s.keys))
+	var values = make([]string, len(s.values))
+	var i int
+
+	for i = range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return s.keys[order[a]] < s.keys[order[b]]
+	})
+	for i = range order {
+		keys[i] = s.keys[order[i]]
+		values[i] = s.values[order[i]]
+	}
+
+	s.keys, s.values = keys, values
+}
+
+/*
+spill writes the records held in memory to a new run file.
+*/
+func (s *externalSorter) spill() error {
+	var f *os.File
+	var out *bufio.Writer
+	var i int
+	var err error
+
+	s.sortMemory()
+
+	if f, err = os.CreateTemp(s.dir, "sstbuild-run-"); err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+
+	out = bufio.NewWriter(f)
+	for i = range s.keys {
+		if err = writeString(out, s.keys[i]); err != nil {
+			return err
+		}
+		if err = writeString(out, s.values[i]); err != nil {
+			return err
+		}
+	}
+	if err = out.Flush(); err != nil {
+		return err
+	}
+
+	s.keys, s.values, s.size = nil, nil, 0
+	return nil
+}
+
+/*
+writeString writes a length-prefixed string to a run file.
+*/
+func writeString(out *bufio.Writer, s string) error {
+	var length [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(length[:], uint64(len(s)))
+	var err error
+
+	if _, err = out.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err = out.WriteString(s)
+	return err
+}
+
+/*
+readString reads a length-prefixed string from a run file.
+*/
+func readString(in *bufio.Reader) (string, error) {
+	var data []byte
+	var length uint64
+	var err error
+
+	if length, err = binary.ReadUvarint(in); err != nil {
+		return "", err
+	}
+	data = make([]byte, length)
+	if _, err = io.ReadFull(in, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+/*
+runReader reads back the records of a run.
+*/
+type runReader struct {
+	// Position of the run, so records with the same key are returned in the
+	// order they were added.
+	number     int
+	in         *bufio.Reader
+	key, value string
+}
+
+/*
+advance reads the next record of the run, returning io.EOF at its end.
+*/
+func (r *runReader) advance() error {
+	var err error
+
+	if r.key, err = readString(r.in); err != nil {
+		return err
+	}
+	r.value, err = readString(r.in)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+/*
+runHeap orders runs by their current key.
+*/
+type runHeap []*runReader
+
+func (h runHeap) Len() int {
+	return len(h)
+}
+
+func (h runHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].number < h[j].number
+}
+
+func (h runHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	*h = append(*h, x.(*runReader))
+}
+
+func (h *runHeap) Pop() interface{} {
+	var old = *h
+	var r = old[len(old)-1]
+
+	*h = old[:len(old)-1]
+	return r
+}
+
+/*
+finish passes all records to fn in sorted order.
+*/
+func (s *externalSorter) finish(fn func(key, value string) error) error {
+	var h runHeap
+	var f *os.File
+	var i int
+	var err error
+
+	if len(s.runs) == 0 {
+		// Everything fit into memory.
+		s.sortMemory()
+		for i = range s.keys {
+			if err = fn(s.keys[i], s.values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(s.keys) > 0 {
+		if err = s.spill(); err != nil {
+			return err
+		}
+	}
+
+	for i, f = range s.runs {
+		var r = &runReader{number: i}
+
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r.in = bufio.NewReader(f)
+		if err = r.advance(); err == nil {
+			h = append(h, r)
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		var r = h[0]
+
+		if err = fn(r.key, r.value); err != nil {
+			return err
+		}
+
+		if err = r.advance(); err == io.EOF {
+			heap.Pop(&h)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+
+	return nil
+}
+
+/*
+close removes all run files.
+*/
+func (s *externalSorter) close() {
+	var f *os.File
+
+	for _, f = range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+dumpOptions describes what to print from which table.
+*/
+type dumpOptions struct {
+	table string
+	index string
+
+	// Output format, text or json.
+	format string
+
+	// Range of keys to print; start is inclusive, end exclusive.
+	start  string
+	end    string
+	prefix string
+	limit  int
+
+	records     bool
+	print_index bool
+	stats       bool
+
+	// Message type of the values, if they are to be decoded.
+	message protoreflect.MessageType
+}
+
+/*
+dumpStats holds statistics about all records of the table and the index,
+regardless of the range of records printed.
+*/
+type dumpStats struct {
+	Records      int64  `json:"records"`
+	MergeRecords int64  `json:"merge_records"`
+	KeyBytes     int64  `json:"key_bytes"`
+	ValueBytes   int64  `json:"value_bytes"`
+	SmallestKey  string `json:"smallest_key"`
+	LargestKey   string `json:"largest_key"`
+	DataBytes    int64  `json:"data_bytes"`
+	IndexEntries int    `json:"index_entries"`
+}
+
+/*
+dump prints the parts of the table requested by opts to out.
+*/
+func dump(ctx context.Context, opts *dumpOptions, out io.Writer) error {
+	var buf = bufio.NewWriter(out)
+	var data, idx *osfile.Reader
+	var reader *sstable.Reader
+	var stats dumpStats
+	var err error
+
+	if data, err = osfile.Open(opts.table); err != nil {
+		return err
+	}
+	defer data.Close(ctx)
+	if stats.DataBytes, err = data.Size(); err != nil {
+		return err
+	}
+
+	if opts.index != "" {
+		if idx, err = osfile.Open(opts.index); err != nil {
+			return err
+		}
+		defer idx.Close(ctx)
+
+		if reader, err = sstable.NewReaderWithIdx(
+			ctx, data, idx, true); err != nil {
+			return err
+		}
+	} else {
+		reader = sstable.NewReader(data)
+	}
+
+	if err = dumpRecords(ctx, opts, reader, buf); err != nil {
+		buf.Flush()
+		return err
+	}
+	if opts.stats {
+		if err = collectStats(ctx, reader, &stats); err != nil {
+			buf.Flush()
+			return err
+		}
+	}
+
+	if opts.index != "" {
+		var entries []sstable.IndexEntry
+		var entry sstable.IndexEntry
+
+		if entries, err = reader.ReadIndex(ctx); err != nil {
+			buf.Flush()
+			return err
+		}
+		stats.IndexEntries = len(entries)
+
+		if opts.print_index {
+			for _, entry = range entries {
+				if err = printIndexEntry(opts, buf, entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if opts.stats {
+		if opts.format == "json" {
+			err = writeJSON(buf, map[string]interface{}{"stats": &stats})
+		} else {
+			err = writeTextStats(buf, &stats, opts.index != "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
+
+/*
+seekToKey positions the reader at the indexed record closest to, but not
+after, the specified key.
+*/
+func seekToKey(ctx context.Context, reader *sstable.Reader, key string) error {
+	var entries []sstable.IndexEntry
+	var i int
+	var err error
+
+	if entries, err = reader.ReadIndex(ctx); err != nil {
+		return err
+	}
+	i = sort.Search(len(entries), func(i int) bool {
+		return entries[i].Key > key
+	})
+	if i == 0 {
+		return reader.SeekTo(ctx, 0)
+	}
+	return reader.SeekTo(ctx, entries[i-1].Offset)
+}
+
+/*
+dumpRecords prints the records in the requested range. Merge records are
+printed with their operands, since there is no merge operator to combine them.
+*/
+func dumpRecords(ctx context.Context, opts *dumpOptions,
+	reader *sstable.Reader, out io.Writer) error {
+	var start = opts.start
+	var key, value string
+	var operands []string
+	var records int
+	var err error
+
+	if opts.prefix > start {
+		start = opts.prefix
+	}
+
+	if start != "" && opts.index != "" {
+		if err = seekToKey(ctx, reader, start); err != nil {
+			return err
+		}
+	}
+
+	for opts.limit <= 0 || records < opts.limit {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		key, value, operands, err = reader.ReadNextRecord(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if key < start {
+			continue
+		}
+		if (opts.end != "" && key >= opts.end) ||
+			!strings.HasPrefix(key, opts.prefix) {
+			// Keys are sorted, so no further keys can be in range.
+			return nil
+		}
+
+		records++
+		if opts.records {
+			err = printRecord(opts, out, key, value, operands)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+collectStats reads all records of the table to collect statistics about them.
+*/
+func collectStats(ctx context.Context, reader *sstable.Reader,
+	stats *dumpStats) error {
+	var key, value string
+	var operands []string
+	var operand string
+	var err error
+
+	if err = reader.SeekTo(ctx, 0); err != nil {
+		return err
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		key, value, operands, err = reader.ReadNextRecord(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if stats.Records == 0 {
+			stats.SmallestKey = key
+		}
+		stats.LargestKey = key
+		stats.Records++
+		stats.KeyBytes += int64(len(key))
+		stats.ValueBytes += int64(len(value))
+		if operands != nil {
+			stats.MergeRecords++
+		}
+		for _, operand = range operands {
+			stats.ValueBytes += int64(len(operand))
+		}
+	}
+}
+
+/*
+printRecord prints a single record in the requested format. Records with
+operands are merge records; their operands are printed instead of the value,
+without decoding them, since they needn't be messages of the value type.
+*/
+func printRecord(opts *dumpOptions, out io.Writer, key, value string,
+	operands []string) error {
+	var err error
+
+	if operands != nil {
+		return printMergeRecord(opts, out, key, operands)
+	}
+
+	if opts.format == "json" {
+		var record = make(map[string]interface{})
+
+		setJSONString(record, "key", key)
+		if opts.message != nil {
+			var decoded json.RawMessage
+
+			if decoded, err = decodeJSON(opts.message, value); err != nil {
+				return fmt.Errorf("decoding value of %q: %v", key, err)
+			}
+			record["value"] = decoded
+		} else {
+			setJSONString(record, "value", value)
+		}
+
+		return writeJSON(out, record)
+	}
+
+	if opts.message != nil {
+		if value, err = decodeText(opts.message, value); err != nil {
+			return fmt.Errorf("decoding value of %q: %v", key, err)
+		}
+	} else {
+		value = strconv.Quote(value)
+	}
+
+	_, err = fmt.Fprintf(out, "%s\t%s\n", strconv.Quote(key), value)
+	return err
+}
+
+/*
+printMergeRecord prints a merge record in the requested format: as text, the
+quoted key is followed by the word merge and the quoted operands, oldest
+first, all separated by tabs.
+*/
+func printMergeRecord(opts *dumpOptions, out io.Writer, key string,
+	operands []string) error {
+	var fields []string
+	var operand string
+	var err error
+
+	if opts.format == "json" {
+		var record = make(map[string]interface{})
+		var valid = true
+		var stored [][]byte
+
+		setJSONString(record, "key", key)
+		for _, operand = range operands {
+			valid = valid && utf8.ValidString(operand)
+			stored = append(stored, []byte(operand))
+		}
+		if valid {
+			record["merge"] = operands
+		} else {
+			record["merge_base64"] = stored
+		}
+
+		return writeJSON(out, record)
+	}
+
+	fields = []string{strconv.Quote(key), "merge"}
+	for _, operand = range operands {
+		fields = append(fields, strconv.Quote(operand))
+	}
+	_, err = fmt.Fprintf(out, "%s\n", strings.Join(fields, "\t"))
+	return err
+}
+
+/*
+printIndexEntry prints a single index entry in the requested format.
+*/
+func printIndexEntry(opts *dumpOptions, out io.Writer,
+	entry sstable.IndexEntry) error {
+	var err error
+
+	if opts.format == "json" {
+		return writeJSON(out, map[string]interface{}{
+			"index_key": entry.Key,
+			"offset":    entry.Offset,
+		})
+	}
+
+	_, err = fmt.Fprintf(out, "index\t%s\t%d\n",
+		strconv.Quote(entry.Key), entry.Offset)
+	return err
+}
+
+/*
+setJSONString sets the field of a JSON object to s. Since JSON strings can't
+hold arbitrary bytes, s is base64 encoded into name_base64 instead if it isn't
+valid UTF-8.
+*/
+func setJSONString(object map[string]interface{}, name, s string) {
+	if utf8.ValidString(s) {
+		object[name] = s
+	} else {
+		object[name+"_base64"] = []byte(s)
+	}
+}
+
+/*
+writeJSON writes v as a single line of JSON.
+*/
+func writeJSON(out io.Writer, v interface{}) error {
+	var data []byte
+	var err error
+
+	if data, err = json.Marshal(v); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+/*
+writeTextStats writes the statistics in text form.
+*/
+func writeTextStats(out io.Writer, stats *dumpStats, indexed bool) error {
+	var err error
+
+	_, err = fmt.Fprintf(out,
+		"records: %d\nmerge records: %d\nkey bytes: %d\nvalue bytes: %d\n"+
+			"smallest key: %s\nlargest key: %s\ndata bytes: %d\n",
+		stats.Records, stats.MergeRecords, stats.KeyBytes, stats.ValueBytes,
+		strconv.Quote(stats.SmallestKey), strconv.Quote(stats.LargestKey),
+		stats.DataBytes)
+	if err == nil && indexed {
+		_, err = fmt.Fprintf(out, "index entries: %d\n", stats.IndexEntries)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+/*
+Command sstdump prints the contents of an sstable.
+
+	sstdump [flags] table
+
+Records are printed one per line, either as text (quoted key and value,
+separated by a tab) or as JSON objects. The range of records printed can be
+restricted using -start, -end, -prefix and -limit; if an index file is
+specified using -index, it is used to find the first record rather than
+scanning the table from the start. Values holding protocol buffers can be
+decoded using a descriptor set, as written by protoc --descriptor_set_out
+--include_imports, and the full name of the message type.
+
+Merge records are printed with their operands, oldest first, instead of a
+value: as text, the key is followed by the word merge and the quoted operands,
+and in JSON, the operands make up the merge field. Operands aren't decoded.
+
+With -print_index, the entries of the index are printed after the records,
+and with -stats, statistics about all records of the table and the index.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	var opts dumpOptions
+	var descriptor_set, message_type string
+	var err error
+
+	flag.StringVar(&opts.index, "index", "",
+		"Index file of the table, used for seeking to the first record")
+	flag.StringVar(&opts.format, "format", "text",
+		"Output format: text or json")
+	flag.StringVar(&opts.start, "start", "",
+		"Print records with keys greater than or equal to this")
+	flag.StringVar(&opts.end, "end", "",
+		"Print records with keys less than this")
+	flag.StringVar(&opts.prefix, "prefix", "",
+		"Print records with keys starting with this prefix")
+	flag.IntVar(&opts.limit, "limit", 0,
+		"Maximum number of records to print, or 0 for all")
+	flag.BoolVar(&opts.records, "records", true, "Print the records")
+	flag.BoolVar(&opts.print_index, "print_index", false,
+		"Print the entries of the index (requires -index)")
+	flag.BoolVar(&opts.stats, "stats", false,
+		"Print statistics about all records of the table and the index")
+	flag.StringVar(&descriptor_set, "descriptor_set", "",
+		"File holding a FileDescriptorSet for decoding values")
+	flag.StringVar(&message_type, "message", "",
+		"Full name of the message type of the values (requires "+
+			"-descriptor_set)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] table\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (descriptor_set == "") != (message_type == "") ||
+		(opts.print_index && opts.index == "") ||
+		(opts.format != "text" && opts.format != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.table = flag.Arg(0)
+
+	if descriptor_set != "" {
+		opts.message, err = loadMessageType(descriptor_set, message_type)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sstdump: error loading message type:",
+				err)
+			os.Exit(1)
+		}
+	}
+
+	if err = dump(context.Background(), &opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "sstdump:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// writeTable writes an indexed table of durations to dir.
+func writeTable(t *testing.T, dir string) (string, string) {
+	var ctx = context.Background()
+	var table = filepath.Join(dir, "table.sst")
+	var index = filepath.Join(dir, "table.idx")
+	var data, idx *osfile.Writer
+	var writer *sstable.Writer
+	var value []byte
+	var i int
+	var err error
+
+	if data, err = osfile.Create(table); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	if idx, err = osfile.Create(index); err != nil {
+		t.Fatal("Error creating index: ", err)
+	}
+	writer = sstable.NewIndexedWriter(ctx, data, idx,
+		sstable.IndexType_EVERY_N, 4)
+
+	for i = 0; i < 20; i++ {
+		value, err = proto.Marshal(&durationpb.Duration{Seconds: int64(i)})
+		if err != nil {
+			t.Fatal("Error encoding value: ", err)
+		}
+		err = writer.WriteString(ctx, fmt.Sprintf("key%02d", i), string(value))
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	return table, index
+}
+
+// Dump ranges of records as text and JSON, with and without decoding them.
+func TestDump(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var table, index = writeTable(t, dir)
+	var set = &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(
+				durationpb.File_google_protobuf_duration_proto),
+		},
+	}
+	var opts *dumpOptions
+	var out bytes.Buffer
+	var lines []string
+	var data []byte
+	var err error
+
+	opts = &dumpOptions{table: table, index: index, format: "text",
+		start: "key05", end: "key15", prefix: "key1", records: true,
+		stats: true}
+	if err = dump(ctx, opts, &out); err != nil {
+		t.Fatal("Error dumping table: ", err)
+	}
+	lines = strings.Split(out.String(), "\n")
+	if !strings.HasPrefix(lines[0], "\"key10\"\t") ||
+		!strings.HasPrefix(lines[4], "\"key14\"\t") ||
+		lines[5] != "records: 20" || lines[6] != "merge records: 0" ||
+		lines[9] != "smallest key: \"key00\"" ||
+		lines[10] != "largest key: \"key19\"" || lines[11] != "data bytes: "+
+		fmt.Sprint(fileSize(t, table)) || lines[12] != "index entries: 5" {
+		t.Error("Unexpected output: ", out.String())
+	}
+
+	// Without the index, the table is scanned instead.
+	data, err = proto.Marshal(set)
+	if err != nil {
+		t.Fatal("Error encoding descriptor set: ", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "set.pb"), data, 0644)
+	if err != nil {
+		t.Fatal("Error writing descriptor set: ", err)
+	}
+	opts = &dumpOptions{table: table, format: "json", start: "key03",
+		limit: 2, records: true}
+	opts.message, err = loadMessageType(
+		filepath.Join(dir, "set.pb"), "google.protobuf.Duration")
+	if err != nil {
+		t.Fatal("Error loading message type: ", err)
+	}
+	out.Reset()
+	if err = dump(ctx, opts, &out); err != nil {
+		t.Fatal("Error dumping table: ", err)
+	}
+	if out.String() != "{\"key\":\"key03\",\"value\":\"3s\"}\n"+
+		"{\"key\":\"key04\",\"value\":\"4s\"}\n" {
+		t.Error("Unexpected output: ", out.String())
+	}
+
+	opts = &dumpOptions{table: table, index: index, format: "json",
+		print_index: true}
+	out.Reset()
+	if err = dump(ctx, opts, &out); err != nil {
+		t.Fatal("Error dumping index: ", err)
+	}
+	lines = strings.Split(out.String(), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[0],
+		"{\"index_key\":\"key03\",\"offset\":") {
+		t.Error("Unexpected index: ", out.String())
+	}
+}
+
+// Merge records are dumped with their operands rather than stopping the dump.
+func TestDumpMergeRecords(t *testing.T) {
+	var ctx = context.Background()
+	var table = filepath.Join(t.TempDir(), "table.sst")
+	var data *osfile.Writer
+	var writer *sstable.Writer
+	var opts *dumpOptions
+	var out bytes.Buffer
+	var err error
+
+	if data, err = osfile.Create(table); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	writer = sstable.NewWriter(ctx, data)
+	if err = writer.WriteString(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.WriteMerge(ctx, "b", "+2", "+3"); err != nil {
+		t.Fatal("Error writing merge record: ", err)
+	}
+	if err = writer.WriteString(ctx, "c", "4"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	opts = &dumpOptions{table: table, format: "text", records: true,
+		stats: true}
+	if err = dump(ctx, opts, &out); err != nil {
+		t.Fatal("Error dumping table: ", err)
+	}
+	if !strings.HasPrefix(out.String(), "\"a\"\t\"1\"\n"+
+		"\"b\"\tmerge\t\"+2\"\t\"+3\"\n\"c\"\t\"4\"\n"+
+		"records: 3\nmerge records: 1\nkey bytes: 3\nvalue bytes: 6\n") {
+		t.Error("Unexpected output: ", out.String())
+	}
+
+	opts = &dumpOptions{table: table, format: "json", start: "b",
+		records: true}
+	out.Reset()
+	if err = dump(ctx, opts, &out); err != nil {
+		t.Fatal("Error dumping table: ", err)
+	}
+	if out.String() != "{\"key\":\"b\",\"merge\":[\"+2\",\"+3\"]}\n"+
+		"{\"key\":\"c\",\"value\":\"4\"}\n" {
+		t.Error("Unexpected output: ", out.String())
+	}
+}
+
+// fileSize determines the size of a file.
+func fileSize(t *testing.T, name string) int64 {
+	var data []byte
+	var err error
+
+	if data, err = os.ReadFile(name); err != nil {
+		t.Fatal("Error reading ", name, ": ", err)
+	}
+	return int64(len(data))
+}
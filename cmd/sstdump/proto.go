@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+/*
+loadMessageType looks up the message type with the specified full name in the
+FileDescriptorSet stored in the file at path. The set needs to include all
+imported files.
+*/
+func loadMessageType(path, name string) (protoreflect.MessageType, error) {
+	var set descriptorpb.FileDescriptorSet
+	var files *protoregistry.Files
+	var desc protoreflect.Descriptor
+	var md protoreflect.MessageDescriptor
+	var data []byte
+	var ok bool
+	var err error
+
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if err = proto.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	if files, err = protodesc.NewFiles(&set); err != nil {
+		return nil, err
+	}
+
+	desc, err = files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, err
+	}
+	if md, ok = desc.(protoreflect.MessageDescriptor); !ok {
+		return nil, fmt.Errorf("%s is not a message type", name)
+	}
+
+	return dynamicpb.NewMessageType(md), nil
+}
+
+/*
+decodeText decodes a value as a message of type mt and formats it as a single
+line of text.
+*/
+func decodeText(mt protoreflect.MessageType, value string) (string, error) {
+	var msg = mt.New().Interface()
+	var data []byte
+	var err error
+
+	if err = proto.Unmarshal([]byte(value), msg); err != nil {
+		return "", err
+	}
+	if data, err = prototext.Marshal(msg); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+/*
+decodeJSON decodes a value as a message of type mt and formats it as JSON.
+*/
+func decodeJSON(mt protoreflect.MessageType, value string) ([]byte, error) {
+	var msg = mt.New().Interface()
+	var err error
+
+	if err = proto.Unmarshal([]byte(value), msg); err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(msg)
+}
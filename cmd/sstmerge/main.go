@@ -0,0 +1,71 @@
+/*
+Command sstmerge merges sstables into a new table.
+
+	sstmerge [flags] -out table input...
+
+The records of all inputs are written to the new table in key order. Only one
+record of each input is held in memory at a time, so inputs far larger than
+memory can be merged, e.g. to combine daily tables into a weekly one.
+
+If a key occurs more than once, in the same or different inputs, -duplicates
+selects which record is kept: "first" keeps the record from the input listed
+first, "last" the one from the input listed last, and "error" fails the
+merge.
+
+Merge records are copied to the new table without combining their operands.
+Since their operands can't be applied to another record without knowing the
+merge operator, a key with a merge record must occur only once; the merge
+fails otherwise, whatever the -duplicates policy.
+
+The new table is indexed as selected using -index_type and -n; the index is
+written to -index, or to the table name with .idx appended.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/childoftheuniverse/sstable/internal/cliflags"
+)
+
+func main() {
+	var opts mergeOptions
+	var index_flags *cliflags.IndexFlags
+	var stats *mergeStats
+	var ok bool
+	var err error
+
+	flag.StringVar(&opts.duplicates, "duplicates", duplicatesLast,
+		"Record to keep for duplicate keys: first, last or error")
+	flag.StringVar(&opts.out, "out", "", "Table to write")
+	flag.StringVar(&opts.index, "index", "",
+		"Index file to write; defaults to the table name with .idx appended")
+	index_flags = cliflags.RegisterIndexFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] -out table input...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts.index_type, opts.index_n, ok = index_flags.IndexType()
+	if !ok || opts.out == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if opts.index == "" {
+		opts.index = opts.out + ".idx"
+	}
+
+	stats, err = merge(context.Background(), &opts, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sstmerge:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "sstmerge: read %d records, wrote %d to %s "+
+		"(%d duplicates dropped)\n", stats.Read, stats.Written, opts.out,
+		stats.Duplicates)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+// writeTable writes a table with the specified records to dir.
+func writeTable(t *testing.T, dir, name string, records ...string) string {
+	var ctx = context.Background()
+	var table = filepath.Join(dir, name)
+	var data *osfile.Writer
+	var writer *sstable.Writer
+	var i int
+	var err error
+
+	if data, err = osfile.Create(table); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	writer = sstable.NewWriter(ctx, data)
+	for i = 0; i < len(records); i += 2 {
+		if err = writer.WriteString(ctx, records[i], records[i+1]); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	return table
+}
+
+// readTable reads all records of a table, looking up the last key through
+// the index.
+func readTable(t *testing.T, table, index, last string) []string {
+	var ctx = context.Background()
+	var data, idx *osfile.Reader
+	var reader *sstable.Reader
+	var records []string
+	var k, v string
+	var err error
+
+	if data, err = osfile.Open(table); err != nil {
+		t.Fatal("Error opening table: ", err)
+	}
+	defer data.Close(ctx)
+	if idx, err = osfile.Open(index); err != nil {
+		t.Fatal("Error opening index: ", err)
+	}
+	defer idx.Close(ctx)
+
+	if reader, err = sstable.NewReaderWithIdx(ctx, data, idx, true); err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if v, err = reader.ReadString(ctx, last); err != nil {
+		t.Error("Error looking up ", last, ": ", err)
+	}
+	if err = reader.SeekTo(ctx, 0); err != nil {
+		t.Fatal("Error seeking to start: ", err)
+	}
+	for {
+		if k, v, err = reader.ReadNextString(ctx); err != nil {
+			break
+		}
+		records = append(records, k, v)
+	}
+
+	return records
+}
+
+// expectRecords checks the records of a table.
+func expectRecords(t *testing.T, records []string, expected ...string) {
+	var i int
+
+	if len(records) != len(expected) {
+		t.Error("Expected ", expected, ", got ", records)
+		return
+	}
+	for i = range expected {
+		if records[i] != expected[i] {
+			t.Error("Expected ", expected, ", got ", records)
+			return
+		}
+	}
+}
+
+// Merge tables with each duplicates policy.
+func TestMerge(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var inputs = []string{
+		writeTable(t, dir, "a.sst", "a", "a1", "c", "a2", "d", "a3"),
+		writeTable(t, dir, "b.sst"),
+		writeTable(t, dir, "c.sst", "b", "c1", "c", "c2", "c", "c3"),
+	}
+	var opts = &mergeOptions{duplicates: duplicatesFirst,
+		out: filepath.Join(dir, "out.sst"), index: filepath.Join(dir, "out.idx"),
+		index_type: sstable.IndexType_EVERY_N, index_n: 2}
+	var stats *mergeStats
+	var err error
+
+	if stats, err = merge(ctx, opts, inputs); err != nil {
+		t.Fatal("Error merging tables: ", err)
+	}
+	if stats.Read != 6 || stats.Written != 4 || stats.Duplicates != 2 {
+		t.Error("Unexpected stats: ", stats)
+	}
+	expectRecords(t, readTable(t, opts.out, opts.index, "d"),
+		"a", "a1", "b", "c1", "c", "a2", "d", "a3")
+
+	opts.duplicates = duplicatesLast
+	if _, err = merge(ctx, opts, inputs); err != nil {
+		t.Fatal("Error merging tables: ", err)
+	}
+	expectRecords(t, readTable(t, opts.out, opts.index, "d"),
+		"a", "a1", "b", "c1", "c", "c3", "d", "a3")
+
+	// Failing merges leave no table behind.
+	opts.duplicates = duplicatesError
+	if _, err = merge(ctx, opts, inputs); err == nil {
+		t.Error("Expected duplicate keys to fail")
+	}
+	if _, err = os.Stat(opts.out); !os.IsNotExist(err) {
+		t.Error("Expected table to be removed, got ", err)
+	}
+	if _, err = os.Stat(opts.index); !os.IsNotExist(err) {
+		t.Error("Expected index to be removed, got ", err)
+	}
+
+	if _, err = merge(ctx, opts, inputs[:2]); err != nil {
+		t.Error("Error merging tables without duplicates: ", err)
+	}
+}
+
+// Merge records are copied as they are, but their keys must not occur more
+// than once.
+func TestMergeRecords(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var table = filepath.Join(dir, "merge.sst")
+	var opts = &mergeOptions{duplicates: duplicatesLast,
+		out: filepath.Join(dir, "out.sst"), index: filepath.Join(dir, "out.idx"),
+		index_type: sstable.IndexType_EVERY_N, index_n: 2}
+	var data *osfile.Writer
+	var in *osfile.Reader
+	var writer *sstable.Writer
+	var reader *sstable.Reader
+	var key, value string
+	var operands []string
+	var err error
+
+	if data, err = osfile.Create(table); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	writer = sstable.NewWriter(ctx, data)
+	if err = writer.WriteMerge(ctx, "b", "x", "y"); err != nil {
+		t.Fatal("Error writing merge record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	_, err = merge(ctx, opts, []string{
+		writeTable(t, dir, "a.sst", "a", "a1", "c", "a2"), table})
+	if err != nil {
+		t.Fatal("Error merging tables: ", err)
+	}
+	if in, err = osfile.Open(opts.out); err != nil {
+		t.Fatal("Error opening table: ", err)
+	}
+	defer in.Close(ctx)
+	reader = sstable.NewReader(in)
+	if _, _, _, err = reader.ReadNextRecord(ctx); err != nil {
+		t.Fatal("Error reading record: ", err)
+	}
+	key, value, operands, err = reader.ReadNextRecord(ctx)
+	if err != nil || key != "b" || value != "" || len(operands) != 2 ||
+		operands[0] != "x" || operands[1] != "y" {
+		t.Error("Unexpected merge record: ", key, ", ", value, ", ",
+			operands, ", ", err)
+	}
+
+	_, err = merge(ctx, opts, []string{
+		writeTable(t, dir, "b.sst", "b", "b1"), table})
+	if err == nil || !strings.Contains(err.Error(), "merge record") {
+		t.Error("Expected duplicate key of merge record to fail, got ", err)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+/*
+Policies for records with the same key, in the same or different inputs.
+*/
+const (
+	// Keep the record from the input listed first.
+	duplicatesFirst = "first"
+	// Keep the record from the input listed last.
+	duplicatesLast = "last"
+	// Fail the merge.
+	duplicatesError = "error"
+)
+
+/*
+mergeOptions describes how to merge the tables.
+*/
+type mergeOptions struct {
+	duplicates string
+
+	out        string
+	index      string
+	index_type int
+	index_n    int
+}
+
+/*
+mergeStats counts the records read and written by a merge.
+*/
+type mergeStats struct {
+	Read       int64
+	Written    int64
+	Duplicates int64
+}
+
+/*
+inputReader reads the records of one input table in order.
+*/
+type inputReader struct {
+	name   string
+	number int
+	in     *osfile.Reader
+	reader *sstable.Reader
+
+	key   string
+	value string
+	// Operands of the current record if it's a merge record, nil otherwise.
+	operands []string
+}
+
+/*
+advance reads the next record of the input, checking it doesn't go back in
+key order. Merge records are read as they are stored.
+*/
+func (r *inputReader) advance(ctx context.Context) error {
+	var key, value string
+	var operands []string
+	var err error
+
+	key, value, operands, err = r.reader.ReadNextRecord(ctx)
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", r.name, err)
+	}
+	if key < r.key {
+		return fmt.Errorf("%s: key %q follows larger key %q", r.name, key,
+			r.key)
+	}
+
+	r.key = key
+	r.value = value
+	r.operands = operands
+	return nil
+}
+
+/*
+writeRecord writes a record to the new table, as a merge record if operands
+are given.
+*/
+func writeRecord(ctx context.Context, writer *sstable.Writer, key,
+	value string, operands []string) error {
+	if operands != nil {
+		return writer.WriteMerge(ctx, key, operands...)
+	}
+	return writer.WriteString(ctx, key, value)
+}
+
+/*
+inputHeap orders inputs by their current key, and inputs with the same key in
+the order they were listed.
+*/
+type inputHeap []*inputReader
+
+func (h inputHeap) Len() int {
+	return len(h)
+}
+
+func (h inputHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].number < h[j].number
+}
+
+func (h inputHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *inputHeap) Push(x interface{}) {
+	*h = append(*h, x.(*inputReader))
+}
+
+func (h *inputHeap) Pop() interface{} {
+	var old = *h
+	var r = old[len(old)-1]
+
+	*h = old[:len(old)-1]
+	return r
+}
+
+/*
+merge writes all records of the inputs to a new table in key order, keeping
+one record per key as selected by the duplicates policy. Only the current
+record of each input is held in memory. If the merge fails, the output files
+are removed.
+*/
+func merge(ctx context.Context, opts *mergeOptions, inputs []string) (
+	*mergeStats, error) {
+	var stats = new(mergeStats)
+	var readers []*inputReader
+	var h inputHeap
+	var data, idx *osfile.Writer
+	var writer *sstable.Writer
+	var r *inputReader
+	var key, value string
+	var operands []string
+	var pending bool
+	var i int
+	var err error
+
+	switch opts.duplicates {
+	case duplicatesFirst, duplicatesLast, duplicatesError:
+	default:
+		return nil, fmt.Errorf("unknown duplicates policy %q", opts.duplicates)
+	}
+
+	defer func() {
+		for _, r = range readers {
+			r.in.Close(ctx)
+		}
+	}()
+	for i = range inputs {
+		r = &inputReader{name: inputs[i], number: i}
+		if r.in, err = osfile.Open(inputs[i]); err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+		r.reader = sstable.NewReader(r.in)
+
+		if err = r.advance(ctx); err == nil {
+			h = append(h, r)
+		} else if err != io.EOF {
+			return nil, err
+		}
+	}
+	heap.Init(&h)
+
+	if data, err = osfile.Create(opts.out); err != nil {
+		return nil, err
+	}
+	if opts.index_type == sstable.IndexType_NONE {
+		writer = sstable.NewWriter(ctx, data)
+	} else {
+		if idx, err = osfile.Create(opts.index); err != nil {
+			data.Close(ctx)
+			os.Remove(opts.out)
+			return nil, err
+		}
+		writer = sstable.NewIndexedWriter(
+			ctx, data, idx, opts.index_type, opts.index_n)
+	}
+
+	for len(h) > 0 && err == nil {
+		r = h[0]
+		stats.Read++
+
+		if pending && r.key == key {
+			stats.Duplicates++
+			if operands != nil || r.operands != nil {
+				err = fmt.Errorf("%s: merge record for duplicate key %q",
+					r.name, key)
+				break
+			}
+			if opts.duplicates == duplicatesError {
+				err = fmt.Errorf("%s: duplicate key %q", r.name, key)
+				break
+			}
+			if opts.duplicates == duplicatesLast {
+				value = r.value
+			}
+		} else {
+			if pending {
+				err = writeRecord(ctx, writer, key, value, operands)
+				stats.Written++
+			}
+			key, value, operands, pending = r.key, r.value, r.operands, true
+		}
+
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			if err = r.advance(ctx); err == io.EOF {
+				heap.Pop(&h)
+				err = nil
+			} else if err == nil {
+				heap.Fix(&h, 0)
+			}
+		}
+	}
+	if err == nil && pending {
+		err = writeRecord(ctx, writer, key, value, operands)
+		stats.Written++
+	}
+
+	if err == nil {
+		err = writer.Close(ctx)
+	} else {
+		data.Close(ctx)
+		if idx != nil {
+			idx.Close(ctx)
+		}
+	}
+	if err != nil {
+		os.Remove(opts.out)
+		if idx != nil {
+			os.Remove(opts.index)
+		}
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,84 @@
+/*
+Command sstsplit splits an sstable into shards by key range or size.
+
+	sstsplit [flags] -out pattern table
+
+The boundaries between shards are chosen according to -by:
+
+	keys   at the comma separated keys listed with -keys; shard i holds the
+	       keys from the (i-1)-th split key up to, but not including, the i-th
+	size   into -k shards of roughly equal size in bytes
+	index  into -k shards holding roughly the same number of records, as
+	       determined from the record counts in the index, or the same
+	       number of index entries if the index doesn't hold counts; the
+	       index of the table has to be specified with -index
+
+Records with the same key always end up in the same shard. Every shard is
+written to a table of its own, named by formatting -out with the shard
+number, e.g. "shard-%03d.sst", and indexed as selected using -index_type and
+-n; the index is written to the shard name with .idx appended. The key range
+of every shard is printed on standard output.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/cliflags"
+)
+
+func main() {
+	var opts splitOptions
+	var keys string
+	var index_flags *cliflags.IndexFlags
+	var shards []sstable.Shard
+	var ok bool
+	var i int
+	var err error
+
+	flag.StringVar(&opts.index, "index", "", "Index file of the table")
+	flag.StringVar(&opts.by, "by", splitBySize,
+		"How to choose the boundaries between shards: keys, size or index")
+	flag.StringVar(&keys, "keys", "",
+		"Comma separated split keys, for -by keys")
+	flag.IntVar(&opts.k, "k", 2,
+		"Number of shards, for -by size and -by index")
+	flag.StringVar(&opts.out, "out", "",
+		"Name of the shard tables, formatted with the shard number")
+	index_flags = cliflags.RegisterIndexFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] -out pattern table\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts.index_type, opts.index_n, ok = index_flags.IndexType()
+	if !ok || flag.NArg() != 1 || !strings.Contains(opts.out, "%") ||
+		opts.k < 1 ||
+		(opts.by == splitByIndex && opts.index == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.table = flag.Arg(0)
+	if keys != "" {
+		opts.keys = strings.Split(keys, ",")
+	}
+
+	shards, err = split(context.Background(), &opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sstsplit:", err)
+		os.Exit(1)
+	}
+	for i = range shards {
+		var table, _ = shardNames(&opts, i)
+
+		fmt.Printf("%s\t%d records\t%q\t%q\n", table, shards[i].Records,
+			shards[i].FirstKey, shards[i].LastKey)
+	}
+}
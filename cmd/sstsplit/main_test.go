@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+// writeTable writes an indexed table of 100 records to dir.
+func writeTable(t *testing.T, dir string) (string, string) {
+	var ctx = context.Background()
+	var table = filepath.Join(dir, "table.sst")
+	var index = filepath.Join(dir, "table.idx")
+	var data, idx *osfile.Writer
+	var writer *sstable.Writer
+	var i int
+	var err error
+
+	if data, err = osfile.Create(table); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	if idx, err = osfile.Create(index); err != nil {
+		t.Fatal("Error creating index: ", err)
+	}
+	writer = sstable.NewIndexedWriter(ctx, data, idx,
+		sstable.IndexType_EVERY_N, 10)
+	for i = 0; i < 100; i++ {
+		// Keys occur twice, so shards can't be cut anywhere.
+		err = writer.WriteString(ctx, fmt.Sprintf("key%02d", i/2),
+			fmt.Sprint(i))
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	return table, index
+}
+
+// checkShards reads all shards back through their indexes, checking they
+// hold all records with no key in more than one shard.
+func checkShards(t *testing.T, opts *splitOptions, shards []sstable.Shard) {
+	var ctx = context.Background()
+	var seen = make(map[string]int)
+	var total int64
+	var i int
+
+	for i = range shards {
+		var table, index = shardNames(opts, i)
+		var data, idx *osfile.Reader
+		var reader *sstable.Reader
+		var records int64
+		var k string
+		var j int
+		var ok bool
+		var err error
+
+		if data, err = osfile.Open(table); err != nil {
+			t.Fatal("Error opening shard: ", err)
+		}
+		defer data.Close(ctx)
+		if idx, err = osfile.Open(index); err != nil {
+			t.Fatal("Error opening shard index: ", err)
+		}
+		defer idx.Close(ctx)
+
+		reader, err = sstable.NewReaderWithIdx(ctx, data, idx, true)
+		if err != nil {
+			t.Fatal("Error loading shard index: ", err)
+		}
+		if shards[i].Records > 0 {
+			_, err = reader.ReadString(ctx, shards[i].LastKey)
+			if err != nil {
+				t.Error("Error looking up ", shards[i].LastKey, ": ", err)
+			}
+			if err = reader.SeekTo(ctx, 0); err != nil {
+				t.Fatal("Error seeking to start: ", err)
+			}
+		}
+		for {
+			if k, _, err = reader.ReadNextString(ctx); err != nil {
+				break
+			}
+			if j, ok = seen[k]; ok && j != i {
+				t.Error("Key ", k, " in shards ", j, " and ", i)
+			}
+			seen[k] = i
+			records++
+		}
+		if records != shards[i].Records {
+			t.Error("Shard ", i, " has ", records, " records, expected ",
+				shards[i])
+		}
+		total += records
+	}
+
+	if total != 100 {
+		t.Error("Expected 100 records in shards, got ", total)
+	}
+}
+
+// Split a table in each of the supported ways.
+func TestSplit(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var table, index = writeTable(t, dir)
+	var opts = &splitOptions{table: table, index: index,
+		out:        filepath.Join(dir, "shard-%d.sst"),
+		index_type: sstable.IndexType_EVERY_N, index_n: 4}
+	var shards []sstable.Shard
+	var err error
+
+	opts.by = splitByKeys
+	opts.keys = []string{"key10", "key99"}
+	if shards, err = split(ctx, opts); err != nil {
+		t.Fatal("Error splitting by keys: ", err)
+	}
+	if len(shards) != 3 || shards[0].LastKey != "key09" ||
+		shards[1].FirstKey != "key10" || shards[2].Records != 0 {
+		t.Error("Unexpected shards: ", shards)
+	}
+	checkShards(t, opts, shards)
+
+	opts.by = splitBySize
+	opts.k = 3
+	if shards, err = split(ctx, opts); err != nil {
+		t.Fatal("Error splitting by size: ", err)
+	}
+	if len(shards) != 3 || shards[0].Records < 30 || shards[0].Records > 36 {
+		t.Error("Unexpected shards: ", shards)
+	}
+	checkShards(t, opts, shards)
+
+	opts.by = splitByIndex
+	opts.k = 4
+	if shards, err = split(ctx, opts); err != nil {
+		t.Fatal("Error splitting by index: ", err)
+	}
+	// Every tenth record is indexed, starting with the tenth (key04).
+	if len(shards) != 4 || shards[1].FirstKey != "key14" ||
+		shards[3].FirstKey != "key39" {
+		t.Error("Unexpected shards: ", shards)
+	}
+	checkShards(t, opts, shards)
+
+	opts.by = splitByKeys
+	opts.keys = []string{"key10", "key05"}
+	if _, err = split(ctx, opts); err != sstable.Err_UnsortedSplitKeys {
+		t.Error("Expected unsorted split keys to fail, got ", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+/*
+Ways of choosing the boundaries between shards.
+*/
+const (
+	// At the split keys listed.
+	splitByKeys = "keys"
+	// At evenly spaced offsets of the table.
+	splitBySize = "size"
+	// At the keys of evenly spaced index entries.
+	splitByIndex = "index"
+)
+
+/*
+splitOptions describes how to split the table.
+*/
+type splitOptions struct {
+	table string
+	index string
+
+	by   string
+	keys []string
+	k    int
+
+	// Name of the shard tables, formatted with the shard number.
+	out        string
+	index_type int
+	index_n    int
+}
+
+/*
+shardNames returns the names of the table and index files of a shard.
+*/
+func shardNames(opts *splitOptions, shard int) (string, string) {
+	var table = fmt.Sprintf(opts.out, shard)
+
+	return table, table + ".idx"
+}
+
+/*
+split splits the table into shards as configured. If splitting fails, all
+shards written so far are removed.
+*/
+func split(ctx context.Context, opts *splitOptions) ([]sstable.Shard, error) {
+	var data, idx *osfile.Reader
+	var reader *sstable.Reader
+	var shards []sstable.Shard
+	var created int
+	var size int64
+	var err error
+
+	var create = func(ctx context.Context, shard int) (*sstable.Writer, error) {
+		var table, index = shardNames(opts, shard)
+		var out, out_idx *osfile.Writer
+		var err error
+
+		if out, err = osfile.Create(table); err != nil {
+			return nil, err
+		}
+		created++
+		if opts.index_type == sstable.IndexType_NONE {
+			return sstable.NewWriter(ctx, out), nil
+		}
+		if out_idx, err = osfile.Create(index); err != nil {
+			out.Close(ctx)
+			return nil, err
+		}
+		return sstable.NewIndexedWriter(
+			ctx, out, out_idx, opts.index_type, opts.index_n), nil
+	}
+
+	if data, err = osfile.Open(opts.table); err != nil {
+		return nil, err
+	}
+	defer data.Close(ctx)
+
+	if opts.index != "" {
+		if idx, err = osfile.Open(opts.index); err != nil {
+			return nil, err
+		}
+		defer idx.Close(ctx)
+		reader, err = sstable.NewReaderWithIdx(ctx, data, idx, false)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		reader = sstable.NewReader(data)
+	}
+
+	switch opts.by {
+	case splitByKeys:
+		shards, err = reader.SplitAtKeys(ctx, opts.keys, create)
+	case splitBySize:
+		if size, err = data.Size(); err == nil {
+			shards, err = reader.SplitBySize(ctx, opts.k, size, create)
+		}
+	case splitByIndex:
+		shards, err = reader.SplitAtIndexQuantiles(ctx, opts.k, create)
+	default:
+		err = fmt.Errorf("unknown split mode %q", opts.by)
+	}
+
+	if err != nil {
+		var i int
+
+		for i = 0; i < created; i++ {
+			var table, index = shardNames(opts, i)
+
+			os.Remove(table)
+			os.Remove(index)
+		}
+		return nil, err
+	}
+
+	return shards, nil
+}
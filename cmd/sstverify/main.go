@@ -0,0 +1,71 @@
+/*
+Command sstverify checks the integrity of an sstable.
+
+	sstverify [flags] table
+
+It checks that every record of the table decodes and that the keys are in
+ascending order. If the index file of the table is specified using -index, it
+also checks that every index entry points to the start of a record with a key
+at or after the index key, from which reading can start, and that every record
+can be found through the index.
+
+All problems found are reported on standard output, and the exit status is 1
+if there were any, so sstverify can be used to check tables before publishing
+them. Errors accessing the files are reported on standard error, with exit
+status 2.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	var index string
+	var max_problems int
+	var report *verifyReport
+	var problem string
+	var err error
+
+	flag.StringVar(&index, "index", "", "Index file of the table")
+	flag.IntVar(&max_problems, "max_problems", 100,
+		"Maximum number of problems to describe, or 0 for all")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] table\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	report, err = verify(context.Background(), flag.Arg(0), index,
+		max_problems)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sstverify:", err)
+		os.Exit(2)
+	}
+
+	for _, problem = range report.Problems {
+		fmt.Println(problem)
+	}
+	if report.NumProblems > len(report.Problems) {
+		fmt.Printf("... %d more problems\n",
+			report.NumProblems-len(report.Problems))
+	}
+
+	if report.NumProblems > 0 {
+		fmt.Printf("%s: FAILED with %d problems (%d records, %d index "+
+			"entries checked)\n", flag.Arg(0), report.NumProblems,
+			report.Records, report.IndexEntries)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK (%d records, %d index entries)\n", flag.Arg(0),
+		report.Records, report.IndexEntries)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/childoftheuniverse/recordio"
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+// writeTable writes a table with compressed keys and its index to dir,
+// returning the offsets of its records.
+func writeTable(t *testing.T, dir string) []int64 {
+	var ctx = context.Background()
+	var data, idx *osfile.Writer
+	var in *osfile.Reader
+	var writer *sstable.Writer
+	var reader *sstable.Reader
+	var offsets []int64
+	var i int
+	var err error
+
+	if data, err = osfile.Create(filepath.Join(dir, "table.sst")); err != nil {
+		t.Fatal("Error creating table: ", err)
+	}
+	if idx, err = osfile.Create(filepath.Join(dir, "table.idx")); err != nil {
+		t.Fatal("Error creating index: ", err)
+	}
+	writer = sstable.NewIndexedWriter(ctx, data, idx,
+		sstable.IndexType_EVERY_N, 3)
+	writer.SetKeyCompression(2)
+	for i = 0; i < 10; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("k%02d", i), "value")
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	if in, err = osfile.Open(filepath.Join(dir, "table.sst")); err != nil {
+		t.Fatal("Error opening table: ", err)
+	}
+	defer in.Close(ctx)
+	reader = sstable.NewReader(in)
+	for i = 0; i < 10; i++ {
+		offsets = append(offsets, reader.Tell(ctx))
+		if _, _, err = reader.ReadNextString(ctx); err != nil {
+			t.Fatal("Error reading record: ", err)
+		}
+	}
+
+	return offsets
+}
+
+// writeIndex writes an index file with the specified entries.
+func writeIndex(t *testing.T, name string, entries []*sstable.IndexRecord) {
+	var ctx = context.Background()
+	var out *osfile.Writer
+	var rec *recordio.RecordWriter
+	var entry *sstable.IndexRecord
+	var err error
+
+	if out, err = osfile.Create(name); err != nil {
+		t.Fatal("Error creating index: ", err)
+	}
+	rec = recordio.NewRecordWriter(out)
+	for _, entry = range entries {
+		if err = rec.WriteMessage(ctx, entry); err != nil {
+			t.Fatal("Error writing index: ", err)
+		}
+	}
+	if err = out.Close(ctx); err != nil {
+		t.Fatal("Error closing index: ", err)
+	}
+}
+
+// expectProblems checks that the report describes exactly the problems
+// containing the specified strings.
+func expectProblems(t *testing.T, report *verifyReport, expected ...string) {
+	var i int
+
+	if len(report.Problems) != len(expected) {
+		t.Error("Expected ", len(expected), " problems, got ",
+			report.Problems)
+		return
+	}
+	for i = range expected {
+		if !strings.Contains(report.Problems[i], expected[i]) {
+			t.Error("Expected problem ", i, " to contain ", expected[i],
+				", got ", report.Problems[i])
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var ctx = context.Background()
+	var dir = t.TempDir()
+	var offsets = writeTable(t, dir)
+	var table = filepath.Join(dir, "table.sst")
+	var index = filepath.Join(dir, "table.idx")
+	var bad_index = filepath.Join(dir, "bad.idx")
+	var report *verifyReport
+	var data []byte
+	var err error
+
+	report, err = verify(ctx, table, index, 0)
+	if err != nil {
+		t.Fatal("Error verifying table: ", err)
+	}
+	if report.Records != 10 || report.IndexEntries != 3 {
+		t.Error("Unexpected report: ", report)
+	}
+	expectProblems(t, report)
+
+	// Entries pointing into a record, to a record with a compressed key and
+	// to a record with a smaller key.
+	writeIndex(t, bad_index, []*sstable.IndexRecord{
+		{Key: []byte("k02"), Offset: offsets[2] + 1},
+		{Key: []byte("k03"), Offset: offsets[3]},
+		{Key: []byte("k05"), Offset: offsets[4]},
+		{Key: []byte("k07"), Offset: offsets[7]},
+	})
+	report, err = verify(ctx, table, bad_index, 0)
+	if err != nil {
+		t.Fatal("Error verifying table: ", err)
+	}
+	expectProblems(t, report,
+		fmt.Sprintf("index entry 0 (\"k02\"): offset %d is not a record "+
+			"boundary", offsets[2]+1),
+		fmt.Sprintf("index entry 1 (\"k03\"): can't read from offset %d",
+			offsets[3]),
+		fmt.Sprintf("index entry 2 (\"k05\"): record at offset %d has "+
+			"smaller key \"k04\"", offsets[4]),
+		fmt.Sprintf("offset %d: record \"k02\" not reachable", offsets[2]))
+
+	// A truncated table.
+	if data, err = os.ReadFile(table); err != nil {
+		t.Fatal("Error reading table: ", err)
+	}
+	if err = os.WriteFile(table, data[:offsets[5]+3], 0644); err != nil {
+		t.Fatal("Error truncating table: ", err)
+	}
+	report, err = verify(ctx, table, "", 1)
+	if err != nil {
+		t.Fatal("Error verifying table: ", err)
+	}
+	if report.Records != 5 || report.NumProblems != 1 {
+		t.Error("Unexpected report: ", report)
+	}
+	expectProblems(t, report, fmt.Sprintf("offset %d: record 5 does not "+
+		"decode", offsets[5]))
+
+	_, err = verify(ctx, filepath.Join(dir, "missing"), "", 0)
+	if !os.IsNotExist(err) {
+		t.Error("Expected missing table to fail, got ", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/osfile"
+)
+
+/*
+verifyReport holds the results of verifying a table.
+*/
+type verifyReport struct {
+	Records      int64
+	IndexEntries int
+
+	// Descriptions of all problems found, up to the configured maximum.
+	Problems []string
+	// Number of problems found, including those not described.
+	NumProblems int
+
+	max_problems int
+}
+
+/*
+problem records a problem found in the table.
+*/
+func (r *verifyReport) problem(format string, args ...interface{}) {
+	r.NumProblems++
+	if r.max_problems <= 0 || len(r.Problems) < r.max_problems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+/*
+ignoreMergeOperator allows merge records to be decoded, without caring about
+the value they amount to.
+*/
+type ignoreMergeOperator struct{}
+
+func (ignoreMergeOperator) FullMerge(key, existing string, has_existing bool,
+	operands []string) (string, error) {
+	return "", nil
+}
+
+func (ignoreMergeOperator) PartialMerge(key, left, right string) (
+	string, bool) {
+	return "", false
+}
+
+/*
+verify checks the table, and its index if one is specified. Problems with the
+table are recorded in the report; errors are only returned if the files
+can't be accessed at all.
+*/
+func verify(ctx context.Context, table, index string, max_problems int) (
+	*verifyReport, error) {
+	var report = &verifyReport{max_problems: max_problems}
+	var data, idx *osfile.Reader
+	var reader *sstable.Reader
+	var entries []sstable.IndexEntry
+	var offsets []int64
+	var keys []string
+	var size int64
+	var err error
+
+	if data, err = osfile.Open(table); err != nil {
+		return nil, err
+	}
+	defer data.Close(ctx)
+	if size, err = data.Size(); err != nil {
+		return nil, err
+	}
+
+	if index != "" {
+		if idx, err = osfile.Open(index); err != nil {
+			return nil, err
+		}
+		defer idx.Close(ctx)
+
+		reader, err = sstable.NewReaderWithIdx(ctx, data, idx, false)
+	} else {
+		reader = sstable.NewReader(data)
+	}
+	if err == nil {
+		err = reader.SeekTo(ctx, 0)
+	}
+	if err != nil {
+		report.problem("table header does not decode: %v", err)
+		return report, nil
+	}
+	reader.SetMergeOperator(ignoreMergeOperator{})
+
+	offsets, keys = verifyRecords(ctx, reader, report)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if index == "" {
+		return report, nil
+	}
+
+	entries, err = reader.ReadIndex(ctx)
+	report.IndexEntries = len(entries)
+	if err != nil {
+		report.problem("index entry %d does not decode: %v", len(entries),
+			err)
+	}
+
+	verifyIndex(ctx, reader, entries, offsets, keys, size, report)
+
+	return report, nil
+}
+
+/*
+verifyRecords reads all records of the table, checking they decode and are
+in key order. The offsets and keys of all records read are returned.
+*/
+func verifyRecords(ctx context.Context, reader *sstable.Reader,
+	report *verifyReport) ([]int64, []string) {
+	var offsets []int64
+	var keys []string
+
+	for ctx.Err() == nil {
+		var offset = reader.Tell(ctx)
+		var key string
+		var err error
+
+		key, _, err = reader.ReadNextString(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Records can't be found past a broken one.
+			report.problem("offset %d: record %d does not decode: %v",
+				offset, len(keys), err)
+			break
+		}
+
+		if len(keys) > 0 && key < keys[len(keys)-1] {
+			report.problem("offset %d: key %q follows larger key %q",
+				offset, key, keys[len(keys)-1])
+		}
+
+		offsets = append(offsets, offset)
+		keys = append(keys, key)
+		report.Records++
+	}
+
+	return offsets, keys
+}
+
+/*
+verifyIndex checks that every index entry points to the start of a record
+with a key at or after the index key from which reading can start, and that
+every record can be found through the index.
+*/
+func verifyIndex(ctx context.Context, reader *sstable.Reader,
+	entries []sstable.IndexEntry, offsets []int64, keys []string,
+	size int64, report *verifyReport) {
+	var index_keys = make([]string, len(entries))
+	var records = make(map[int64]int)
+	var i int
+
+	for i = range offsets {
+		records[offsets[i]] = i
+	}
+
+	for i = range entries {
+		var entry = entries[i]
+		var record int
+		var key string
+		var ok bool
+		var err error
+
+		index_keys[i] = entry.Key
+
+		if i > 0 && entry.Key < entries[i-1].Key {
+			report.problem("index entry %d: key %q follows larger key %q",
+				i, entry.Key, entries[i-1].Key)
+		}
+		if entry.Offset < 0 || entry.Offset >= size {
+			report.problem("index entry %d (%q): offset %d outside of table",
+				i, entry.Key, entry.Offset)
+			continue
+		}
+		if record, ok = records[entry.Offset]; !ok {
+			report.problem(
+				"index entry %d (%q): offset %d is not a record boundary",
+				i, entry.Key, entry.Offset)
+			continue
+		}
+		if keys[record] < entry.Key {
+			report.problem(
+				"index entry %d (%q): record at offset %d has smaller key %q",
+				i, entry.Key, entry.Offset, keys[record])
+		}
+
+		// Reading has to be possible from here, e.g. with compressed keys.
+		if err = reader.SeekTo(ctx, entry.Offset); err == nil {
+			key, _, err = reader.ReadNextString(ctx)
+		}
+		if err == nil && key != keys[record] {
+			err = fmt.Errorf("got key %q instead of %q", key, keys[record])
+		}
+		if err != nil {
+			report.problem(
+				"index entry %d (%q): can't read from offset %d: %v",
+				i, entry.Key, entry.Offset, err)
+		}
+	}
+
+	if !sort.StringsAreSorted(index_keys) {
+		// Lookups are meaningless, and every record would be reported.
+		return
+	}
+
+	// Lookups start from the last entry with a key smaller than or equal to
+	// the one looked up, and read forward. If a key occurs more than once,
+	// finding any of its records is good enough.
+	for i = range keys {
+		var pos = sort.SearchStrings(index_keys, keys[i])
+		var start int64
+
+		if i+1 < len(keys) && keys[i+1] == keys[i] {
+			continue
+		}
+
+		if pos < len(entries) && entries[pos].Key == keys[i] {
+			start = entries[pos].Offset
+		} else if pos > 0 {
+			start = entries[pos-1].Offset
+		}
+
+		if start > offsets[i] {
+			report.problem("offset %d: record %q not reachable through the "+
+				"index, which starts lookups at offset %d", offsets[i],
+				keys[i], start)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package sstable
+
+import (
+	"context"
+	"errors"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+rawDictionaryID is the zstd dictionary ID used for raw content dictionaries,
+which are used if no dictionary could be trained from the samples.
+*/
+const rawDictionaryID = 32768
+
+/*
+dictHashBytes is the length of the byte sequences the dictionary builder
+looks for in the samples.
+*/
+const dictHashBytes = 6
+
+/*
+Err_UnsupportedCompression indicates that the values of a table have been
+compressed in a way which is not supported by this reader.
+*/
+var Err_UnsupportedCompression = errors.New(
+	"Unknown/unsupported compression")
+
+/*
+Err_DictionaryTraining indicates that no dictionary could be trained from the
+samples.
+*/
+var Err_DictionaryTraining = errors.New(
+	"Unable to train dictionary from samples")
+
+/*
+Err_CompressionWithoutHeader indicates that a compressed value was read before
+the table header describing the compression.
+*/
+var Err_CompressionWithoutHeader = errors.New(
+	"Compressed value without table header")
+
+/*
+SetValueCompression makes the writer compress all values using zstd with a
+dictionary trained from the first sample_records records. These are kept in
+memory until enough samples have been collected, or until the writer is
+closed; then, the dictionary is trained and stored in the table header, and
+all records are written out. max_dict_size limits the size of the dictionary.
+
+Values are compressed individually, so this mostly helps with tables holding
+large numbers of small, similar values. This must be called before the first
+record is written.
+*/
+func (w *Writer) SetValueCompression(sample_records int, max_dict_size int) {
+	if sample_records < 1 {
+		sample_records = 1
+	}
+	w.sample_records = sample_records
+	w.max_dict_size = max_dict_size
+}
+
+/*
+addCompressionSample holds on to a record for training the compression
+dictionary. Once enough samples have been collected, compression is started.
+*/
+func (w *Writer) addCompressionSample(
+	ctx context.Context, key, value string, operands []string) error {
+	var operand string
+
+	w.sample_keys = append(w.sample_keys, key)
+	w.sample_values = append(w.sample_values, value)
+	w.sample_merges = append(w.sample_merges, operands)
+	w.sample_size += int64(len(key) + len(value))
+	for _, operand = range operands {
+		w.sample_size += int64(len(operand))
+	}
+	w.last_key = key
+
+	if len(w.sample_keys) >= w.sample_records {
+		return w.startCompression(ctx)
+	}
+	return nil
+}
+
+/*
+startCompression trains the compression dictionary from the samples collected,
+writes the table header and then the sample records themselves.
+*/
+func (w *Writer) startCompression(ctx context.Context) error {
+	var header = w.tableHeader()
+	var samples [][]byte
+	var keys, values []string
+	var merges [][]string
+	var value string
+	var i int
+	var err error
+
+	for i, value = range w.sample_values {
+		// Merge records hold no value to be compressed.
+		if w.sample_merges[i] == nil {
+			samples = append(samples, []byte(value))
+		}
+	}
+
+	header.ValueCompression = TableHeader_ZSTD
+	header.CompressionDictionary, header.RawDictionaryId = trainDictionary(
+		samples, w.max_dict_size)
+
+	w.encoder, err = newEncoder(header)
+	if err != nil {
+		return err
+	}
+	if err = w.writeHeader(ctx, header); err != nil {
+		return err
+	}
+
+	keys = w.sample_keys
+	values = w.sample_values
+	merges = w.sample_merges
+	w.sample_records = 0
+	w.sample_keys = nil
+	w.sample_values = nil
+	w.sample_merges = nil
+	w.sample_size = 0
+	w.last_key = ""
+
+	for i = range keys {
+		err = w.writeRecord(ctx, keys[i], values[i], merges[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+trainDictionary builds a zstd dictionary of at most max_dict_size bytes from
+the samples. If the samples are insufficient for training a dictionary, the
+end of the samples is used as raw content dictionary instead, in which case
+a non-zero dictionary ID is returned.
+*/
+func trainDictionary(samples [][]byte, max_dict_size int) ([]byte, uint32) {
+	var raw []byte
+	var sample []byte
+	var zdict []byte
+	var err error
+
+	zdict, err = buildZstdDict(samples, max_dict_size)
+	if err == nil && len(zdict) > 0 {
+		return zdict, 0
+	}
+
+	for _, sample = range samples {
+		raw = append(raw, sample...)
+	}
+	if len(raw) > max_dict_size {
+		raw = raw[len(raw)-max_dict_size:]
+	}
+	if len(raw) == 0 {
+		return nil, 0
+	}
+
+	return raw, rawDictionaryID
+}
+
+/*
+buildZstdDict trains a zstd dictionary from the samples. The dictionary
+builder fails on samples without any recurring byte sequences, e.g. because
+they are all too short, so such samples are rejected upfront.
+*/
+func buildZstdDict(samples [][]byte, max_dict_size int) ([]byte, error) {
+	if max_dict_size < 1 || !hasRecurringSequences(samples) {
+		return nil, Err_DictionaryTraining
+	}
+
+	// Values are compressed at the default level, so tailor the dictionary
+	// for that.
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: max_dict_size,
+		HashBytes:   dictHashBytes,
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+}
+
+/*
+hasRecurringSequences determines whether any byte sequence occurs in more of
+the samples than the average one, which the dictionary builder requires.
+Like the builder, this only considers sequences starting at least 8 bytes
+before the end of a sample.
+*/
+func hasRecurringSequences(samples [][]byte) bool {
+	var counts = make(map[string]int)
+	var sample []byte
+	var total, count, i int
+
+	for _, sample = range samples {
+		var seen = make(map[string]bool)
+
+		for i = 0; i+8 <= len(sample); i++ {
+			var seq = string(sample[i : i+dictHashBytes])
+
+			if !seen[seq] {
+				seen[seq] = true
+				counts[seq]++
+				total++
+			}
+		}
+	}
+
+	for _, count = range counts {
+		if count > total/len(counts) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+newEncoder creates a zstd encoder using the dictionary from the table header.
+*/
+func newEncoder(header *TableHeader) (*zstd.Encoder, error) {
+	if header.RawDictionaryId != 0 {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderDictRaw(
+				header.RawDictionaryId, header.CompressionDictionary))
+	} else if len(header.CompressionDictionary) > 0 {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderDict(header.CompressionDictionary))
+	}
+
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+}
+
+/*
+newDecoder creates a zstd decoder using the dictionary from the table header.
+*/
+func newDecoder(header *TableHeader) (*zstd.Decoder, error) {
+	if header.RawDictionaryId != 0 {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderDictRaw(
+				header.RawDictionaryId, header.CompressionDictionary))
+	} else if len(header.CompressionDictionary) > 0 {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderDicts(header.CompressionDictionary))
+	}
+
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+}
@@ -0,0 +1,314 @@
+package sstable
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/recordio"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+tableIDSize is the length of the random IDs of encrypted tables.
+*/
+const tableIDSize = 16
+
+/*
+Labels for the additional authenticated data of the different kinds of
+encrypted records, so that records cannot be moved between them. See
+recordAAD.
+*/
+var (
+	aadData       = []byte("sstable data")
+	aadIndex      = []byte("sstable index")
+	aadTopIndex   = []byte("sstable top index")
+	aadDictionary = []byte("sstable dictionary")
+)
+
+/*
+Err_DecryptionFailed indicates that an encrypted record could not be
+authenticated, i.e. it has either been corrupted or tampered with, or the
+wrong key has been used.
+*/
+var Err_DecryptionFailed = errors.New(
+	"Decryption failed: record corrupted or wrong key")
+
+/*
+Err_NoKeyProvider indicates that an encrypted table was read without a key
+provider having been specified.
+*/
+var Err_NoKeyProvider = errors.New(
+	"Table is encrypted but no key provider was specified")
+
+/*
+Err_NotEncrypted indicates that a table was read using a key provider, but is
+not encrypted. Such tables are rejected since an unencrypted table could have
+been put in the place of an encrypted one.
+*/
+var Err_NotEncrypted = errors.New(
+	"Key provider specified but table is not encrypted")
+
+/*
+Err_UnsupportedEncryption indicates that a table has been encrypted in a way
+which is not supported by this reader.
+*/
+var Err_UnsupportedEncryption = errors.New(
+	"Unknown/unsupported encryption")
+
+/*
+KeyProvider supplies the AES keys for encrypting and decrypting tables. Keys
+are identified by an ID which is recorded in the header of every table, so
+that keys can be rotated while tables encrypted with older keys can still be
+read.
+*/
+type KeyProvider interface {
+	/*
+		CurrentKey returns the ID and contents of the key new tables should be
+		encrypted with. Keys must be 16, 24 or 32 bytes long.
+	*/
+	CurrentKey(ctx context.Context) (string, []byte, error)
+
+	/*
+		Key returns the contents of the key with the specified ID.
+	*/
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+/*
+newAEAD creates an AES-GCM cipher for the specified key.
+*/
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	var block cipher.Block
+	var err error
+
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+/*
+seal encrypts data with the specified cipher and a random nonce, which is
+prepended to the result.
+*/
+func seal(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	var nonce = make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+
+		aead.Overhead())
+	var err error
+
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+/*
+open decrypts and authenticates data produced by seal.
+*/
+func open(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	var plain []byte
+	var err error
+
+	if len(data) < aead.NonceSize() {
+		return nil, Err_DecryptionFailed
+	}
+
+	plain, err = aead.Open(nil, data[:aead.NonceSize()],
+		data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, Err_DecryptionFailed
+	}
+
+	return plain, nil
+}
+
+/*
+headerDigest hashes all fields of a table header as it is stored. The header
+is stored unencrypted, so it is authenticated by including the digest in the
+additional authenticated data of every encrypted record: changing any field
+makes all records fail authentication. Fields added to TableHeader need to be
+added here as well.
+*/
+func headerDigest(header *TableHeader) []byte {
+	var b []byte
+	var sum [sha256.Size]byte
+
+	b = binary.AppendUvarint(b, uint64(header.ValueCompression))
+	b = binary.AppendUvarint(b, uint64(len(header.CompressionDictionary)))
+	b = append(b, header.CompressionDictionary...)
+	b = binary.AppendUvarint(b, uint64(header.RawDictionaryId))
+	b = binary.AppendUvarint(b, uint64(header.Encryption))
+	b = binary.AppendUvarint(b, uint64(len(header.EncryptionKeyId)))
+	b = append(b, header.EncryptionKeyId...)
+	b = binary.AppendUvarint(b, uint64(len(header.TableId)))
+	b = append(b, header.TableId...)
+
+	sum = sha256.Sum256(b)
+	return sum[:]
+}
+
+/*
+recordAAD determines the additional authenticated data of an encrypted record
+of the specified kind. It binds the record to the table header, which holds
+the random ID of the table, and to the position of the record: its offset
+relative to the start of the table for data records, its offset in the index
+file for index records, and its number for top level index records, which are
+always read in full. This way, records can't be reordered, duplicated,
+dropped or moved between tables without failing authentication, except for
+records at the end of a file being cut off.
+*/
+func recordAAD(kind, digest []byte, position int64) []byte {
+	var ad = make([]byte, 0, len(kind)+len(digest)+8)
+
+	ad = append(ad, kind...)
+	ad = append(ad, digest...)
+	return binary.BigEndian.AppendUint64(ad, uint64(position))
+}
+
+/*
+SetEncryption makes the writer encrypt the table using AES-GCM with the current
+key of the key provider. Every record of the data and index files is encrypted
+individually; only the table header, which records the ID of the key, is
+written unencrypted, but authenticated along with every record. Encrypted
+tables can only be read from data and index files supporting seeks. This must
+be called before the first record is written.
+*/
+func (w *Writer) SetEncryption(ctx context.Context, keys KeyProvider) error {
+	var id string
+	var key []byte
+	var table_id = make([]byte, tableIDSize)
+	var err error
+
+	id, key, err = keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = rand.Read(table_id); err != nil {
+		return err
+	}
+
+	w.aead, err = newAEAD(key)
+	if err != nil {
+		return err
+	}
+	w.encryption_key_id = id
+	w.table_id = table_id
+
+	return nil
+}
+
+/*
+sealRecord encrypts a record of the specified kind at the specified position
+(see recordAAD) if encryption has been requested, and returns it unchanged
+otherwise.
+*/
+func (w *Writer) sealRecord(record []byte, kind []byte, position int64) (
+	[]byte, error) {
+	if w.aead == nil {
+		return record, nil
+	}
+
+	return seal(w.aead, record, recordAAD(kind, w.header_digest, position))
+}
+
+/*
+setupDecryption fetches the key specified in the table header and sets the
+reader up for decrypting records with it.
+*/
+func (r *Reader) setupDecryption(
+	ctx context.Context, header *TableHeader) error {
+	var key []byte
+	var err error
+
+	switch header.Encryption {
+	case TableHeader_UNENCRYPTED:
+		if r.keys != nil {
+			return Err_NotEncrypted
+		}
+		return nil
+	case TableHeader_AES_GCM:
+		break
+	default:
+		return Err_UnsupportedEncryption
+	}
+
+	if r.keys == nil {
+		return Err_NoKeyProvider
+	}
+
+	key, err = r.keys.Key(ctx, header.EncryptionKeyId)
+	if err != nil {
+		return err
+	}
+
+	r.aead, err = newAEAD(key)
+	if err != nil {
+		return err
+	}
+	r.header_digest = headerDigest(header)
+	return nil
+}
+
+/*
+filePosition determines the position of the next record read from in, relative
+to base, for authenticating it if the table is encrypted. Encrypted tables
+can only be read from files supporting seeks.
+*/
+func (r *Reader) filePosition(ctx context.Context, in filesystem.ReadCloser,
+	base int64) (int64, error) {
+	var sk filesystem.Seeker
+	var offset int64
+	var err error
+	var ok bool
+
+	if r.aead == nil {
+		return 0, nil
+	}
+
+	if sk, ok = in.(filesystem.Seeker); !ok {
+		return 0, Err_NotSeeker
+	}
+	if offset, err = sk.Tell(ctx); err != nil {
+		return 0, err
+	}
+	return offset - base, nil
+}
+
+/*
+readMessage reads the next record from in into pb, decrypting it first if the
+table is encrypted. kind and position describe the record as for recordAAD.
+*/
+func (r *Reader) readMessage(ctx context.Context, in *recordio.RecordReader,
+	pb proto.Message, kind []byte, position int64) error {
+	var record []byte
+	var err error
+
+	if r.aead == nil && r.keys != nil {
+		// The header of an encrypted table would have set up decryption.
+		return Err_NotEncrypted
+	}
+
+	record, err = in.ReadRecord(ctx)
+	if err != nil {
+		return err
+	}
+
+	if r.aead != nil {
+		record, err = open(
+			r.aead, record, recordAAD(kind, r.header_digest, position))
+		if err != nil {
+			return err
+		}
+	}
+
+	return proto.Unmarshal(record, pb)
+}
@@ -1,10 +1,15 @@
 package sstable
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/childoftheuniverse/filesystem-internal"
-	"golang.org/x/net/context"
+	"io"
 	"math/rand"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -163,6 +168,827 @@ func TestWriteAndReadStringMapIndexedNotCached(t *testing.T) {
 	}
 }
 
+// Write strings with a size based index and read individual ones back.
+func TestWriteAndReadEveryNBytesIndex(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(
+		ctx, buf, idx, IndexType_EVERY_N_BYTES, 64)
+	var reader *Reader
+	var k, v string
+	var err error
+
+	err = writer.WriteStringMap(ctx, testdata)
+	if err != nil {
+		t.Error("Error writing records: ", err)
+	}
+
+	// Reset position.
+	buf.Close(ctx)
+	idx.Close(ctx)
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if len(reader.entry_index_keys) < 2 ||
+		len(reader.entry_index_keys) >= len(testdata) {
+		t.Error("Unexpected number of index records: ",
+			len(reader.entry_index_keys))
+	}
+
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+}
+
+// Without key compression, index records are written along with the records,
+// so the index is complete even if the Writer isn't closed.
+func TestIndexWithoutClose(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 2)
+	var reader *Reader
+	var entries []IndexEntry
+	var i int
+	var err error
+
+	for i = 0; i < 10; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("key%02d", i), "value")
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+
+	// Reset position.
+	buf.Close(ctx)
+	idx.Close(ctx)
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	entries, err = reader.ReadIndex(ctx)
+	if err != nil || len(entries) != 5 || entries[4].Key != "key09" {
+		t.Error("Unexpected index: ", entries, ", ", err)
+	}
+}
+
+// Write strings with a two-level index and read individual ones back.
+func TestWriteAndReadPartitionedIndex(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var top_idx = internal.NewAnonymousFile()
+	var writer *Writer = NewPartitionedIndexWriter(
+		ctx, buf, idx, top_idx, IndexType_EVERY_N, 2, 3)
+	var reader *Reader
+	var k, v string
+	var err error
+
+	err = writer.WriteStringMap(ctx, testdata)
+	if err != nil {
+		t.Error("Error writing records: ", err)
+	}
+
+	// Reset position.
+	buf.Close(ctx)
+	idx.Close(ctx)
+	top_idx.Close(ctx)
+
+	reader, err = NewReaderWithPartitionedIdx(ctx, buf, idx, top_idx)
+	if err != nil {
+		t.Fatal("Error loading top level index: ", err)
+	}
+	if len(reader.top_index_keys) < 2 {
+		t.Error("Expected multiple index partitions, got ",
+			len(reader.top_index_keys))
+	}
+
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+
+	k, v, err = reader.ReadSubsequentString(ctx, "maa")
+	if err != nil {
+		t.Error("Error reading first record after maa: ", err)
+	}
+	if k != "mars" {
+		t.Error("Mismatched key: expected mars, got ", k)
+	}
+	if v != testdata["mars"] {
+		t.Error("Mismatched data: expected ", testdata["mars"], ", got ", v)
+	}
+}
+
+// Write strings with a hash index and look them up through it.
+func TestWriteAndReadHashIndex(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var hash_idx = internal.NewAnonymousFile()
+	var writer *Writer = NewWriter(ctx, buf)
+	var reader *Reader
+	var k, v string
+	var err error
+
+	writer.SetHashIndex(hash_idx)
+
+	err = writer.WriteStringMap(ctx, testdata)
+	if err != nil {
+		t.Error("Error writing records: ", err)
+	}
+	err = writer.Close(ctx)
+	if err != nil {
+		t.Fatal("Error writing hash index: ", err)
+	}
+
+	reader = NewReader(buf)
+	err = reader.SetHashIndex(ctx, hash_idx)
+	if err != nil {
+		t.Fatal("Error loading hash index: ", err)
+	}
+
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+
+	v, err = reader.ReadString(ctx, "nonexistent")
+	if err != nil {
+		t.Error("Error reading nonexistent record: ", err)
+	}
+	if len(v) > 0 {
+		t.Error("Reading nonexistent record returned ", v,
+			", should be nothing")
+	}
+}
+
+// Write strings with compressed keys and read them back in various ways.
+func TestWriteAndReadCompressedKeys(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var hash_idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 5)
+	var result_map = make(map[string]string)
+	var reader *Reader
+	var entries []IndexEntry
+	var entry IndexEntry
+	var keys []string
+	var offset int64
+	var k, v string
+	var err error
+
+	writer.SetKeyCompression(3)
+	writer.SetHashIndex(hash_idx)
+
+	err = writer.WriteStringMap(ctx, testdata)
+	if err != nil {
+		t.Error("Error writing records: ", err)
+	}
+	err = writer.Close(ctx)
+	if err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	// Linear read of everything.
+	reader = NewReader(buf)
+	err = reader.ReadAllStrings(ctx, result_map)
+	if err != nil {
+		t.Error("Error reading records: ", err)
+	}
+	for k, _ = range testdata {
+		if result_map[k] != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", result_map[k])
+		}
+	}
+	if len(result_map) != len(testdata) {
+		t.Error("Expected ", len(testdata), " records, got ", len(result_map))
+	}
+
+	// Lookups through the cached index.
+	buf.Close(ctx)
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+
+	// Blocks of five records have restart points at their first and fourth
+	// record, which lookups binary search.
+	if entries, err = reader.ReadIndex(ctx); err != nil || len(entries) != 5 {
+		t.Fatal("Unexpected index: ", entries, ", ", err)
+	}
+	for _, entry = range entries {
+		if len(entry.Restarts) != 2 || entry.Restarts[0] != entry.Offset {
+			t.Error("Unexpected restart points: ", entry)
+		}
+	}
+	for k = range testdata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if offset, err = reader.indexLookup(ctx, keys[8]); err != nil ||
+		offset != entries[0].Restarts[1] {
+		t.Error("Expected lookup to start at restart point ",
+			entries[0].Restarts[1], ", got ", offset, ", ", err)
+	}
+	if offset, err = reader.indexLookup(ctx, keys[6]); err != nil ||
+		offset != entries[0].Offset {
+		t.Error("Expected lookup to start at block ", entries[0].Offset,
+			", got ", offset, ", ", err)
+	}
+
+	// Lookups through the hash index.
+	err = reader.SetHashIndex(ctx, hash_idx)
+	if err != nil {
+		t.Fatal("Error loading hash index: ", err)
+	}
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, " through hash index: ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+}
+
+// Keys needn't be valid UTF-8, even when compressed keys share a prefix
+// ending in the middle of a character.
+func TestWriteAndReadNonUTF8Keys(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 2)
+	var keys = []string{"caf\xc3\xa8", "caf\xc3\xa9", "\xfe\x00", "\xff"}
+	var reader *Reader
+	var k, v string
+	var err error
+
+	writer.SetKeyCompression(4)
+	for _, k = range keys {
+		if err = writer.WriteString(ctx, k, "value "+k); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	for _, k = range keys {
+		if v, err = reader.ReadString(ctx, k); err != nil || v != "value "+k {
+			t.Errorf("Mismatched data for %q: got %q, %v", k, v, err)
+		}
+	}
+}
+
+// failingWriter fails the write with the specified number without writing
+// anything.
+type failingWriter struct {
+	*internal.AnonymousFile
+	fail  int
+	count int
+}
+
+func (f *failingWriter) Write(ctx context.Context, p []byte) (int, error) {
+	f.count++
+	if f.count == f.fail {
+		return 0, errors.New("Write failed")
+	}
+	return f.AnonymousFile.Write(ctx, p)
+}
+
+// A failed write must not count towards the index.
+func TestWriteFailureKeepsIndexState(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx,
+		&failingWriter{AnonymousFile: buf, fail: 2}, idx, IndexType_EVERY_N, 2)
+	var reader *Reader
+	var entries []IndexEntry
+	var v string
+	var err error
+
+	writer.SetKeyCompression(2)
+	if err = writer.WriteString(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.WriteString(ctx, "b", "2"); err == nil {
+		t.Fatal("Expected write to fail")
+	}
+	if err = writer.WriteString(ctx, "b", "2"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.WriteString(ctx, "c", "3"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if entries, err = reader.ReadIndex(ctx); err != nil || len(entries) != 1 ||
+		entries[0].Key != "b" {
+		t.Error("Expected b to be indexed, got ", entries, ", ", err)
+	}
+	if v, err = reader.ReadString(ctx, "c"); err != nil || v != "3" {
+		t.Error("Mismatched data for c: got ", v, ", ", err)
+	}
+}
+
+// Write compressed values, training the dictionary on various sample sizes, and
+// read them back.
+func TestWriteAndReadCompressedValues(t *testing.T) {
+	var ctx = context.Background()
+	var data = make(map[string]string)
+	var sample_records int
+	var i int
+
+	for i = 0; i < 500; i++ {
+		data[fmt.Sprintf("key%05d", i)] = fmt.Sprintf(
+			"{\"id\": %d, \"name\": \"record %d\", \"tags\": [\"a\", \"b\"]}", i, i)
+	}
+
+	for _, sample_records = range []int{100, 1000} {
+		var buf = internal.NewAnonymousFile()
+		var idx = internal.NewAnonymousFile()
+		var writer *Writer = NewIndexedWriter(
+			ctx, buf, idx, IndexType_EVERY_N, 16)
+		var result_map = make(map[string]string)
+		var reader *Reader
+		var k, v string
+		var err error
+
+		writer.SetValueCompression(sample_records, 4096)
+
+		err = writer.WriteStringMap(ctx, data)
+		if err != nil {
+			t.Error("Error writing records: ", err)
+		}
+		err = writer.Close(ctx)
+		if err != nil {
+			t.Fatal("Error closing writer: ", err)
+		}
+
+		reader = NewReader(buf)
+		err = reader.ReadAllStrings(ctx, result_map)
+		if err != nil {
+			t.Error("Error reading records: ", err)
+		}
+		if len(result_map) != len(data) {
+			t.Error("Expected ", len(data), " records, got ", len(result_map))
+		}
+		for k, v = range data {
+			if result_map[k] != v {
+				t.Error("Mismatched data for ", k, ": expected ", v, ", got ",
+					result_map[k])
+			}
+		}
+
+		// Reset position.
+		buf.Close(ctx)
+		reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+		if err != nil {
+			t.Fatal("Error loading index: ", err)
+		}
+		v, err = reader.ReadString(ctx, "key00321")
+		if err != nil {
+			t.Error("Error reading record key00321: ", err)
+		}
+		if v != data["key00321"] {
+			t.Error("Mismatched data: expected ", data["key00321"], ", got ", v)
+		}
+	}
+}
+
+// Write a table with a header after some unrelated data and make sure it can
+// be read from where it starts.
+func TestReadTableAtNonzeroOffset(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var preamble = []byte("preamble")
+	var writer *Writer
+	var reader *Reader
+	var k, v string
+	var i int
+	var err error
+
+	if _, err = buf.Write(ctx, preamble); err != nil {
+		t.Fatal("Error writing preamble: ", err)
+	}
+	writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 8)
+	writer.SetValueCompression(10, 1024)
+	for i = 0; i < 50; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("key%03d", i),
+			fmt.Sprintf("value %d", i))
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	if _, err = buf.Seek(ctx, int64(len(preamble)), io.SeekStart); err != nil {
+		t.Fatal("Error seeking to table: ", err)
+	}
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if v, err = reader.ReadString(ctx, "key042"); err != nil ||
+		v != "value 42" {
+		t.Error("Mismatched data for key042: got ", v, ", ", err)
+	}
+	if err = reader.SeekTo(ctx, 0); err != nil {
+		t.Fatal("Error seeking to start: ", err)
+	}
+	if k, v, err = reader.ReadNextString(ctx); err != nil || k != "key000" ||
+		v != "value 0" {
+		t.Error("Unexpected first record: ", k, ", ", v, ", ", err)
+	}
+
+	// NewReader only reads the header when it's first used, from wherever
+	// the data file is positioned by then.
+	reader = NewReader(buf)
+	if _, err = buf.Seek(ctx, int64(len(preamble)), io.SeekStart); err != nil {
+		t.Fatal("Error seeking to table: ", err)
+	}
+	if err = reader.SeekTo(ctx, 0); err != nil {
+		t.Fatal("Error seeking to start: ", err)
+	}
+	if k, v, err = reader.ReadNextString(ctx); err != nil || k != "key000" ||
+		v != "value 0" {
+		t.Error("Unexpected first record: ", k, ", ", v, ", ", err)
+	}
+}
+
+func TestTrainDictionaryDegenerateSamples(t *testing.T) {
+	var samples [][]byte
+	var id uint32
+
+	// Too short for any sequence to be considered.
+	samples = [][]byte{[]byte("abc"), []byte("abcdefg")}
+	if _, id = trainDictionary(samples, 4096); id != rawDictionaryID {
+		t.Error("Expected raw dictionary for short samples, got ", id)
+	}
+
+	// No sequence occurs more often than the others.
+	samples = [][]byte{[]byte("0123456789"), []byte("abcdefghij")}
+	if _, id = trainDictionary(samples, 4096); id != rawDictionaryID {
+		t.Error("Expected raw dictionary for distinct samples, got ", id)
+	}
+
+	if _, id = trainDictionary(nil, 4096); id != 0 {
+		t.Error("Expected no dictionary without samples, got ", id)
+	}
+}
+
+// testKeyProvider is a KeyProvider handing out fixed keys.
+type testKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *testKeyProvider) CurrentKey(ctx context.Context) (
+	string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *testKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	return p.keys[id], nil
+}
+
+// Write an encrypted table and read it back with the right and wrong keys.
+func TestWriteAndReadEncrypted(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 4)
+	var keys = &testKeyProvider{
+		current: "key2",
+		keys: map[string][]byte{
+			"key1": []byte("0123456789abcdef"),
+			"key2": []byte("fedcba9876543210"),
+		},
+	}
+	var result_map = make(map[string]string)
+	var reader *Reader
+	var k, v string
+	var err error
+
+	err = writer.SetEncryption(ctx, keys)
+	if err != nil {
+		t.Fatal("Error setting up encryption: ", err)
+	}
+	writer.SetValueCompression(10, 1024)
+	writer.SetKeyCompression(4)
+
+	err = writer.WriteStringMap(ctx, testdata)
+	if err != nil {
+		t.Error("Error writing records: ", err)
+	}
+	err = writer.Close(ctx)
+	if err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	if reader, err = NewEncryptedReader(ctx, buf, keys); err != nil {
+		t.Fatal("Error reading table header: ", err)
+	}
+	err = reader.ReadAllStrings(ctx, result_map)
+	if err != nil {
+		t.Error("Error reading records: ", err)
+	}
+	if len(result_map) != len(testdata) {
+		t.Error("Expected ", len(testdata), " records, got ", len(result_map))
+	}
+
+	// Reset position.
+	buf.Close(ctx)
+	reader, err = NewEncryptedReaderWithIdx(ctx, buf, idx, true, keys)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+
+	// Reset position.
+	buf.Close(ctx)
+	_, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != Err_NoKeyProvider {
+		t.Error("Expected Err_NoKeyProvider without key provider, got ", err)
+	}
+
+	// Reset position, and pretend the key has been replaced under the same ID.
+	buf.Close(ctx)
+	keys.keys["key2"] = keys.keys["key1"]
+	_, err = NewEncryptedReaderWithIdx(ctx, buf, idx, true, keys)
+	if err != Err_DecryptionFailed {
+		t.Error("Expected Err_DecryptionFailed with wrong key, got ", err)
+	}
+}
+
+// writeEncrypted writes an encrypted table with an index entry for every
+// record.
+func writeEncrypted(t *testing.T, keys KeyProvider, records ...string) (
+	*internal.AnonymousFile, *internal.AnonymousFile) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 1)
+	var k string
+	var err error
+
+	if err = writer.SetEncryption(ctx, keys); err != nil {
+		t.Fatal("Error setting up encryption: ", err)
+	}
+	for _, k = range records {
+		if err = writer.WriteString(ctx, k, "value "+k); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	return buf, idx
+}
+
+// readFile returns the contents of a file.
+func readFile(t *testing.T, f *internal.AnonymousFile) []byte {
+	var ctx = context.Background()
+	var data []byte
+	var p = make([]byte, 1024)
+	var n int
+	var err error
+
+	f.Close(ctx)
+	for {
+		n, err = f.Read(ctx, p)
+		data = append(data, p[:n]...)
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Fatal("Error reading file: ", err)
+		}
+	}
+}
+
+// Encrypted records can't be moved within or between tables, and unencrypted
+// tables aren't accepted in their place.
+func TestEncryptionTampering(t *testing.T) {
+	var ctx = context.Background()
+	var keys = &testKeyProvider{
+		current: "key",
+		keys:    map[string][]byte{"key": []byte("0123456789abcdef")},
+	}
+	var buf, idx = writeEncrypted(t, keys, "a", "b", "c")
+	var other_buf, other_idx = writeEncrypted(t, keys, "a", "b", "c")
+	var swapped = internal.NewAnonymousFile()
+	var plain = internal.NewAnonymousFile()
+	var writer *Writer
+	var reader *Reader
+	var entries []IndexEntry
+	var data []byte
+	var err error
+
+	// Records of another table with the same key and layout.
+	_, err = NewEncryptedReaderWithIdx(ctx, buf, other_idx, true, keys)
+	if err != Err_DecryptionFailed {
+		t.Error("Expected index of other table to fail, got ", err)
+	}
+	buf.Close(ctx)
+	reader, err = NewEncryptedReaderWithIdx(ctx, other_buf, idx, false, keys)
+	if err != nil {
+		t.Fatal("Error reading table header: ", err)
+	}
+	if _, err = reader.ReadString(ctx, "b"); err != Err_DecryptionFailed {
+		t.Error("Expected index of other table to fail, got ", err)
+	}
+
+	// The first two records swapped.
+	buf.Close(ctx)
+	idx.Close(ctx)
+	reader, err = NewEncryptedReaderWithIdx(ctx, buf, idx, false, keys)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if entries, err = reader.ReadIndex(ctx); err != nil || len(entries) != 3 {
+		t.Fatal("Unexpected index: ", entries, ", ", err)
+	}
+	data = readFile(t, buf)
+	swapped.Write(ctx, data[:entries[0].Offset])
+	swapped.Write(ctx, data[entries[1].Offset:entries[2].Offset])
+	swapped.Write(ctx, data[entries[0].Offset:entries[1].Offset])
+	swapped.Write(ctx, data[entries[2].Offset:])
+	swapped.Close(ctx)
+	if reader, err = NewEncryptedReader(ctx, swapped, keys); err != nil {
+		t.Fatal("Error reading table header: ", err)
+	}
+	if _, _, err = reader.ReadNextString(ctx); err != Err_DecryptionFailed {
+		t.Error("Expected swapped records to fail, got ", err)
+	}
+
+	// An unencrypted table read with a key provider.
+	writer = NewWriter(ctx, plain)
+	if err = writer.WriteString(ctx, "a", "value a"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+	if _, err = NewEncryptedReader(ctx, plain, keys); err != Err_NotEncrypted {
+		t.Error("Expected unencrypted table to fail, got ", err)
+	}
+
+	// Empty encrypted tables still have a header to tell them apart.
+	buf, _ = writeEncrypted(t, keys)
+	if reader, err = NewEncryptedReader(ctx, buf, keys); err != nil {
+		t.Fatal("Error reading table header: ", err)
+	}
+	if _, _, err = reader.ReadNextString(ctx); err != io.EOF {
+		t.Error("Expected empty table, got ", err)
+	}
+}
+
+// Fill a memtable, also concurrently, and flush it to an indexed sstable.
+func TestMemtableFlush(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(ctx, buf, idx, IndexType_EVERY_N, 3)
+	var memtable = NewMemtable()
+	var it *MemtableIterator
+	var reader *Reader
+	var wg sync.WaitGroup
+	var keys []string
+	var k, v string
+	var ok bool
+	var i int
+	var err error
+
+	for i = 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			var k, v string
+
+			defer wg.Done()
+			for k, v = range testdata {
+				memtable.Put(k, v)
+			}
+			memtable.Put(fmt.Sprintf("zz%d", i), "temporary")
+		}(i)
+	}
+	wg.Wait()
+
+	for i = 0; i < 4; i++ {
+		memtable.Delete(fmt.Sprintf("zz%d", i))
+	}
+
+	if memtable.Len() != len(testdata) {
+		t.Error("Expected ", len(testdata), " keys, got ", memtable.Len())
+	}
+	if memtable.ApproximateSize() <= 0 {
+		t.Error("Expected a positive size, got ", memtable.ApproximateSize())
+	}
+	if v, ok = memtable.Get("zz0"); ok {
+		t.Error("Deleted key still has value ", v)
+	}
+
+	it = memtable.NewIterator()
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if it.Value() != testdata[it.Key()] {
+			t.Error("Mismatched data for ", it.Key(), ": expected ",
+				testdata[it.Key()], ", got ", it.Value())
+		}
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) != len(testdata) {
+		t.Error("Iterated over unexpected keys ", keys)
+	}
+
+	it.Seek("cas")
+	if !it.Next() || it.Key() != "cat" {
+		t.Error("Seek to cas ended up at ", it.Key())
+	}
+
+	if err = memtable.FlushTo(ctx, writer); err != nil {
+		t.Fatal("Error flushing memtable: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error creating reader: ", err)
+	}
+	for k, _ = range testdata {
+		v, err = reader.ReadString(ctx, k)
+		if err != nil {
+			t.Error("Error reading record ", k, ": ", err)
+		}
+		if v != testdata[k] {
+			t.Error("Mismatched data for ", k, ": expected ", testdata[k],
+				", got ", v)
+		}
+	}
+}
+
 // Write collection strings without index and attempt to read all of them back.
 func TestWriteAndReadStringMapNotIndexed(t *testing.T) {
 	var ctx = context.Background()
@@ -321,3 +1147,477 @@ func BenchmarkIndexedNonCachedLookup(b *testing.B) {
 	b.StopTimer()
 	b.ReportAllocs()
 }
+
+// appendOperator is a MergeOperator appending operands to the value,
+// separated by commas.
+type appendOperator struct{}
+
+func (appendOperator) FullMerge(key, existing string, has_existing bool,
+	operands []string) (string, error) {
+	var operand string
+
+	for _, operand = range operands {
+		if has_existing {
+			existing += ","
+		}
+		existing += operand
+		has_existing = true
+	}
+	return existing, nil
+}
+
+func (appendOperator) PartialMerge(key, left, right string) (string, bool) {
+	return left + "," + right, true
+}
+
+// Write merge records between regular records, with and without value
+// compression, and read them back through a merge operator.
+func TestWriteAndReadMergeRecords(t *testing.T) {
+	var ctx = context.Background()
+	var sample_records int
+
+	for _, sample_records = range []int{0, 2} {
+		var buf = internal.NewAnonymousFile()
+		var idx = internal.NewAnonymousFile()
+		var writer *Writer = NewIndexedWriter(
+			ctx, buf, idx, IndexType_EVERY_N, 2)
+		var result_map = make(map[string]string)
+		var reader *Reader
+		var v string
+		var err error
+
+		if sample_records > 0 {
+			writer.SetValueCompression(sample_records, 4096)
+		}
+		if err = writer.WriteString(ctx, "a", "plain"); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+		if err = writer.WriteMerge(ctx, "a", "x"); err != Err_MergeAfterRecord {
+			t.Error("Expected merge record after a to fail, got ", err)
+		}
+		if err = writer.WriteMerge(ctx, "b", "x", "y"); err != nil {
+			t.Fatal("Error writing merge record: ", err)
+		}
+		if err = writer.WriteMerge(ctx, "c"); err != Err_NoMergeOperands {
+			t.Error("Expected empty merge record to fail, got ", err)
+		}
+		if err = writer.WriteMerge(ctx, "d", "z\xff"); err != nil {
+			t.Fatal("Error writing merge record: ", err)
+		}
+		if err = writer.Close(ctx); err != nil {
+			t.Fatal("Error closing writer: ", err)
+		}
+
+		reader = NewReader(buf)
+		if err = reader.ReadAllStrings(ctx, result_map); err != Err_NoMergeOperator {
+			t.Error("Expected reading merge records to fail, got ", err)
+		}
+
+		// Reset position.
+		buf.Close(ctx)
+		reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+		if err != nil {
+			t.Fatal("Error loading index: ", err)
+		}
+		reader.SetMergeOperator(appendOperator{})
+		if v, err = reader.ReadString(ctx, "b"); err != nil || v != "x,y" {
+			t.Error("Mismatched data for b: got ", v, ", ", err)
+		}
+		if v, err = reader.ReadString(ctx, "a"); err != nil || v != "plain" {
+			t.Error("Mismatched data for a: got ", v, ", ", err)
+		}
+
+		reader.SeekTo(ctx, 0)
+		if err = reader.ReadAllStrings(ctx, result_map); err != nil {
+			t.Error("Error reading records: ", err)
+		}
+		if len(result_map) != 3 || result_map["d"] != "z\xff" {
+			t.Error("Unexpected records: ", result_map)
+		}
+	}
+}
+
+func TestSplitAtKeys(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var writer *Writer = NewWriter(ctx, buf)
+	var outputs []*internal.AnonymousFile
+	var shards []Shard
+	var reader *Reader
+	var v string
+	var err error
+
+	if err = writer.WriteString(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.WriteMerge(ctx, "b", "x", "y"); err != nil {
+		t.Fatal("Error writing merge record: ", err)
+	}
+	if err = writer.WriteString(ctx, "c", "3"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader = NewReader(buf)
+	shards, err = reader.SplitAtKeys(ctx, []string{"b", "x"},
+		func(ctx context.Context, shard int) (*Writer, error) {
+			var out = internal.NewAnonymousFile()
+
+			outputs = append(outputs, out)
+			return NewWriter(ctx, out), nil
+		})
+	if err != nil {
+		t.Fatal("Error splitting table: ", err)
+	}
+	if len(shards) != 3 || len(outputs) != 3 ||
+		shards[0].FirstKey != "a" || shards[0].LastKey != "a" ||
+		shards[0].Records != 1 || shards[0].Size == 0 ||
+		shards[1].FirstKey != "b" || shards[1].LastKey != "c" ||
+		shards[1].Records != 2 || shards[2].Records != 0 {
+		t.Fatal("Unexpected shards: ", shards)
+	}
+
+	// The merge record is copied without being folded.
+	reader = NewReader(outputs[1])
+	reader.SetMergeOperator(appendOperator{})
+	if _, v, err = reader.ReadNextString(ctx); err != nil || v != "x,y" {
+		t.Error("Mismatched data for b: got ", v, ", ", err)
+	}
+
+	reader = NewReader(buf)
+	if _, err = reader.SplitAtKeys(ctx, []string{"b", "b"},
+		nil); err != Err_UnsortedSplitKeys {
+		t.Error("Expected unsorted split keys to fail, got ", err)
+	}
+}
+
+func TestRollingWriter(t *testing.T) {
+	var ctx = context.Background()
+	var outputs []*internal.AnonymousFile
+	var create = func(ctx context.Context, table int) (*Writer, error) {
+		var out = internal.NewAnonymousFile()
+
+		outputs = append(outputs, out)
+		return NewWriter(ctx, out), nil
+	}
+	var writer *RollingWriter
+	var reader *Reader
+	var tables []Shard
+	var key, v string
+	var err error
+
+	// Tables hold two records, unless the key repeats.
+	writer = NewRollingWriter(create, 0, 2)
+	for _, key = range []string{"a", "b", "b", "b", "c", "d", "e"} {
+		if err = writer.WriteString(ctx, key, "value "+key); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	err = writer.WriteString(ctx, "d", "value d")
+	if err != Err_KeyOrderViolation {
+		t.Error("Expected key order violation, got ", err)
+	}
+	if tables, err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+	if len(tables) != 3 || len(outputs) != 3 ||
+		tables[0].FirstKey != "a" || tables[0].LastKey != "b" ||
+		tables[0].Records != 4 || tables[1].FirstKey != "c" ||
+		tables[1].Records != 2 || tables[2].LastKey != "e" ||
+		tables[2].Size == 0 {
+		t.Fatal("Unexpected tables: ", tables)
+	}
+
+	reader = NewReader(outputs[1])
+	if key, v, err = reader.ReadNextString(ctx); err != nil ||
+		key != "c" || v != "value c" {
+		t.Error("Mismatched first record of table 1: ", key, ", ", v, ", ",
+			err)
+	}
+
+	// Every table is full after its first record.
+	outputs = nil
+	writer = NewRollingWriter(create, 1, 0)
+	for _, key = range []string{"a", "b", "c"} {
+		if err = writer.WriteString(ctx, key, "value "+key); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if tables, err = writer.Close(ctx); err != nil || len(tables) != 3 {
+		t.Error("Unexpected tables: ", tables, ", ", err)
+	}
+
+	// Records still held back for training the compression dictionary count
+	// towards the size limit.
+	writer = NewRollingWriter(
+		func(ctx context.Context, table int) (*Writer, error) {
+			var w, err = create(ctx, table)
+
+			if err == nil {
+				w.SetValueCompression(100, 1024)
+			}
+			return w, err
+		}, 1, 0)
+	for _, key = range []string{"a", "b", "c"} {
+		if err = writer.WriteString(ctx, key, "value "+key); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if tables, err = writer.Close(ctx); err != nil || len(tables) != 3 {
+		t.Error("Unexpected compressed tables: ", tables, ", ", err)
+	}
+
+	if tables, err = NewRollingWriter(create, 1, 0).Close(ctx); err != nil ||
+		len(tables) != 0 {
+		t.Error("Expected no tables, got ", tables, ", ", err)
+	}
+}
+
+func TestApproximateSizes(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(
+		ctx, buf, idx, IndexType_EVERY_N, 10)
+	var reader *Reader
+	var offsets = make(map[string]int64)
+	var entries []IndexEntry
+	var offset, size, records int64
+	var k string
+	var i int
+	var err error
+
+	for i = 0; i < 100; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("key%02d", i), "value")
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	for i = 0; i < 100; i++ {
+		offsets[fmt.Sprintf("key%02d", i)] = reader.Tell(ctx)
+		if _, _, err = reader.ReadNextString(ctx); err != nil {
+			t.Fatal("Error reading record: ", err)
+		}
+	}
+	size = reader.Tell(ctx)
+
+	// Every tenth record is indexed, starting with key09.
+	entries, err = reader.ReadIndex(ctx)
+	if err != nil || len(entries) != 10 || entries[0].Key != "key09" ||
+		entries[0].Records != 10 {
+		t.Fatal("Unexpected index: ", entries, ", ", err)
+	}
+
+	if offset, err = reader.ApproximateOffsetOf(ctx, "key19"); err != nil ||
+		offset != offsets["key19"] {
+		t.Error("Expected exact offset for indexed key, got ", offset, ", ",
+			err)
+	}
+	if offset, err = reader.ApproximateOffsetOf(ctx, "key25"); err != nil ||
+		offset <= offsets["key19"] || offset >= offsets["key29"] {
+		t.Error("Offset of key25 outside of surrounding entries: ", offset,
+			", ", err)
+	}
+	if offset, err = reader.ApproximateOffsetOf(ctx, "z"); err != nil ||
+		offset <= offsets["key99"] || offset >= size {
+		t.Error("Offset past last index entry outside of table: ", offset,
+			", ", err)
+	}
+
+	if offset, err = reader.ApproximateSize(ctx, "", ""); err != nil ||
+		offset != size {
+		t.Error("Expected size of table, got ", offset, ", ", err)
+	}
+	records, err = reader.ApproximateRecords(ctx, "key19", "key39")
+	if err != nil || records != 20 {
+		t.Error("Expected 20 records, got ", records, ", ", err)
+	}
+	if records, err = reader.ApproximateRecordCount(ctx); err != nil ||
+		records != 100 {
+		t.Error("Expected 100 records, got ", records, ", ", err)
+	}
+
+	// Estimates don't disturb reading.
+	if err = reader.SeekTo(ctx, offsets["key50"]); err != nil {
+		t.Fatal("Error seeking: ", err)
+	}
+	if _, err = reader.ApproximateSize(ctx, "key10", "key20"); err != nil {
+		t.Error("Error estimating size: ", err)
+	}
+	if k, _, err = reader.ReadNextString(ctx); err != nil || k != "key50" {
+		t.Error("Expected to read key50, got ", k, ", ", err)
+	}
+
+	// Without an index, there's nothing to estimate from.
+	reader = NewReader(buf)
+	if _, err = reader.ApproximateSize(ctx, "", ""); err != Err_NoIndexEntries {
+		t.Error("Expected missing index to fail, got ", err)
+	}
+}
+
+func TestSampleKeysAndQuantiles(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(
+		ctx, buf, idx, IndexType_EVERY_N, 10)
+	var reader *Reader
+	var keys []string
+	var key string
+	var i int
+	var err error
+
+	for i = 0; i < 100; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("key%02d", i), "value")
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	keys, err = reader.SampleKeys(ctx, 5)
+	if err != nil || fmt.Sprint(keys) != "[key09 key29 key49 key69 key89]" {
+		t.Error("Unexpected sample: ", keys, ", ", err)
+	}
+	if keys, err = reader.SampleKeys(ctx, 20); err != nil || len(keys) != 10 {
+		t.Error("Expected all index keys, got ", keys, ", ", err)
+	}
+	keys, err = reader.Quantiles(ctx, 4)
+	if err != nil || fmt.Sprint(keys) != "[key29 key59 key79]" {
+		t.Error("Unexpected quantiles: ", keys, ", ", err)
+	}
+
+	// Without an index, keys are sampled from the data.
+	reader = NewReader(buf)
+	if keys, err = reader.SampleKeys(ctx, 10); err != nil || len(keys) != 10 ||
+		!sort.StringsAreSorted(keys) || keys[0] < "key00" || keys[9] > "key99" {
+		t.Error("Unexpected sample: ", keys, ", ", err)
+	}
+	if keys, err = reader.Quantiles(ctx, 4); err != nil ||
+		fmt.Sprint(keys) != "[key25 key50 key75]" {
+		t.Error("Unexpected quantiles: ", keys, ", ", err)
+	}
+
+	// Most records follow the last indexed one here, so the quantiles have
+	// to account for them.
+	buf = internal.NewAnonymousFile()
+	idx = internal.NewAnonymousFile()
+	writer = NewIndexedWriter(ctx, buf, idx, IndexType_PREFIXLEN, 1)
+	for _, key = range []string{"a", "b"} {
+		if err = writer.WriteString(ctx, key, "value"); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	for i = 0; i < 20; i++ {
+		err = writer.WriteString(ctx, fmt.Sprintf("c%02d", i), "value")
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+	if keys, err = reader.Quantiles(ctx, 2); err != nil ||
+		fmt.Sprint(keys) != "[c]" {
+		t.Error("Unexpected quantiles: ", keys, ", ", err)
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	var ctx = context.Background()
+	var large = strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 3)
+	var restart_interval int
+
+	for _, restart_interval = range []int{0, 3} {
+		var buf = internal.NewAnonymousFile()
+		var idx = internal.NewAnonymousFile()
+		var writer *Writer = NewIndexedWriter(
+			ctx, buf, idx, IndexType_EVERY_N, 1)
+		var result_map = make(map[string]string)
+		var expected = map[string]string{
+			"a": "short",
+			"b": large,
+			"c": large[:25],
+			"d": large[:20],
+			"e": "",
+		}
+		var entries []IndexEntry
+		var reader *Reader
+		var stream io.Reader
+		var data []byte
+		var key string
+		var err error
+
+		if restart_interval > 0 {
+			writer.SetKeyCompression(restart_interval)
+		}
+		writer.SetChunkSize(10)
+		for _, key = range []string{"a", "b"} {
+			if err = writer.WriteString(ctx, key, expected[key]); err != nil {
+				t.Fatal("Error writing record: ", err)
+			}
+		}
+		for _, key = range []string{"c", "d", "e"} {
+			err = writer.WriteStream(ctx, key, strings.NewReader(expected[key]))
+			if err != nil {
+				t.Fatal("Error streaming record: ", err)
+			}
+		}
+		if err = writer.Close(ctx); err != nil {
+			t.Fatal("Error closing writer: ", err)
+		}
+
+		reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+		if err != nil {
+			t.Fatal("Error loading index: ", err)
+		}
+		if entries, err = reader.ReadIndex(ctx); err != nil || len(entries) != 5 {
+			t.Error("Expected one index entry per value, got ", entries, ", ", err)
+		}
+		if err = reader.ReadAllStrings(ctx, result_map); err != nil {
+			t.Error("Error reading records: ", err)
+		}
+		if fmt.Sprint(result_map) != fmt.Sprint(expected) {
+			t.Error("Unexpected records: ", result_map)
+		}
+
+		for _, key = range []string{"e", "c", "a", "b", "d"} {
+			if stream, err = reader.ReadStream(ctx, key); err != nil {
+				t.Error("Error streaming ", key, ": ", err)
+				continue
+			}
+			if data, err = io.ReadAll(stream); err != nil {
+				t.Error("Error reading stream of ", key, ": ", err)
+			}
+			if string(data) != expected[key] {
+				t.Error("Mismatched data for ", key, ": ", string(data))
+			}
+		}
+		if _, err = reader.ReadStream(ctx, "bb"); err != Err_KeyNotFound {
+			t.Error("Expected missing key not to be found, got ", err)
+		}
+		if _, err = reader.ReadStream(ctx, "f"); err != Err_KeyNotFound {
+			t.Error("Expected missing key not to be found, got ", err)
+		}
+	}
+}
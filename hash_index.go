@@ -0,0 +1,287 @@
+package sstable
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+
+	"github.com/childoftheuniverse/filesystem"
+)
+
+/*
+The hash index is a CDB-style hash table mapping keys to the offsets of the
+records in the data file. It is written by the Writer on Close and consists of
+a header of hashIndexTables table descriptors (offset and slot count of every
+table), followed by the tables themselves. Every slot holds the hash of a key
+and the offset of the corresponding record plus one, so that empty slots can
+be recognized by a zero offset. If keys are compressed, the offset is that of
+the restart point preceding the record. All integers are stored in little
+endian byte order.
+
+A key is assigned to a table by the lowest 8 bits of its hash, and to a slot
+within that table by the remaining bits. Collisions are resolved by linear
+probing.
+*/
+const (
+	hashIndexTables     = 256
+	hashIndexSlotSize   = 16
+	hashIndexHeaderSize = hashIndexTables * 16
+)
+
+/*
+Err_CorruptHashIndex indicates that the hash index could not be decoded.
+*/
+var Err_CorruptHashIndex = errors.New(
+	"Corrupt hash index")
+
+/*
+hashEntry associates the hash of a key with the offset of its record in the
+data file.
+*/
+type hashEntry struct {
+	hash   uint64
+	offset int64
+}
+
+/*
+hashTable describes the position of a single hash table in the hash index.
+*/
+type hashTable struct {
+	offset int64
+	slots  int64
+}
+
+/*
+hashKey computes the hash of the specified key as used in the hash index.
+*/
+func hashKey(key string) uint64 {
+	var h = fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+/*
+readFull reads exactly len(p) bytes from in, unless an error occurs.
+*/
+func readFull(ctx context.Context, in filesystem.ReadCloser, p []byte) error {
+	var n int
+
+	for n < len(p) {
+		var l int
+		var err error
+
+		l, err = in.Read(ctx, p[n:])
+		n += l
+		if err == io.EOF && n == len(p) {
+			return nil
+		}
+		if err == io.EOF && n > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if l == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+
+	return nil
+}
+
+/*
+SetHashIndex makes the writer produce a hash index for exact-key lookups into
+out_hash. The hash index is kept in memory while writing and only written out
+when the writer is closed. This must be called before the first record is
+written.
+*/
+func (w *Writer) SetHashIndex(out_hash filesystem.WriteCloser) {
+	w.out_hash = out_hash
+}
+
+/*
+writeHashIndex lays out the hash entries collected while writing in hash
+tables and writes them to the hash index output.
+*/
+func (w *Writer) writeHashIndex(ctx context.Context) error {
+	var tables [hashIndexTables][]hashEntry
+	var data []byte
+	var table_offset int64 = hashIndexHeaderSize
+	var entry hashEntry
+	var i int
+	var err error
+
+	for _, entry = range w.hash_entries {
+		var t = entry.hash % hashIndexTables
+		tables[t] = append(tables[t], entry)
+	}
+
+	data = make([]byte, hashIndexHeaderSize)
+
+	for i = 0; i < hashIndexTables; i++ {
+		var slots = uint64(2 * len(tables[i]))
+		var table []byte
+
+		binary.LittleEndian.PutUint64(data[i*16:], uint64(table_offset))
+		binary.LittleEndian.PutUint64(data[i*16+8:], slots)
+
+		table = make([]byte, slots*hashIndexSlotSize)
+		for _, entry = range tables[i] {
+			var slot = (entry.hash / hashIndexTables) % slots
+
+			// Linear probing; the table is never full.
+			for binary.LittleEndian.Uint64(
+				table[slot*hashIndexSlotSize+8:]) != 0 {
+				slot = (slot + 1) % slots
+			}
+
+			binary.LittleEndian.PutUint64(
+				table[slot*hashIndexSlotSize:], entry.hash)
+			binary.LittleEndian.PutUint64(
+				table[slot*hashIndexSlotSize+8:], uint64(entry.offset+1))
+		}
+
+		data = append(data, table...)
+		table_offset += int64(len(table))
+	}
+
+	_, err = w.out_hash.Write(ctx, data)
+	if err == nil {
+		w.hash_entries = nil
+	}
+	return err
+}
+
+/*
+SetHashIndex makes the reader use the hash index in in_hash, as written by
+Writer.SetHashIndex, for ReadString and ReadProto. Only the header of the hash
+index is read into memory; every lookup will then read the slots of the hash
+index it needs. Both the hash index and the data file must support seeking.
+*/
+func (r *Reader) SetHashIndex(
+	ctx context.Context, in_hash filesystem.ReadCloser) error {
+	var header = make([]byte, hashIndexHeaderSize)
+	var sk filesystem.Seeker
+	var tables []hashTable
+	var i int
+	var err error
+	var ok bool
+
+	sk, ok = in_hash.(filesystem.Seeker)
+	if !ok {
+		return Err_NotSeeker
+	}
+	if _, ok = r.orig_in.(filesystem.Seeker); !ok {
+		return Err_NotSeeker
+	}
+
+	if _, err = sk.Seek(ctx, 0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = readFull(ctx, in_hash, header); err != nil {
+		return err
+	}
+
+	tables = make([]hashTable, hashIndexTables)
+	for i = 0; i < hashIndexTables; i++ {
+		tables[i].offset = int64(binary.LittleEndian.Uint64(header[i*16:]))
+		tables[i].slots = int64(binary.LittleEndian.Uint64(header[i*16+8:]))
+		if tables[i].offset < hashIndexHeaderSize || tables[i].slots < 0 {
+			return Err_CorruptHashIndex
+		}
+	}
+
+	r.orig_in_hash = in_hash
+	r.hash_tables = tables
+	return nil
+}
+
+/*
+hashLookup finds the record for the specified key using the hash index. The
+value is returned along with a flag indicating whether the key was found.
+*/
+func (r *Reader) hashLookup(ctx context.Context, key string) (
+	string, bool, error) {
+	var sk = r.orig_in_hash.(filesystem.Seeker)
+	var h = hashKey(key)
+	var table = r.hash_tables[h%hashIndexTables]
+	var slot_data = make([]byte, hashIndexSlotSize)
+	var slot int64
+	var i int64
+	var err error
+
+	if table.slots == 0 {
+		return "", false, nil
+	}
+
+	slot = int64((h / hashIndexTables) % uint64(table.slots))
+
+	for i = 0; i < table.slots; i++ {
+		var slot_hash uint64
+		var offset uint64
+
+		_, err = sk.Seek(
+			ctx, table.offset+slot*hashIndexSlotSize, io.SeekStart)
+		if err != nil {
+			return "", false, err
+		}
+		if err = readFull(ctx, r.orig_in_hash, slot_data); err != nil {
+			return "", false, err
+		}
+
+		slot_hash = binary.LittleEndian.Uint64(slot_data)
+		offset = binary.LittleEndian.Uint64(slot_data[8:])
+		if offset == 0 {
+			// Empty slot; the key is not in the table.
+			return "", false, nil
+		}
+
+		if slot_hash == h {
+			var value string
+			var found bool
+
+			value, found, err = r.scanFromRestart(ctx, int64(offset-1), key)
+			if err != nil || found {
+				return value, found, err
+			}
+		}
+
+		slot = (slot + 1) % table.slots
+	}
+
+	return "", false, nil
+}
+
+/*
+scanFromRestart looks for the record with the specified key starting at the
+restart point at offset. Unless key compression is used, this is the record
+itself; otherwise, it can be at most one restart interval further down.
+*/
+func (r *Reader) scanFromRestart(
+	ctx context.Context, offset int64, key string) (string, bool, error) {
+	var err error
+
+	if err = r.SeekTo(ctx, offset); err != nil {
+		return "", false, err
+	}
+
+	for {
+		var rdata KeyValue
+
+		err = r.readKeyValue(ctx, &rdata)
+		if err == io.EOF {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if string(rdata.Key) == key {
+			return string(rdata.Value), true, nil
+		}
+		if string(rdata.Key) > key {
+			return "", false, nil
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package sstable
+
+import (
+	"context"
+	"io"
+
+	"github.com/childoftheuniverse/filesystem"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+tableHeader creates a new table header describing the writers settings.
+*/
+func (w *Writer) tableHeader() *TableHeader {
+	var header = new(TableHeader)
+
+	if w.aead != nil {
+		header.Encryption = TableHeader_AES_GCM
+		header.EncryptionKeyId = w.encryption_key_id
+		header.TableId = w.table_id
+	}
+
+	return header
+}
+
+/*
+writeHeader writes the table header as the first record of the data file. The
+header itself is never encrypted, but the compression dictionary in it is if
+the table is encrypted, and the header is authenticated along with every
+encrypted record.
+*/
+func (w *Writer) writeHeader(ctx context.Context, header *TableHeader) error {
+	var rdata KeyValue
+	var record []byte
+	var length int
+	var err error
+
+	if w.aead != nil && len(header.CompressionDictionary) > 0 {
+		header = proto.Clone(header).(*TableHeader)
+		header.CompressionDictionary, err = seal(w.aead,
+			header.CompressionDictionary, recordAAD(aadDictionary, w.table_id, 0))
+		if err != nil {
+			return err
+		}
+	}
+	if w.aead != nil {
+		w.header_digest = headerDigest(header)
+	}
+
+	rdata.Header = header
+
+	record, err = proto.Marshal(&rdata)
+	if err != nil {
+		return err
+	}
+
+	length, err = w.out.Write(ctx, record)
+	if err != nil {
+		return err
+	}
+	w.header_written = true
+
+	w.advanceOffset(ctx, length)
+	return nil
+}
+
+/*
+readHeader reads the table header, if any, unless it has been read already,
+so it is known before seeking around in the data file. The encrypted and
+indexed readers do so when they are created, NewReader before the first read
+or seek. The table is assumed to start at the current position of the data
+file at that time, which need not be its beginning; data_start is set to the
+offset of the first record following the header.
+
+This requires the data file to support seeking; otherwise, the header will
+only be picked up when reading the data file linearly.
+*/
+func (r *Reader) readHeader(ctx context.Context) error {
+	var sk filesystem.Seeker
+	var rdata KeyValue
+	var record []byte
+	var err error
+	var ok bool
+
+	if r.header_checked {
+		return nil
+	}
+
+	sk, ok = r.orig_in.(filesystem.Seeker)
+	if !ok {
+		if r.keys != nil {
+			// Encrypted tables can only be authenticated with seeks.
+			return Err_NotSeeker
+		}
+		r.header_checked = true
+		return nil
+	}
+
+	r.table_start, err = sk.Tell(ctx)
+	if err != nil {
+		return err
+	}
+	r.data_start = r.table_start
+	r.offset = r.data_start
+
+	record, err = r.in.ReadRecord(ctx)
+	if err == io.EOF {
+		if r.keys != nil {
+			return Err_NotEncrypted
+		}
+		r.header_checked = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = proto.Unmarshal(record, &rdata); err != nil {
+		return err
+	}
+
+	if rdata.Header != nil {
+		r.data_start, err = sk.Tell(ctx)
+		if err != nil {
+			return err
+		}
+		if err = r.applyHeader(ctx, rdata.Header); err != nil {
+			return err
+		}
+	}
+
+	if r.keys != nil && r.aead == nil {
+		return Err_NotEncrypted
+	}
+
+	// Leave the reader positioned at the first data record.
+	if _, err = sk.Seek(ctx, r.data_start, io.SeekStart); err != nil {
+		return err
+	}
+	r.offset = r.data_start
+	r.header_checked = true
+	return nil
+}
+
+/*
+applyHeader sets the reader up for decoding the records described by the
+table header.
+*/
+func (r *Reader) applyHeader(
+	ctx context.Context, header *TableHeader) error {
+	var err error
+
+	if r.header != nil {
+		// Header has been seen before.
+		return nil
+	}
+
+	if err = r.setupDecryption(ctx, header); err != nil {
+		return err
+	}
+
+	if r.aead != nil && len(header.CompressionDictionary) > 0 {
+		header = proto.Clone(header).(*TableHeader)
+		header.CompressionDictionary, err = open(r.aead,
+			header.CompressionDictionary,
+			recordAAD(aadDictionary, header.TableId, 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	switch header.ValueCompression {
+	case TableHeader_NONE:
+		break
+	case TableHeader_ZSTD:
+		r.decoder, err = newDecoder(header)
+		if err != nil {
+			return err
+		}
+		break
+	default:
+		return Err_UnsupportedCompression
+	}
+
+	r.header = header
+	return nil
+}
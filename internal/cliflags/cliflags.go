@@ -0,0 +1,61 @@
+/*
+Package cliflags defines the command line flags shared by the command line
+tools, so that they are named and documented the same way in all of them.
+*/
+package cliflags
+
+import (
+	"flag"
+
+	"github.com/childoftheuniverse/sstable"
+)
+
+/*
+indexTypes maps the names accepted by -index_type to index types.
+*/
+var indexTypes = map[string]int{
+	"none":          sstable.IndexType_NONE,
+	"every_n":       sstable.IndexType_EVERY_N,
+	"prefixlen":     sstable.IndexType_PREFIXLEN,
+	"every_n_bytes": sstable.IndexType_EVERY_N_BYTES,
+}
+
+/*
+IndexFlags holds the values of the flags selecting how tables written by a
+command are indexed.
+*/
+type IndexFlags struct {
+	index_type string
+	n          int
+}
+
+/*
+RegisterIndexFlags registers -index_type and -n with the flag set. Once the
+flags have been parsed, the index type is obtained from IndexType.
+*/
+func RegisterIndexFlags(fs *flag.FlagSet) *IndexFlags {
+	var f = new(IndexFlags)
+
+	fs.StringVar(&f.index_type, "index_type", "every_n_bytes",
+		"Index type: none, every_n, prefixlen or every_n_bytes")
+	fs.IntVar(&f.n, "n", 4096,
+		"Parameter of the index type: number of records, prefix length or "+
+			"number of bytes")
+	return f
+}
+
+/*
+IndexType resolves the flags into one of the sstable.IndexType_ constants and
+its parameter. The flag returned is false if the flags are invalid, i.e. the
+index type is unknown or the parameter isn't positive.
+*/
+func (f *IndexFlags) IndexType() (int, int, bool) {
+	var index_type int
+	var ok bool
+
+	index_type, ok = indexTypes[f.index_type]
+	if !ok || f.n < 1 {
+		return 0, 0, false
+	}
+	return index_type, f.n, true
+}
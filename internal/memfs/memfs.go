@@ -0,0 +1,204 @@
+/*
+Package memfs keeps files in memory, implementing the Storage interfaces of
+the lsm, wal and manifest packages. It is meant for tests.
+*/
+package memfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/childoftheuniverse/filesystem"
+)
+
+/*
+Storage keeps all files in memory. Files are only ever appended to, so
+readers see the contents of a file at the time it was opened.
+*/
+type Storage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	syncs int
+}
+
+/*
+NewStorage creates a new Storage without any files.
+*/
+func NewStorage() *Storage {
+	return &Storage{files: make(map[string][]byte)}
+}
+
+/*
+Create creates a new, empty file with the specified name, replacing any
+existing file of the same name.
+*/
+func (s *Storage) Create(ctx context.Context, name string) (
+	filesystem.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = nil
+	return &Writer{storage: s, name: name}, nil
+}
+
+/*
+Open opens an existing file for reading.
+*/
+func (s *Storage) Open(ctx context.Context, name string) (
+	filesystem.ReadCloser, error) {
+	var data []byte
+	var ok bool
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok = s.files[name]
+	if !ok {
+		return nil, errors.New("No such file: " + name)
+	}
+	return &Reader{data: data}, nil
+}
+
+/*
+Remove deletes the file with the specified name.
+*/
+func (s *Storage) Remove(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+/*
+List returns the names of all files, in sorted order.
+*/
+func (s *Storage) List(ctx context.Context) ([]string, error) {
+	var names []string
+	var name string
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name = range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/*
+Contents returns the current contents of the file with the specified name,
+or nil if there is no such file.
+*/
+func (s *Storage) Contents(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name]
+}
+
+/*
+SetContents replaces the contents of the file with the specified name, e.g.
+to simulate corruption.
+*/
+func (s *Storage) SetContents(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+/*
+Syncs returns the number of times any file has been synced.
+*/
+func (s *Storage) Syncs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+/*
+Writer appends to a file in a Storage.
+*/
+type Writer struct {
+	storage *Storage
+	name    string
+}
+
+/*
+Write appends p to the file.
+*/
+func (w *Writer) Write(ctx context.Context, p []byte) (int, error) {
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+	w.storage.files[w.name] = append(w.storage.files[w.name], p...)
+	return len(p), nil
+}
+
+/*
+Sync only counts how often it has been called.
+*/
+func (w *Writer) Sync(ctx context.Context) error {
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+	w.storage.syncs++
+	return nil
+}
+
+/*
+Close does nothing; the data is stored on every Write.
+*/
+func (w *Writer) Close(ctx context.Context) error {
+	return nil
+}
+
+/*
+Reader reads from the contents of a file at the time it was opened. It
+implements filesystem.ReadCloser and filesystem.Seeker.
+*/
+type Reader struct {
+	data []byte
+	pos  int64
+}
+
+/*
+Read fills p with data from the file.
+*/
+func (r *Reader) Read(ctx context.Context, p []byte) (int, error) {
+	var n int
+
+	if r.pos >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, r.data[r.pos:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+/*
+Seek moves to the specified position in the file.
+*/
+func (r *Reader) Seek(ctx context.Context, offset int64, whence int) (
+	int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.pos = offset
+	case io.SeekCurrent:
+		r.pos += offset
+	case io.SeekEnd:
+		r.pos = int64(len(r.data)) + offset
+	}
+	return r.pos, nil
+}
+
+/*
+Tell returns the current position in the file.
+*/
+func (r *Reader) Tell(ctx context.Context) (int64, error) {
+	return r.pos, nil
+}
+
+/*
+Close does nothing.
+*/
+func (r *Reader) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+Package osfile adapts local files to the interfaces of the filesystem package,
+so that the command line tools can read and write tables on local disk.
+Reads and writes are buffered.
+*/
+package osfile
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+)
+
+/*
+Reader reads from a local file. It implements filesystem.ReadCloser and
+filesystem.Seeker.
+*/
+type Reader struct {
+	f   *os.File
+	in  *bufio.Reader
+	pos int64
+}
+
+/*
+Open opens the local file with the specified name for reading.
+*/
+func Open(name string) (*Reader, error) {
+	var f *os.File
+	var err error
+
+	if f, err = os.Open(name); err != nil {
+		return nil, err
+	}
+
+	return &Reader{f: f, in: bufio.NewReaderSize(f, 1<<16)}, nil
+}
+
+/*
+Read fills p with data from the file. Short reads only happen at the end of
+the file.
+*/
+func (r *Reader) Read(ctx context.Context, p []byte) (int, error) {
+	var n int
+	var err error
+
+	n, err = io.ReadFull(r.in, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+/*
+Seek moves to the specified position in the file.
+*/
+func (r *Reader) Seek(ctx context.Context, offset int64, whence int) (
+	int64, error) {
+	var err error
+
+	if whence == io.SeekCurrent {
+		// The file position is ahead of ours by whatever is buffered.
+		offset += r.pos
+		whence = io.SeekStart
+	}
+
+	if r.pos, err = r.f.Seek(offset, whence); err != nil {
+		return r.pos, err
+	}
+	r.in.Reset(r.f)
+	return r.pos, nil
+}
+
+/*
+Tell returns the current position in the file.
+*/
+func (r *Reader) Tell(ctx context.Context) (int64, error) {
+	return r.pos, nil
+}
+
+/*
+Size returns the size of the file.
+*/
+func (r *Reader) Size() (int64, error) {
+	var fi os.FileInfo
+	var err error
+
+	if fi, err = r.f.Stat(); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+/*
+Close closes the file.
+*/
+func (r *Reader) Close(ctx context.Context) error {
+	return r.f.Close()
+}
+
+/*
+Writer writes to a local file. It implements filesystem.WriteCloser and
+filesystem.Seeker.
+*/
+type Writer struct {
+	f   *os.File
+	out *bufio.Writer
+	pos int64
+}
+
+/*
+Create creates the local file with the specified name for writing, replacing
+any existing file.
+*/
+func Create(name string) (*Writer, error) {
+	var f *os.File
+	var err error
+
+	if f, err = os.Create(name); err != nil {
+		return nil, err
+	}
+
+	return &Writer{f: f, out: bufio.NewWriterSize(f, 1<<16)}, nil
+}
+
+/*
+Write appends p to the file.
+*/
+func (w *Writer) Write(ctx context.Context, p []byte) (int, error) {
+	var n int
+	var err error
+
+	n, err = w.out.Write(p)
+	w.pos += int64(n)
+	return n, err
+}
+
+/*
+Seek moves to the specified position in the file, writing out buffered data
+first.
+*/
+func (w *Writer) Seek(ctx context.Context, offset int64, whence int) (
+	int64, error) {
+	var err error
+
+	if err = w.out.Flush(); err != nil {
+		return w.pos, err
+	}
+	if w.pos, err = w.f.Seek(offset, whence); err != nil {
+		return w.pos, err
+	}
+	return w.pos, nil
+}
+
+/*
+Tell returns the current position in the file.
+*/
+func (w *Writer) Tell(ctx context.Context) (int64, error) {
+	return w.pos, nil
+}
+
+/*
+Sync writes out buffered data and syncs the file to stable storage.
+*/
+func (w *Writer) Sync(ctx context.Context) error {
+	var err error
+
+	if err = w.out.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+/*
+Close writes out buffered data and closes the file.
+*/
+func (w *Writer) Close(ctx context.Context) error {
+	var err, close_err error
+
+	err = w.out.Flush()
+	close_err = w.f.Close()
+	if err == nil {
+		err = close_err
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+//go:build go1.23
+
+package sstable
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+All returns an iterator over all records of the table, for use with range:
+
+	for key, value := range reader.All(ctx) {
+		...
+	}
+	if err := reader.Err(); err != nil {
+		...
+	}
+
+Iteration stops at the first error, which is then returned by Err. Reading
+starts at the beginning of the table, which requires the input to support
+seeking if it has been read from before. Like all reads, iterating is not
+safe for concurrent use, so only one iterator of a reader may be used at a
+time.
+*/
+func (r *Reader) All(ctx context.Context) iter.Seq2[string, string] {
+	return r.Range(ctx, "", "")
+}
+
+/*
+Range returns an iterator over the records with keys from start up to, but
+not including, end; an empty end stands for the end of the table. The index,
+if any, is used to find the first record. Errors are handled as for All.
+*/
+func (r *Reader) Range(ctx context.Context, start, end string) iter.Seq2[
+	string, string] {
+	return func(yield func(string, string) bool) {
+		var offset int64
+		var err error
+
+		r.iter_err = nil
+
+		if start != "" {
+			offset, err = r.indexLookup(ctx, start)
+		}
+		if err == nil {
+			err = r.SeekTo(ctx, offset)
+		}
+
+		for err == nil {
+			var rdata KeyValue
+
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if err = r.readKeyValue(ctx, &rdata); err != nil {
+				break
+			}
+
+			if string(rdata.Key) < start {
+				continue
+			}
+			if end != "" && string(rdata.Key) >= end {
+				return
+			}
+			if !yield(string(rdata.Key), string(rdata.Value)) {
+				return
+			}
+		}
+
+		if err != io.EOF {
+			r.iter_err = err
+		}
+	}
+}
+
+/*
+Prefix returns an iterator over the records with keys starting with the
+specified prefix. Errors are handled as for All.
+*/
+func (r *Reader) Prefix(ctx context.Context, prefix string) iter.Seq2[
+	string, string] {
+	return r.Range(ctx, prefix, prefixEnd(prefix))
+}
+
+/*
+prefixEnd determines the smallest key greater than all keys starting with
+prefix, or the empty string if there is none.
+*/
+func prefixEnd(prefix string) string {
+	var end = []byte(prefix)
+	var i int
+
+	for i = len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+/*
+Protos decodes the values produced by an iterator of the reader into the
+specified protocol buffer, which is reset for every record, like
+ReadNextProto:
+
+	var entry pb.Entry
+
+	for key, msg := range reader.Protos(reader.Prefix(ctx, "user:"), &entry) {
+		...
+	}
+
+Since the same message is reused, it must not be kept beyond an iteration.
+If a value doesn't decode, iteration stops and the error is returned by Err.
+*/
+func (r *Reader) Protos(seq iter.Seq2[string, string],
+	pb proto.Message) iter.Seq2[string, proto.Message] {
+	return func(yield func(string, proto.Message) bool) {
+		var key, value string
+		var err error
+
+		for key, value = range seq {
+			proto.Reset(pb)
+			if err = proto.Unmarshal([]byte(value), pb); err != nil {
+				r.iter_err = err
+				return
+			}
+			if !yield(key, pb) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Err returns the error which stopped the last iteration using All, Range,
+Prefix or Protos, or nil if it ran to completion or was stopped by the loop.
+*/
+func (r *Reader) Err() error {
+	return r.iter_err
+}
@@ -0,0 +1,97 @@
+//go:build go1.23
+
+package sstable
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/childoftheuniverse/filesystem-internal"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIterators(t *testing.T) {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var idx = internal.NewAnonymousFile()
+	var writer *Writer = NewIndexedWriter(
+		ctx, buf, idx, IndexType_EVERY_N, 3)
+	var reader *Reader
+	var ir IndexRecord
+	var msg proto.Message
+	var keys []string
+	var key, value string
+	var i int
+	var err error
+
+	for _, key = range []string{"a", "b", "ba", "bz", "c", "d"} {
+		err = writer.WriteProto(ctx, key, &IndexRecord{Key: []byte(key)})
+		if err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	reader, err = NewReaderWithIdx(ctx, buf, idx, true)
+	if err != nil {
+		t.Fatal("Error loading index: ", err)
+	}
+
+	for key, value = range reader.All(ctx) {
+		keys = append(keys, key)
+		if value == "" {
+			t.Error("Empty value for ", key)
+		}
+	}
+	if reader.Err() != nil || len(keys) != 6 {
+		t.Error("Unexpected records: ", keys, ", ", reader.Err())
+	}
+
+	keys = nil
+	for key = range reader.Range(ctx, "ba", "d") {
+		keys = append(keys, key)
+	}
+	if fmt.Sprint(keys) != "[ba bz c]" {
+		t.Error("Unexpected range: ", keys)
+	}
+
+	keys = nil
+	for key, msg = range reader.Protos(reader.Prefix(ctx, "b"), &ir) {
+		if string(msg.(*IndexRecord).Key) != key {
+			t.Error("Mismatched message for ", key, ": ", msg)
+		}
+		keys = append(keys, key)
+	}
+	if reader.Err() != nil || fmt.Sprint(keys) != "[b ba bz]" {
+		t.Error("Unexpected prefix: ", keys, ", ", reader.Err())
+	}
+
+	// Stopping early is fine.
+	for key = range reader.Range(ctx, "", "") {
+		i++
+		break
+	}
+	if reader.Err() != nil || i != 1 {
+		t.Error("Unexpected early stop: ", i, ", ", reader.Err())
+	}
+
+	// Values which aren't protocol buffers stop iteration with an error.
+	buf = internal.NewAnonymousFile()
+	writer = NewWriter(ctx, buf)
+	if err = writer.WriteString(ctx, "a", "\x07"); err != nil {
+		t.Fatal("Error writing record: ", err)
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+	reader = NewReader(buf)
+	for range reader.Protos(reader.All(ctx), &ir) {
+		t.Error("Expected no messages")
+	}
+	if reader.Err() == nil {
+		t.Error("Expected undecodable value to fail")
+	}
+}
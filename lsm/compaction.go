@@ -0,0 +1,240 @@
+package lsm
+
+import (
+	"context"
+
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+/*
+compaction describes the merge of tables from one level with the overlapping
+tables of the following level into new tables in the following level. It
+holds a reference on the version the tables were picked from.
+*/
+type compaction struct {
+	version *manifest.Version
+	level   int
+	inputs  [2][]*manifest.TableInfo
+}
+
+/*
+levelLimit determines the maximum size of the specified level in bytes.
+*/
+func (db *DB) levelLimit(level int) int64 {
+	var limit = db.opts.LevelSizeBase
+	var i int
+
+	for i = 1; i < level; i++ {
+		limit *= 10
+	}
+
+	return limit
+}
+
+/*
+levelSize determines the total size of all tables in a level.
+*/
+func levelSize(tables []*manifest.TableInfo) int64 {
+	var size int64
+	var info *manifest.TableInfo
+
+	for _, info = range tables {
+		size += info.Size
+	}
+
+	return size
+}
+
+/*
+keyRange determines the smallest and largest key of the tables.
+*/
+func keyRange(tables []*manifest.TableInfo) (string, string) {
+	var smallest, largest string
+	var i int
+
+	for i = range tables {
+		if i == 0 || string(tables[i].SmallestKey) < smallest {
+			smallest = string(tables[i].SmallestKey)
+		}
+		if i == 0 || string(tables[i].LargestKey) > largest {
+			largest = string(tables[i].LargestKey)
+		}
+	}
+
+	return smallest, largest
+}
+
+/*
+pickCompaction determines the next compaction to run, if any. Level 0 is
+compacted once it has accumulated enough tables; all other levels once they
+exceed their size limit, one table at a time, going round robin through the
+key space. The database mutex must be held.
+*/
+func (db *DB) pickCompaction(ctx context.Context) *compaction {
+	var v = db.manifest.Current()
+	var c *compaction
+	var smallest, largest string
+	var level int
+
+	if len(v.Level(0)) >= db.opts.L0CompactionTrigger {
+		c = &compaction{level: 0}
+		c.inputs[0] = v.Level(0)
+	}
+
+	for level = 1; c == nil && level < v.NumLevels()-1; level++ {
+		var info *manifest.TableInfo
+
+		if levelSize(v.Level(level)) <= db.levelLimit(level) {
+			continue
+		}
+
+		// Pick the first table after the one compacted last time.
+		for _, info = range v.Level(level) {
+			if string(info.SmallestKey) > db.compact_pointers[level] {
+				break
+			}
+		}
+		if string(info.SmallestKey) <= db.compact_pointers[level] {
+			info = v.Level(level)[0]
+		}
+		db.compact_pointers[level] = string(info.LargestKey)
+
+		c = &compaction{level: level}
+		c.inputs[0] = []*manifest.TableInfo{info}
+	}
+
+	if c == nil {
+		v.Unref(ctx)
+		return nil
+	}
+
+	c.version = v
+	smallest, largest = keyRange(c.inputs[0])
+	c.inputs[1] = v.Overlapping(c.level+1, smallest, largest)
+	return c
+}
+
+/*
+isBaseLevelForKey determines whether no level below the output level of the
+compaction holds data for the key, so deletions of it can be dropped.
+*/
+func (c *compaction) isBaseLevelForKey(key string) bool {
+	var level int
+	var info *manifest.TableInfo
+
+	for level = c.level + 2; level < c.version.NumLevels(); level++ {
+		for _, info = range c.version.Level(level) {
+			if info.Contains(key) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/*
+runCompaction merges the input tables of the compaction into new tables and
+installs them in place of the inputs.
+*/
+func (db *DB) runCompaction(ctx context.Context, c *compaction) error {
+	var children []internalIterator
+	var merged *mergingIterator
+	var builder *tableBuilder
+	var edit manifest.Edit
+	var info *manifest.TableInfo
+	var i int
+	var err error
+
+	defer c.version.Unref(ctx)
+
+	// Level 0 tables may overlap, so the newest one needs to come first.
+	if c.level == 0 {
+		for i = len(c.inputs[0]) - 1; i >= 0; i-- {
+			children = append(children, newLevelIterator(
+				db.storage, c.inputs[0][i:i+1]))
+		}
+	} else {
+		children = append(children, newLevelIterator(db.storage, c.inputs[0]))
+	}
+	children = append(children, newLevelIterator(db.storage, c.inputs[1]))
+	merged = newMergingIterator(children)
+	defer merged.close(ctx)
+
+	for err = merged.seek(ctx, ""); err == nil && merged.valid(); err = merged.next(ctx) {
+		var key = merged.key()
+		var l = newMergeLookup(db.opts.MergeOperator, key)
+		var encoded string
+		var done bool
+
+		if done, err = merged.lookup(l); err != nil {
+			break
+		}
+		if !done && db.opts.MergeOperator != nil && c.isBaseLevelForKey(key) {
+			// No older value for the merge operands to apply to.
+			if err = l.finish(); err != nil {
+				break
+			}
+		}
+
+		encoded = l.result()
+		if valueType(encoded) == typeDeletion && c.isBaseLevelForKey(key) {
+			// Nothing left for the deletion to hide.
+			continue
+		}
+
+		if builder == nil {
+			builder, err = newTableBuilder(ctx, db.storage,
+				db.manifest.NewFileNumber(), c.level+1)
+			if err != nil {
+				break
+			}
+		}
+
+		if err = builder.add(ctx, key, encoded); err != nil {
+			break
+		}
+
+		if builder.info.Size >= db.opts.TableSize {
+			info, err = builder.finish(ctx)
+			if err != nil {
+				break
+			}
+			builder = nil
+			edit.Added = append(edit.Added, info)
+		}
+	}
+	if err == nil && builder != nil {
+		info, err = builder.finish(ctx)
+		if err == nil {
+			builder = nil
+			edit.Added = append(edit.Added, info)
+		}
+	}
+
+	if err == nil {
+		for _, info = range c.inputs[0] {
+			edit.Removed = append(edit.Removed, info.Number)
+		}
+		for _, info = range c.inputs[1] {
+			edit.Removed = append(edit.Removed, info.Number)
+		}
+
+		db.mu.Lock()
+		err = db.manifest.Apply(ctx, &edit)
+		db.cond.Broadcast()
+		db.mu.Unlock()
+	}
+
+	if err != nil {
+		// Get rid of whatever has been written so far.
+		if builder != nil {
+			builder.abandon(ctx, db.storage)
+		}
+		for _, info = range edit.Added {
+			removeTableFiles(ctx, db.storage, info.Number)
+		}
+	}
+
+	return err
+}
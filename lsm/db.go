@@ -0,0 +1,770 @@
+/*
+Package lsm implements a log-structured merge-tree key-value store on top of
+the sstable package.
+
+Writes go to a write-ahead log and an in-memory memtable. Once the memtable
+has grown large enough, it is flushed to a new table in level 0. Tables are
+then merged into larger, non-overlapping tables in the following levels by
+background compactions. All files are accessed through a Storage, so the
+database can be kept on any backend supported by the filesystem package.
+*/
+package lsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+	"github.com/childoftheuniverse/sstable/wal"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Err_NotFound indicates that the requested key does not exist.
+*/
+var Err_NotFound = errors.New(
+	"Key not found")
+
+/*
+Err_Closed indicates that the database has already been closed.
+*/
+var Err_Closed = errors.New(
+	"Database closed")
+
+/*
+Options configures the behavior of a database. Fields left at zero take the
+default values listed.
+*/
+type Options struct {
+	// Size of the memtable in bytes at which it is flushed to a table. 4 MB.
+	MemtableSize int64
+
+	// Number of tables in level 0 which triggers a compaction. 4.
+	L0CompactionTrigger int
+
+	// Number of tables in level 0 at which writes are stalled until
+	// compactions have caught up. 12.
+	L0StopWritesTrigger int
+
+	// Maximum size of level 1 in bytes; every following level may be ten
+	// times as large as the previous one. 10 MB.
+	LevelSizeBase int64
+
+	// Size of the tables written by compactions in bytes. 2 MB.
+	TableSize int64
+
+	// Number of levels. 7.
+	NumLevels int
+
+	// Options of the write-ahead log.
+	Log wal.Options
+
+	// Operator combining the operands written using Merge into values. Only
+	// required if Merge is used.
+	MergeOperator sstable.MergeOperator
+}
+
+/*
+withDefaults fills in the default values for all unset options.
+*/
+func (o Options) withDefaults() Options {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = 4 << 20
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = 4
+	}
+	if o.L0StopWritesTrigger <= 0 {
+		o.L0StopWritesTrigger = 12
+	}
+	if o.L0StopWritesTrigger < o.L0CompactionTrigger {
+		o.L0StopWritesTrigger = o.L0CompactionTrigger
+	}
+	if o.LevelSizeBase <= 0 {
+		o.LevelSizeBase = 10 << 20
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = 2 << 20
+	}
+	if o.NumLevels < 2 {
+		o.NumLevels = 7
+	}
+	return o
+}
+
+/*
+DB is a key-value store keeping its data in sstables. All methods are safe
+for concurrent use.
+*/
+type DB struct {
+	storage  Storage
+	opts     Options
+	manifest *manifest.Manifest
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// mem receives all writes; imm is a full memtable waiting to be flushed.
+	// seq is the sequence number of the last write added to mem.
+	mem *sstable.Memtable
+	imm *sstable.Memtable
+	seq uint64
+	log *wal.Log
+	// Number of the first log segment holding the writes in mem.
+	mem_log_number uint64
+	// Writes queued for the log but not added to mem yet, in log order.
+	pending []*pendingWrite
+
+	compact_pointers []string
+
+	bg_err error
+	closed bool
+
+	// Readers for point lookups of all tables used so far, by number.
+	tables_mu sync.Mutex
+	tables    map[uint64]*table
+
+	work    chan struct{}
+	closing chan struct{}
+	bg_done chan struct{}
+}
+
+/*
+Open opens the database kept in storage, creating a new one if there is none.
+Writes which have not been flushed to tables before are recovered from the
+write-ahead log.
+*/
+func Open(ctx context.Context, storage Storage, opts Options) (*DB, error) {
+	var db = &DB{
+		storage: storage,
+		opts:    opts.withDefaults(),
+		tables:  make(map[uint64]*table),
+		work:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		bg_done: make(chan struct{}),
+	}
+	var err error
+
+	db.cond = sync.NewCond(&db.mu)
+	db.compact_pointers = make([]string, db.opts.NumLevels)
+
+	db.mu.Lock()
+	err = db.recover(ctx)
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go db.background()
+	db.signalBackground()
+
+	return db, nil
+}
+
+/*
+recover loads the most recent set of tables from the manifest, replays the
+log and removes files which are no longer needed.
+*/
+func (db *DB) recover(ctx context.Context) error {
+	var mem = sstable.NewMemtable()
+	var edit manifest.Edit
+	var err error
+
+	db.manifest, err = manifest.Open(ctx, db.storage, manifest.Options{
+		NumLevels: db.opts.NumLevels,
+		Obsolete:  db.removeTable,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Recover all writes which have not made it into a table yet.
+	err = wal.Replay(ctx, db.storage, db.manifest.LogNumber(),
+		func(record []byte) error {
+			var lr LogRecord
+			var err error
+
+			if err = proto.Unmarshal(record, &lr); err != nil {
+				return err
+			}
+			db.seq++
+			addToMemtable(mem, string(lr.Key), string(lr.Value), db.seq)
+			return nil
+		})
+	if err != nil {
+		db.manifest.Close(ctx)
+		return err
+	}
+
+	db.log, err = wal.Open(ctx, db.storage, db.opts.Log)
+	if err != nil {
+		db.manifest.Close(ctx)
+		return err
+	}
+	db.mem = sstable.NewMemtable()
+	db.mem_log_number = db.log.Segment()
+
+	// Write the recovered writes to a table, so the old log can go.
+	edit.LogNumber = db.mem_log_number
+	if mem.Len() > 0 {
+		var info *manifest.TableInfo
+
+		info, err = db.writeLevel0Table(ctx, mem, db.manifest.NewFileNumber())
+		if err != nil {
+			db.close(ctx)
+			return err
+		}
+		edit.Added = append(edit.Added, info)
+	}
+	if err = db.manifest.Apply(ctx, &edit); err != nil {
+		db.close(ctx)
+		return err
+	}
+
+	if err = db.removeObsoleteFiles(ctx); err != nil {
+		db.close(ctx)
+		return err
+	}
+	return db.log.RemoveBefore(ctx, db.mem_log_number)
+}
+
+/*
+removeObsoleteFiles deletes the files of all tables which are not part of the
+current version, such as those left behind by a crash in the middle of a
+compaction. This must only be called during recovery, since files of tables
+being written could be deleted otherwise.
+*/
+func (db *DB) removeObsoleteFiles(ctx context.Context) error {
+	var v = db.manifest.Current()
+	var live = make(map[uint64]bool)
+	var info *manifest.TableInfo
+	var names []string
+	var name string
+	var err error
+
+	for _, info = range v.Tables() {
+		live[info.Number] = true
+	}
+	v.Unref(ctx)
+
+	names, err = db.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name = range names {
+		var number uint64
+		var kind int
+
+		number, kind = parseFileName(name)
+		if (kind == fileTypeTable || kind == fileTypeIndex) && !live[number] {
+			if err = db.storage.Remove(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+table returns the table used for point lookups in the table described by
+info.
+*/
+func (db *DB) table(info *manifest.TableInfo) *table {
+	var t *table
+	var ok bool
+
+	db.tables_mu.Lock()
+	defer db.tables_mu.Unlock()
+
+	t, ok = db.tables[info.Number]
+	if !ok {
+		t = newTable(info)
+		db.tables[info.Number] = t
+	}
+	return t
+}
+
+/*
+removeTable closes and deletes a table which is no longer part of any
+version. It's called by the manifest.
+*/
+func (db *DB) removeTable(ctx context.Context, info *manifest.TableInfo) {
+	var t *table
+
+	db.tables_mu.Lock()
+	t = db.tables[info.Number]
+	delete(db.tables, info.Number)
+	db.tables_mu.Unlock()
+
+	if t != nil {
+		t.close(ctx)
+	}
+	removeTableFiles(ctx, db.storage, info.Number)
+}
+
+/*
+Put sets the value of the specified key.
+*/
+func (db *DB) Put(ctx context.Context, key, value string) error {
+	return db.write(ctx, key, encodeValue(value))
+}
+
+/*
+Delete removes the specified key from the database.
+*/
+func (db *DB) Delete(ctx context.Context, key string) error {
+	return db.write(ctx, key, deletionMarker)
+}
+
+/*
+Merge records an operand to be combined with the value of the specified key
+by the merge operator of the database. The operand is only folded onto the
+value when the key is read or compacted, so it doesn't need to be read first.
+*/
+func (db *DB) Merge(ctx context.Context, key, operand string) error {
+	if db.opts.MergeOperator == nil {
+		return sstable.Err_NoMergeOperator
+	}
+	return db.write(ctx, key, encodeMerge([]string{operand}))
+}
+
+/*
+pendingWrite is a write which has been queued for the log, but not added to
+the memtable yet.
+*/
+type pendingWrite struct {
+	key     string
+	encoded string
+	commit  *wal.Commit
+	err     error
+}
+
+/*
+write logs an encoded value and adds it to the memtable. The record is queued
+for the log while holding the database mutex, but waiting for it to be
+committed happens outside, so that concurrent writes are committed to the log
+together. Writes are only added to the memtable once they have been
+committed, in the order in which they were queued for the log.
+*/
+func (db *DB) write(ctx context.Context, key, encoded string) error {
+	var lr = LogRecord{Key: []byte(key), Value: []byte(encoded)}
+	var p *pendingWrite
+	var data []byte
+	var err error
+
+	data, err = proto.Marshal(&lr)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	if err = db.makeRoomForWrite(ctx); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	p = &pendingWrite{key: key, encoded: encoded}
+	p.commit = db.log.Enqueue(data)
+	db.pending = append(db.pending, p)
+	db.mu.Unlock()
+
+	// If the wait is cancelled, the write is still committed and applied
+	// by whoever comes along next.
+	err = p.commit.Wait(ctx)
+
+	db.mu.Lock()
+	db.applyPending()
+	if err == nil {
+		err = p.err
+	}
+	db.mu.Unlock()
+
+	return err
+}
+
+/*
+applyPending adds all pending writes which have been committed to the log to
+the memtable, stopping at the first one which hasn't been committed yet. If a
+write couldn't be logged, all further writes fail. The database mutex must be
+held.
+*/
+func (db *DB) applyPending() {
+	for len(db.pending) > 0 {
+		var p = db.pending[0]
+
+		select {
+		case <-p.commit.Done():
+		default:
+			return
+		}
+		db.pending = db.pending[1:]
+
+		if p.err = p.commit.Wait(context.Background()); p.err == nil {
+			db.seq++
+			addToMemtable(db.mem, p.key, p.encoded, db.seq)
+		}
+		if p.err != nil && db.bg_err == nil {
+			db.bg_err = p.err
+			db.cond.Broadcast()
+		}
+	}
+}
+
+/*
+waitPending waits for all pending writes to be committed and adds them to
+the memtable. The database mutex must be held; it is released while waiting.
+*/
+func (db *DB) waitPending() {
+	var last = db.pending[len(db.pending)-1]
+
+	// Records are committed in order, so all others are done by then.
+	db.mu.Unlock()
+	<-last.commit.Done()
+	db.mu.Lock()
+	db.applyPending()
+}
+
+/*
+makeRoomForWrite makes sure the memtable can take another write, switching to
+a new memtable if it's full. Writes are stalled while the previous memtable
+is still being flushed or while level 0 has too many tables. The database
+mutex must be held.
+*/
+func (db *DB) makeRoomForWrite(ctx context.Context) error {
+	var err error
+
+	for {
+		var v *manifest.Version
+		var level0 int
+
+		if db.closed {
+			return Err_Closed
+		}
+		if db.bg_err != nil {
+			return db.bg_err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		v = db.manifest.Current()
+		level0 = len(v.Level(0))
+		v.Unref(ctx)
+
+		if level0 >= db.opts.L0StopWritesTrigger {
+			db.signalBackground()
+			db.cond.Wait()
+			continue
+		}
+		if db.mem.ApproximateSize() < db.opts.MemtableSize {
+			return nil
+		}
+		if db.imm != nil {
+			db.cond.Wait()
+			continue
+		}
+		if len(db.pending) > 0 {
+			// Pending writes belong to the current memtable and log
+			// segment.
+			db.waitPending()
+			continue
+		}
+
+		// Switch to a new memtable and log segment; the old ones will be
+		// flushed.
+		db.imm = db.mem
+		db.mem_log_number = db.log.Rotate()
+		db.mem = sstable.NewMemtable()
+		db.signalBackground()
+	}
+}
+
+/*
+Get looks up the value of the specified key. Err_NotFound is returned if the
+key does not exist.
+*/
+func (db *DB) Get(ctx context.Context, key string) (string, error) {
+	var l = newMergeLookup(db.opts.MergeOperator, key)
+	var mem *sstable.Memtable
+	var v *manifest.Version
+	var done bool
+	var err error
+
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return "", Err_Closed
+	}
+
+	for _, mem = range []*sstable.Memtable{db.mem, db.imm} {
+		if mem == nil {
+			continue
+		}
+		if done, err = memtableLookup(mem, l, db.seq); err != nil || done {
+			break
+		}
+	}
+	if err == nil && !done {
+		v = db.manifest.Current()
+	}
+	db.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if v != nil {
+		err = db.getFromTables(ctx, v, l)
+		v.Unref(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return resolveLookup(l)
+}
+
+/*
+getFromTables adds the encoded values of the key being looked up from the
+tables of the version, from newest to oldest, until its value is determined.
+*/
+func (db *DB) getFromTables(ctx context.Context, v *manifest.Version,
+	l *mergeLookup) error {
+	var info *manifest.TableInfo
+
+	for _, info = range v.TablesForKey(l.key) {
+		var encoded string
+		var ok, done bool
+		var err error
+
+		encoded, ok, err = db.table(info).get(ctx, db.storage, l.key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if done, err = l.add(encoded); err != nil || done {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+resolveLookup determines the value of a key once all of its encoded values
+have been added to the lookup. Err_NotFound is returned if the key does not
+exist.
+*/
+func resolveLookup(l *mergeLookup) (string, error) {
+	var value string
+	var deleted bool
+	var err error
+
+	if err = l.finish(); err != nil {
+		return "", err
+	}
+
+	value, deleted = decodeValue(l.result())
+	if deleted {
+		return "", Err_NotFound
+	}
+	return value, nil
+}
+
+/*
+NewIterator creates an iterator over the current contents of the database,
+positioned before the first key.
+*/
+func (db *DB) NewIterator(ctx context.Context) (*Iterator, error) {
+	var s *Snapshot
+	var err error
+
+	if s, err = db.NewSnapshot(ctx); err != nil {
+		return nil, err
+	}
+	defer s.Release(ctx)
+
+	return s.NewIterator(ctx)
+}
+
+/*
+Close stops all background work and closes the database. Writes which have
+not been flushed to tables yet remain in the log and are recovered when the
+database is opened again.
+*/
+func (db *DB) Close(ctx context.Context) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+
+	close(db.closing)
+	<-db.bg_done
+
+	return db.close(ctx)
+}
+
+/*
+close closes the log, the manifest and all tables.
+*/
+func (db *DB) close(ctx context.Context) error {
+	var t *table
+	var err, manifest_err error
+
+	err = db.log.Close(ctx)
+	manifest_err = db.manifest.Close(ctx)
+	if err == nil {
+		err = manifest_err
+	}
+
+	db.tables_mu.Lock()
+	defer db.tables_mu.Unlock()
+	for _, t = range db.tables {
+		t.close(ctx)
+	}
+
+	return err
+}
+
+/*
+signalBackground wakes up the background goroutine, if it's not busy anyway.
+*/
+func (db *DB) signalBackground() {
+	select {
+	case db.work <- struct{}{}:
+	default:
+	}
+}
+
+/*
+background runs flushes and compactions until the database is closed. Errors
+are sticky: once background work has failed, all further writes fail too.
+*/
+func (db *DB) background() {
+	var ctx = context.Background()
+
+	defer close(db.bg_done)
+
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-db.work:
+		}
+
+		for {
+			var did_work bool
+			var err error
+
+			select {
+			case <-db.closing:
+				return
+			default:
+			}
+
+			did_work, err = db.backgroundWork(ctx)
+			if err != nil {
+				db.mu.Lock()
+				db.bg_err = err
+				db.cond.Broadcast()
+				db.mu.Unlock()
+				return
+			}
+			if !did_work {
+				break
+			}
+		}
+	}
+}
+
+/*
+backgroundWork runs a single flush or compaction, if there is anything to do.
+*/
+func (db *DB) backgroundWork(ctx context.Context) (bool, error) {
+	var imm *sstable.Memtable
+	var c *compaction
+
+	db.mu.Lock()
+	imm = db.imm
+	if imm == nil {
+		c = db.pickCompaction(ctx)
+	}
+	db.mu.Unlock()
+
+	if imm != nil {
+		return true, db.flushMemtable(ctx, imm)
+	}
+	if c != nil {
+		return true, db.runCompaction(ctx, c)
+	}
+	return false, nil
+}
+
+/*
+writeLevel0Table writes the contents of a memtable to a new table in level 0.
+All writes of a key are combined into a single record.
+*/
+func (db *DB) writeLevel0Table(ctx context.Context, mem *sstable.Memtable,
+	number uint64) (*manifest.TableInfo, error) {
+	var builder *tableBuilder
+	var it = newMemIterator(mem, maxSequence, db.opts.MergeOperator)
+	var err error
+
+	builder, err = newTableBuilder(ctx, db.storage, number, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for err = it.seek(ctx, ""); err == nil && it.valid(); err = it.next(ctx) {
+		if err = builder.add(ctx, it.key(), it.value()); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		builder.abandon(ctx, db.storage)
+		return nil, err
+	}
+
+	return builder.finish(ctx)
+}
+
+/*
+flushMemtable writes the full memtable to a table and installs it.
+*/
+func (db *DB) flushMemtable(ctx context.Context, imm *sstable.Memtable) error {
+	var edit manifest.Edit
+	var info *manifest.TableInfo
+	var err error
+
+	if imm.Len() > 0 {
+		info, err = db.writeLevel0Table(ctx, imm, db.manifest.NewFileNumber())
+		if err != nil {
+			return err
+		}
+		edit.Added = append(edit.Added, info)
+	}
+
+	db.mu.Lock()
+	edit.LogNumber = db.mem_log_number
+	err = db.manifest.Apply(ctx, &edit)
+	if err == nil {
+		db.imm = nil
+	}
+	db.cond.Broadcast()
+	db.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// The writes in the older log segments are now safely in the table.
+	return db.log.RemoveBefore(ctx, edit.LogNumber)
+}
@@ -0,0 +1,516 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/internal/memfs"
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+// Options which make flushes and compactions happen a lot.
+var testOptions = Options{
+	MemtableSize:        1024,
+	L0CompactionTrigger: 2,
+	LevelSizeBase:       4096,
+	TableSize:           1024,
+	NumLevels:           4,
+}
+
+// Put, overwrite and delete keys, with flushes and compactions happening in
+// between, and check the results through Get and iterators.
+func TestPutGetDeleteIterate(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var expected = make(map[string]string)
+	var db *DB
+	var it *Iterator
+	var k, v string
+	var count int
+	var i int
+	var err error
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+
+	for i = 0; i < 2000; i++ {
+		k = fmt.Sprintf("key%04d", (i*7919)%1000)
+		v = fmt.Sprintf("value%d", i)
+
+		if i%5 == 4 {
+			err = db.Delete(ctx, k)
+			delete(expected, k)
+		} else {
+			err = db.Put(ctx, k, v)
+			expected[k] = v
+		}
+		if err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+
+	for i = 0; i < 1000; i++ {
+		k = fmt.Sprintf("key%04d", i)
+		v, err = db.Get(ctx, k)
+		if expected[k] == "" {
+			if err != Err_NotFound {
+				t.Error("Expected ", k, " to be absent, got ", v, ", ", err)
+			}
+		} else if err != nil || v != expected[k] {
+			t.Error("Mismatched data for ", k, ": expected ", expected[k],
+				", got ", v, ", ", err)
+		}
+	}
+
+	it, err = db.NewIterator(ctx)
+	if err != nil {
+		t.Fatal("Error creating iterator: ", err)
+	}
+	k = ""
+	for it.Next(ctx) {
+		if it.Key() <= k {
+			t.Error("Keys out of order: ", it.Key(), " after ", k)
+		}
+		k = it.Key()
+		if it.Value() != expected[k] {
+			t.Error("Mismatched data for ", k, ": expected ", expected[k],
+				", got ", it.Value())
+		}
+		count++
+	}
+	if it.Err() != nil {
+		t.Error("Error iterating: ", it.Err())
+	}
+	if count != len(expected) {
+		t.Error("Expected ", len(expected), " keys, iterated over ", count)
+	}
+
+	it.Seek(ctx, "key0500")
+	if !it.Next(ctx) || it.Key() < "key0500" {
+		t.Error("Seek to key0500 ended up at ", it.Key())
+	}
+	it.Close(ctx)
+
+	if err = db.Close(ctx); err != nil {
+		t.Error("Error closing database: ", err)
+	}
+}
+
+// Reopen a database and check everything has been recovered.
+func TestRecovery(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var db *DB
+	var k, v string
+	var i int
+	var err error
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+	for i = 0; i < 500; i++ {
+		k = fmt.Sprintf("key%04d", i)
+		if err = db.Put(ctx, k, fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+	if err = db.Delete(ctx, "key0042"); err != nil {
+		t.Fatal("Error deleting key0042: ", err)
+	}
+	// Keys needn't be valid UTF-8.
+	if err = db.Put(ctx, "\xff\xfe", "binary"); err != nil {
+		t.Fatal("Error writing binary key: ", err)
+	}
+	if err = db.Close(ctx); err != nil {
+		t.Fatal("Error closing database: ", err)
+	}
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error reopening database: ", err)
+	}
+	defer db.Close(ctx)
+
+	for i = 0; i < 500; i++ {
+		k = fmt.Sprintf("key%04d", i)
+		v, err = db.Get(ctx, k)
+		if i == 42 {
+			if err != Err_NotFound {
+				t.Error("Expected deleted key to be absent, got ", v, ", ", err)
+			}
+		} else if err != nil || v != fmt.Sprintf("value%d", i) {
+			t.Error("Mismatched data for ", k, ": got ", v, ", ", err)
+		}
+	}
+	if v, err = db.Get(ctx, "\xff\xfe"); err != nil || v != "binary" {
+		t.Error("Mismatched data for binary key: got ", v, ", ", err)
+	}
+}
+
+// failingStorage is a memfs.Storage whose writes fail once fail is set.
+type failingStorage struct {
+	*memfs.Storage
+	fail atomic.Bool
+}
+
+// failingWriter fails writes once the storage it belongs to is failing.
+type failingWriter struct {
+	filesystem.WriteCloser
+	storage *failingStorage
+}
+
+func (s *failingStorage) Create(ctx context.Context, name string) (
+	filesystem.WriteCloser, error) {
+	var out filesystem.WriteCloser
+	var err error
+
+	if out, err = s.Storage.Create(ctx, name); err != nil {
+		return nil, err
+	}
+	return &failingWriter{WriteCloser: out, storage: s}, nil
+}
+
+func (w *failingWriter) Write(ctx context.Context, p []byte) (int, error) {
+	if w.storage.fail.Load() {
+		return 0, errors.New("Write failed")
+	}
+	return w.WriteCloser.Write(ctx, p)
+}
+
+func (w *failingWriter) Sync(ctx context.Context) error {
+	return w.WriteCloser.(*memfs.Writer).Sync(ctx)
+}
+
+// Writes which couldn't be logged must not become visible.
+func TestLogFailure(t *testing.T) {
+	var ctx = context.Background()
+	var storage = &failingStorage{Storage: memfs.NewStorage()}
+	var db *DB
+	var v string
+	var err error
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+	defer db.Close(ctx)
+
+	if err = db.Put(ctx, "a", "1"); err != nil {
+		t.Fatal("Error writing a: ", err)
+	}
+	storage.fail.Store(true)
+	if err = db.Put(ctx, "b", "2"); err == nil {
+		t.Error("Expected write to fail")
+	}
+	if v, err = db.Get(ctx, "b"); err != Err_NotFound {
+		t.Error("Expected unlogged write to be absent, got ", v, ", ", err)
+	}
+	if v, err = db.Get(ctx, "a"); err != nil || v != "1" {
+		t.Error("Mismatched data for a: got ", v, ", ", err)
+	}
+	if err = db.Put(ctx, "c", "3"); err == nil {
+		t.Error("Expected writes to keep failing")
+	}
+}
+
+// Read from a snapshot while the database is overwritten and compacted, and
+// check the files of compacted tables are kept until the snapshot is released.
+func TestSnapshot(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var snapshot *Snapshot
+	var current *manifest.Version
+	var it *Iterator
+	var db *DB
+	var k, v string
+	var count int
+	var i int
+	var names []string
+	var err error
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+	defer db.Close(ctx)
+
+	for i = 0; i < 500; i++ {
+		k = fmt.Sprintf("key%04d", i)
+		if err = db.Put(ctx, k, "old"); err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+
+	snapshot, err = db.NewSnapshot(ctx)
+	if err != nil {
+		t.Fatal("Error creating snapshot: ", err)
+	}
+
+	for i = 0; i < 2000; i++ {
+		k = fmt.Sprintf("key%04d", i%500)
+		if i%3 == 0 {
+			err = db.Delete(ctx, k)
+		} else {
+			err = db.Put(ctx, k, fmt.Sprintf("new%d", i))
+		}
+		if err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+
+	for i = 0; i < 500; i++ {
+		k = fmt.Sprintf("key%04d", i)
+		v, err = snapshot.Get(ctx, k)
+		if err != nil || v != "old" {
+			t.Error("Mismatched data for ", k, " in snapshot: got ", v, ", ",
+				err)
+		}
+	}
+
+	it, err = snapshot.NewIterator(ctx)
+	if err != nil {
+		t.Fatal("Error creating iterator: ", err)
+	}
+	snapshot.Release(ctx)
+	if _, err = snapshot.Get(ctx, "key0000"); err != Err_SnapshotReleased {
+		t.Error("Expected released snapshot to fail, got ", err)
+	}
+
+	for it.Next(ctx) {
+		if it.Value() != "old" {
+			t.Error("Mismatched data for ", it.Key(), " in snapshot: got ",
+				it.Value())
+		}
+		count++
+	}
+	if it.Err() != nil {
+		t.Error("Error iterating: ", it.Err())
+	}
+	if count != 500 {
+		t.Error("Expected 500 keys in snapshot, got ", count)
+	}
+	it.Close(ctx)
+
+	// Wait for background work to finish by closing the database, then
+	// check only the files of the current tables are left.
+	db.Close(ctx)
+	count = 0
+	names, _ = storage.List(ctx)
+	for _, k = range names {
+		var kind int
+
+		_, kind = parseFileName(k)
+		if kind == fileTypeTable {
+			count++
+		}
+	}
+	current = db.manifest.Current()
+	defer current.Unref(ctx)
+	if count != len(current.Tables()) {
+		t.Error("Expected ", len(current.Tables()), " tables, found ", count)
+	}
+}
+
+// appendOperator is a MergeOperator appending operands to the value,
+// separated by commas.
+type appendOperator struct{}
+
+func (appendOperator) FullMerge(key, existing string, has_existing bool,
+	operands []string) (string, error) {
+	var operand string
+
+	for _, operand = range operands {
+		if has_existing {
+			existing += ","
+		}
+		existing += operand
+		has_existing = true
+	}
+	return existing, nil
+}
+
+func (appendOperator) PartialMerge(key, left, right string) (string, bool) {
+	return left + "," + right, true
+}
+
+// Merge operands onto values, deletions and missing keys, with flushes and
+// compactions happening in between, and check the results through Get,
+// iterators and after recovery.
+func TestMerge(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var opts = testOptions
+	var expected = make(map[string]string)
+	var db *DB
+	var it *Iterator
+	var k, v string
+	var count int
+	var i int
+	var err error
+
+	db, err = Open(ctx, storage, testOptions)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+	if err = db.Merge(ctx, "key", "x"); err != sstable.Err_NoMergeOperator {
+		t.Error("Expected merge without operator to fail, got ", err)
+	}
+	db.Close(ctx)
+
+	opts.MergeOperator = appendOperator{}
+	db, err = Open(ctx, storage, opts)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+
+	for i = 0; i < 3000; i++ {
+		k = fmt.Sprintf("key%03d", (i*7919)%200)
+		v = fmt.Sprintf("%d", i)
+
+		switch {
+		case i%10 == 3:
+			err = db.Put(ctx, k, v)
+			expected[k] = v
+		case i%10 == 7:
+			err = db.Delete(ctx, k)
+			delete(expected, k)
+		default:
+			err = db.Merge(ctx, k, v)
+			if expected[k] != "" {
+				expected[k] += "," + v
+			} else {
+				expected[k] = v
+			}
+		}
+		if err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+
+	for i = 0; i < 2; i++ {
+		for k = range expected {
+			v, err = db.Get(ctx, k)
+			if err != nil || v != expected[k] {
+				t.Error("Mismatched data for ", k, ": expected ", expected[k],
+					", got ", v, ", ", err)
+			}
+		}
+
+		it, err = db.NewIterator(ctx)
+		if err != nil {
+			t.Fatal("Error creating iterator: ", err)
+		}
+		count = 0
+		for it.Next(ctx) {
+			if it.Value() != expected[it.Key()] {
+				t.Error("Mismatched data for ", it.Key(), ": expected ",
+					expected[it.Key()], ", got ", it.Value())
+			}
+			count++
+		}
+		if it.Err() != nil {
+			t.Error("Error iterating: ", it.Err())
+		}
+		if count != len(expected) {
+			t.Error("Expected ", len(expected), " keys, iterated over ", count)
+		}
+		it.Close(ctx)
+
+		// Check again after recovery.
+		if err = db.Close(ctx); err != nil {
+			t.Fatal("Error closing database: ", err)
+		}
+		db, err = Open(ctx, storage, opts)
+		if err != nil {
+			t.Fatal("Error reopening database: ", err)
+		}
+	}
+	db.Close(ctx)
+}
+
+// Read from a snapshot of a memtable which keeps receiving writes, with keys
+// which only differ by trailing zero bytes.
+func TestSnapshotMemtable(t *testing.T) {
+	var ctx = context.Background()
+	var opts = testOptions
+	var keys = []string{"a", "a\x00", "a\x00\x00", "b"}
+	var snapshot *Snapshot
+	var it *Iterator
+	var db *DB
+	var k, v string
+	var i int
+	var err error
+
+	opts.MemtableSize = 1 << 20
+	opts.MergeOperator = appendOperator{}
+	db, err = Open(ctx, memfs.NewStorage(), opts)
+	if err != nil {
+		t.Fatal("Error opening database: ", err)
+	}
+	defer db.Close(ctx)
+
+	for _, k = range keys {
+		if err = db.Put(ctx, k, "old"); err != nil {
+			t.Fatal("Error writing ", k, ": ", err)
+		}
+	}
+	if err = db.Merge(ctx, "b", "x"); err != nil {
+		t.Fatal("Error merging b: ", err)
+	}
+
+	snapshot, err = db.NewSnapshot(ctx)
+	if err != nil {
+		t.Fatal("Error creating snapshot: ", err)
+	}
+	defer snapshot.Release(ctx)
+
+	for _, k = range keys {
+		if err = db.Merge(ctx, k, "y"); err != nil {
+			t.Fatal("Error merging ", k, ": ", err)
+		}
+	}
+	if err = db.Delete(ctx, "a"); err != nil {
+		t.Fatal("Error deleting a: ", err)
+	}
+
+	if v, err = snapshot.Get(ctx, "a"); err != nil || v != "old" {
+		t.Error("Mismatched data for a in snapshot: got ", v, ", ", err)
+	}
+	if v, err = snapshot.Get(ctx, "b"); err != nil || v != "old,x" {
+		t.Error("Mismatched data for b in snapshot: got ", v, ", ", err)
+	}
+	if v, err = db.Get(ctx, "b"); err != nil || v != "old,x,y" {
+		t.Error("Mismatched data for b: got ", v, ", ", err)
+	}
+	if v, err = db.Get(ctx, "a"); err != Err_NotFound {
+		t.Error("Expected a to be deleted, got ", v, ", ", err)
+	}
+
+	it, err = snapshot.NewIterator(ctx)
+	if err != nil {
+		t.Fatal("Error creating iterator: ", err)
+	}
+	for it.Next(ctx) {
+		if i >= len(keys) || it.Key() != keys[i] {
+			t.Error("Unexpected key ", it.Key(), " at position ", i)
+		} else if it.Key() != "b" && it.Value() != "old" {
+			t.Error("Mismatched data for ", it.Key(), ": got ", it.Value())
+		}
+		i++
+	}
+	if err = it.Err(); err != nil {
+		t.Error("Error iterating: ", err)
+	}
+	it.Close(ctx)
+	if i != len(keys) {
+		t.Error("Expected ", len(keys), " keys, got ", i)
+	}
+}
@@ -0,0 +1,61 @@
+package lsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Kinds of files making up a database.
+*/
+const (
+	fileTypeUnknown = iota
+	fileTypeTable
+	fileTypeIndex
+)
+
+/*
+tableFileName determines the name of the data file of the table with the
+specified number.
+*/
+func tableFileName(number uint64) string {
+	return fmt.Sprintf("%06d.sst", number)
+}
+
+/*
+indexFileName determines the name of the index file of the table with the
+specified number.
+*/
+func indexFileName(number uint64) string {
+	return fmt.Sprintf("%06d.idx", number)
+}
+
+/*
+parseFileName determines the number and kind of a file of the database from
+its name.
+*/
+func parseFileName(name string) (uint64, int) {
+	var number uint64
+	var pos int
+	var err error
+
+	pos = strings.LastIndexByte(name, '.')
+	if pos < 0 {
+		return 0, fileTypeUnknown
+	}
+
+	number, err = strconv.ParseUint(name[:pos], 10, 64)
+	if err != nil {
+		return 0, fileTypeUnknown
+	}
+
+	switch name[pos+1:] {
+	case "sst":
+		return number, fileTypeTable
+	case "idx":
+		return number, fileTypeIndex
+	}
+
+	return 0, fileTypeUnknown
+}
@@ -0,0 +1,540 @@
+package lsm
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+/*
+internalIterator iterates over records with encoded values in ascending key
+order. After seek, the iterator is positioned at the first record with a key
+greater than or equal to the specified key.
+*/
+type internalIterator interface {
+	seek(ctx context.Context, key string) error
+	next(ctx context.Context) error
+	valid() bool
+	key() string
+	value() string
+	close(ctx context.Context) error
+}
+
+/*
+memIterator iterates over the contents of a memtable as of a sequence number.
+All writes of a key up to that sequence number are combined into a single
+record; later writes are skipped.
+*/
+type memIterator struct {
+	it  *sstable.MemtableIterator
+	seq uint64
+	op  sstable.MergeOperator
+
+	// Whether it is positioned at an entry which hasn't been consumed yet.
+	ahead bool
+
+	// Record the iterator is positioned at.
+	is_valid bool
+	cur_key  string
+	cur_val  string
+}
+
+/*
+newMemIterator creates an iterator over a memtable as of the specified
+sequence number.
+*/
+func newMemIterator(mem *sstable.Memtable, seq uint64,
+	op sstable.MergeOperator) *memIterator {
+	return &memIterator{it: mem.NewIterator(), seq: seq, op: op}
+}
+
+func (it *memIterator) seek(ctx context.Context, key string) error {
+	it.it.Seek(memtableKey(key, maxSequence))
+	it.ahead = it.it.Next()
+	return it.next(ctx)
+}
+
+func (it *memIterator) next(ctx context.Context) error {
+	var err error
+
+	it.is_valid = false
+	for it.ahead {
+		var l *mergeLookup
+		var key string
+		var seq uint64
+
+		if key, seq = parseMemtableKey(it.it.Key()); seq > it.seq {
+			it.ahead = it.it.Next()
+			continue
+		}
+
+		// Combine all writes of the key, newest first.
+		l = newMergeLookup(it.op, key)
+		for it.ahead {
+			var entry_key string
+
+			if entry_key, seq = parseMemtableKey(it.it.Key()); entry_key != key {
+				break
+			}
+			if seq <= it.seq {
+				if _, err = l.add(it.it.Value()); err != nil {
+					return err
+				}
+			}
+			it.ahead = it.it.Next()
+		}
+
+		it.is_valid = true
+		it.cur_key = key
+		it.cur_val = l.result()
+		return nil
+	}
+
+	return nil
+}
+
+func (it *memIterator) valid() bool {
+	return it.is_valid
+}
+
+func (it *memIterator) key() string {
+	return it.cur_key
+}
+
+func (it *memIterator) value() string {
+	return it.cur_val
+}
+
+func (it *memIterator) close(ctx context.Context) error {
+	return nil
+}
+
+/*
+tableIterator iterates over the contents of a table, using its own reader.
+*/
+type tableIterator struct {
+	data, idx filesystem.ReadCloser
+	reader    *sstable.Reader
+	k, v      string
+	ok        bool
+}
+
+/*
+newTableIterator opens the table with the specified number for iteration.
+*/
+func newTableIterator(ctx context.Context, storage Storage, number uint64) (
+	*tableIterator, error) {
+	var it = new(tableIterator)
+	var err error
+
+	it.reader, it.data, it.idx, err = openTableReader(ctx, storage, number)
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func (it *tableIterator) seek(ctx context.Context, key string) error {
+	var err error
+
+	it.k, it.v, err = it.reader.ReadSubsequentString(ctx, key)
+	if err != nil {
+		it.ok = false
+		return err
+	}
+
+	// Encoded values are never empty, so this means the end of the table.
+	it.ok = len(it.v) > 0
+	return nil
+}
+
+func (it *tableIterator) next(ctx context.Context) error {
+	var err error
+
+	it.k, it.v, err = it.reader.ReadNextString(ctx)
+	if err == io.EOF {
+		it.ok = false
+		return nil
+	}
+	if err != nil {
+		it.ok = false
+		return err
+	}
+
+	it.ok = true
+	return nil
+}
+
+func (it *tableIterator) valid() bool {
+	return it.ok
+}
+
+func (it *tableIterator) key() string {
+	return it.k
+}
+
+func (it *tableIterator) value() string {
+	return it.v
+}
+
+func (it *tableIterator) close(ctx context.Context) error {
+	var err, idx_err error
+
+	err = it.data.Close(ctx)
+	idx_err = it.idx.Close(ctx)
+	if err == nil {
+		err = idx_err
+	}
+	return err
+}
+
+/*
+mergingIterator merges a number of iterators into a single one. If multiple
+iterators contain the same key, the record from the iterator listed first
+wins, so the iterators should be ordered from newest to oldest.
+*/
+type mergingIterator struct {
+	children []internalIterator
+	current  int
+}
+
+/*
+newMergingIterator creates a merging iterator over the specified iterators.
+*/
+func newMergingIterator(children []internalIterator) *mergingIterator {
+	return &mergingIterator{children: children, current: -1}
+}
+
+/*
+findCurrent determines the child iterator holding the smallest key.
+*/
+func (it *mergingIterator) findCurrent() {
+	var i int
+
+	it.current = -1
+	for i = range it.children {
+		if !it.children[i].valid() {
+			continue
+		}
+		if it.current < 0 ||
+			it.children[i].key() < it.children[it.current].key() {
+			it.current = i
+		}
+	}
+}
+
+func (it *mergingIterator) seek(ctx context.Context, key string) error {
+	var child internalIterator
+	var err error
+
+	for _, child = range it.children {
+		if err = child.seek(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	it.findCurrent()
+	return nil
+}
+
+func (it *mergingIterator) next(ctx context.Context) error {
+	var key = it.key()
+	var child internalIterator
+	var err error
+
+	// Skip the current key in all children, including older versions of it.
+	for _, child = range it.children {
+		if child.valid() && child.key() == key {
+			if err = child.next(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	it.findCurrent()
+	return nil
+}
+
+func (it *mergingIterator) valid() bool {
+	return it.current >= 0
+}
+
+func (it *mergingIterator) key() string {
+	return it.children[it.current].key()
+}
+
+func (it *mergingIterator) value() string {
+	return it.children[it.current].value()
+}
+
+/*
+values returns the encoded values of the current key held by all children,
+from newest to oldest.
+*/
+func (it *mergingIterator) values() []string {
+	var key = it.key()
+	var values []string
+	var child internalIterator
+
+	for _, child = range it.children {
+		if child.valid() && child.key() == key {
+			values = append(values, child.value())
+		}
+	}
+
+	return values
+}
+
+/*
+lookup adds the encoded values of the current key to a lookup, from newest to
+oldest, until the value of the key is determined. It returns whether that
+happened.
+*/
+func (it *mergingIterator) lookup(l *mergeLookup) (bool, error) {
+	var encoded string
+	var done bool
+	var err error
+
+	for _, encoded = range it.values() {
+		if done, err = l.add(encoded); err != nil || done {
+			return done, err
+		}
+	}
+
+	return false, nil
+}
+
+func (it *mergingIterator) close(ctx context.Context) error {
+	var child internalIterator
+	var err, close_err error
+
+	for _, child = range it.children {
+		close_err = child.close(ctx)
+		if err == nil {
+			err = close_err
+		}
+	}
+	return err
+}
+
+/*
+Iterator iterates over the contents of the database in ascending key order.
+It sees the state of the database at the time it was created. Iterators must
+be closed after use, since they keep the tables they read from alive.
+
+	it, err := db.NewIterator(ctx)
+	...
+	defer it.Close(ctx)
+	for it.Next(ctx) {
+		fmt.Println(it.Key(), it.Value())
+	}
+	if it.Err() != nil {
+		...
+	}
+*/
+type Iterator struct {
+	version *manifest.Version
+	merged  *mergingIterator
+	op      sstable.MergeOperator
+	started bool
+	value   string
+	err     error
+}
+
+/*
+Seek positions the iterator such that the following call to Next will move
+it to the first key greater than or equal to the specified key.
+*/
+func (it *Iterator) Seek(ctx context.Context, key string) {
+	it.err = it.merged.seek(ctx, key)
+	it.started = false
+}
+
+/*
+Next moves the iterator to the next key, returning whether there is one.
+*/
+func (it *Iterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.started && it.merged.valid() {
+		if it.err = it.merged.next(ctx); it.err != nil {
+			return false
+		}
+	}
+	it.started = true
+
+	for it.merged.valid() {
+		var l = newMergeLookup(it.op, it.merged.key())
+
+		if _, it.err = it.merged.lookup(l); it.err != nil {
+			return false
+		}
+		it.value, it.err = resolveLookup(l)
+		if it.err == nil {
+			return true
+		}
+		if it.err != Err_NotFound {
+			return false
+		}
+
+		// Skip over deleted keys.
+		if it.err = it.merged.next(ctx); it.err != nil {
+			return false
+		}
+	}
+
+	return false
+}
+
+/*
+Key returns the key the iterator is positioned at.
+*/
+func (it *Iterator) Key() string {
+	return it.merged.key()
+}
+
+/*
+Value returns the value of the key the iterator is positioned at.
+*/
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+/*
+Err returns the error which ended the iteration prematurely, if any.
+*/
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+/*
+Close releases the resources held by the iterator.
+*/
+func (it *Iterator) Close(ctx context.Context) error {
+	var err = it.merged.close(ctx)
+
+	if it.version != nil {
+		it.version.Unref(ctx)
+		it.version = nil
+	}
+	return err
+}
+
+/*
+levelIterator iterates over the tables of a level other than level 0, which
+hold non-overlapping key ranges. Only one table is open at any time.
+*/
+type levelIterator struct {
+	storage Storage
+	tables  []*manifest.TableInfo
+	index   int
+	current *tableIterator
+}
+
+/*
+newLevelIterator creates an iterator over the specified tables, which must be
+sorted by key and must not overlap.
+*/
+func newLevelIterator(
+	storage Storage, tables []*manifest.TableInfo) *levelIterator {
+	return &levelIterator{storage: storage, tables: tables}
+}
+
+/*
+openTable switches the iterator to the table with the specified index.
+*/
+func (it *levelIterator) openTable(ctx context.Context, index int) error {
+	var err error
+
+	if it.current != nil {
+		it.current.close(ctx)
+		it.current = nil
+	}
+
+	it.index = index
+	if index >= len(it.tables) {
+		return nil
+	}
+
+	it.current, err = newTableIterator(
+		ctx, it.storage, it.tables[index].Number)
+	return err
+}
+
+/*
+skipExhausted moves on to the following tables while the current one has no
+more records.
+*/
+func (it *levelIterator) skipExhausted(ctx context.Context) error {
+	var err error
+
+	for it.current != nil && !it.current.valid() {
+		if err = it.openTable(ctx, it.index+1); err != nil {
+			return err
+		}
+		if it.current != nil {
+			if err = it.current.seek(ctx, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (it *levelIterator) seek(ctx context.Context, key string) error {
+	var index int
+	var err error
+
+	index = sort.Search(len(it.tables), func(i int) bool {
+		return string(it.tables[i].LargestKey) >= key
+	})
+
+	if err = it.openTable(ctx, index); err != nil {
+		return err
+	}
+	if it.current == nil {
+		return nil
+	}
+	if err = it.current.seek(ctx, key); err != nil {
+		return err
+	}
+
+	return it.skipExhausted(ctx)
+}
+
+func (it *levelIterator) next(ctx context.Context) error {
+	var err error
+
+	if err = it.current.next(ctx); err != nil {
+		return err
+	}
+
+	return it.skipExhausted(ctx)
+}
+
+func (it *levelIterator) valid() bool {
+	return it.current != nil && it.current.valid()
+}
+
+func (it *levelIterator) key() string {
+	return it.current.key()
+}
+
+func (it *levelIterator) value() string {
+	return it.current.value()
+}
+
+func (it *levelIterator) close(ctx context.Context) error {
+	if it.current != nil {
+		return it.current.close(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package lsm
+
+import (
+	"encoding/binary"
+
+	"github.com/childoftheuniverse/sstable"
+)
+
+/*
+maxSequence is larger than the sequence number of any write, so reading as of
+maxSequence sees all writes.
+*/
+const maxSequence = ^uint64(0)
+
+/*
+memtableKey determines the key under which the write of a key with the
+specified sequence number is stored in a memtable. Every write is stored as a
+separate entry, so memtables are only ever appended to and can be read as of
+any sequence number. Entries are sorted by key, and newest first for the same
+key: zero bytes in the key are escaped so that the key can be terminated by
+a zero byte, followed by the inverted sequence number.
+*/
+func memtableKey(key string, seq uint64) string {
+	var b = make([]byte, 0, len(key)+10)
+	var i int
+
+	for i = 0; i < len(key); i++ {
+		b = append(b, key[i])
+		if key[i] == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	b = append(b, 0, 1)
+	b = binary.BigEndian.AppendUint64(b, ^seq)
+
+	return string(b)
+}
+
+/*
+parseMemtableKey determines the key and sequence number from the key of a
+memtable entry.
+*/
+func parseMemtableKey(entry string) (string, uint64) {
+	var escaped = entry[:len(entry)-10]
+	var b = make([]byte, 0, len(escaped))
+	var i int
+
+	for i = 0; i < len(escaped); i++ {
+		b = append(b, escaped[i])
+		if escaped[i] == 0 {
+			// Skip the escape byte.
+			i++
+		}
+	}
+
+	return string(b), ^binary.BigEndian.Uint64([]byte(entry[len(entry)-8:]))
+}
+
+/*
+addToMemtable adds an encoded value to the memtable as the write with the
+specified sequence number.
+*/
+func addToMemtable(mem *sstable.Memtable, key, encoded string, seq uint64) {
+	mem.Put(memtableKey(key, seq), encoded)
+}
+
+/*
+memtableLookup adds the encoded values of the lookups key from the memtable
+to the lookup, from newest to oldest, ignoring writes with sequence numbers
+higher than seq. It returns whether the value of the key has been determined.
+*/
+func memtableLookup(mem *sstable.Memtable, l *mergeLookup, seq uint64) (
+	bool, error) {
+	var it = mem.NewIterator()
+	var done bool
+	var err error
+
+	it.Seek(memtableKey(l.key, seq))
+	for it.Next() {
+		var key string
+
+		if key, _ = parseMemtableKey(it.Key()); key != l.key {
+			break
+		}
+		if done, err = l.add(it.Value()); err != nil || done {
+			return done, err
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,137 @@
+package lsm
+
+import (
+	"github.com/childoftheuniverse/sstable"
+)
+
+/*
+mergeLookup determines the value of a key from its encoded values, which are
+added from newest to oldest. Merge operands are collected until a value or
+deletion they apply to is found, at which point they are folded onto it using
+the merge operator; values older than that are irrelevant.
+*/
+type mergeLookup struct {
+	op  sstable.MergeOperator
+	key string
+
+	// Operands collected so far, oldest first.
+	operands []string
+
+	// Encoded result, once determined.
+	encoded string
+	done    bool
+}
+
+/*
+newMergeLookup starts determining the value of the specified key.
+*/
+func newMergeLookup(op sstable.MergeOperator, key string) *mergeLookup {
+	return &mergeLookup{op: op, key: key}
+}
+
+/*
+add adds the next older encoded value of the key. It returns whether the
+value of the key has been determined, in which case no more values need to be
+added.
+*/
+func (l *mergeLookup) add(encoded string) (bool, error) {
+	var value string
+	var deleted bool
+	var err error
+
+	if l.done {
+		return true, nil
+	}
+
+	if valueType(encoded) == typeMerge {
+		var operands []string
+
+		if operands, err = decodeMerge(encoded); err != nil {
+			return false, err
+		}
+		l.operands = append(operands, l.operands...)
+		return false, nil
+	}
+
+	l.done = true
+	if len(l.operands) == 0 {
+		l.encoded = encoded
+		return true, nil
+	}
+
+	value, deleted = decodeValue(encoded)
+	return true, l.fullMerge(value, !deleted)
+}
+
+/*
+finish determines the value of the key from the operands collected so far,
+assuming the key has no older values.
+*/
+func (l *mergeLookup) finish() error {
+	if l.done {
+		return nil
+	}
+
+	l.done = true
+	if len(l.operands) == 0 {
+		l.encoded = deletionMarker
+		return nil
+	}
+
+	return l.fullMerge("", false)
+}
+
+/*
+fullMerge folds the operands onto the existing value.
+*/
+func (l *mergeLookup) fullMerge(existing string, has_existing bool) error {
+	var value string
+	var err error
+
+	if l.op == nil {
+		return sstable.Err_NoMergeOperator
+	}
+
+	value, err = l.op.FullMerge(l.key, existing, has_existing, l.operands)
+	if err != nil {
+		return err
+	}
+
+	l.encoded = encodeValue(value)
+	l.operands = nil
+	return nil
+}
+
+/*
+result returns the encoded value of the key once it has been determined.
+Otherwise, the operands collected so far are returned as an encoded merge,
+with consecutive operands combined where the merge operator allows.
+*/
+func (l *mergeLookup) result() string {
+	var operands []string
+	var operand string
+
+	if l.done {
+		return l.encoded
+	}
+	if l.op == nil {
+		return encodeMerge(l.operands)
+	}
+
+	for _, operand = range l.operands {
+		var merged string
+		var ok bool
+
+		if len(operands) > 0 {
+			merged, ok = l.op.PartialMerge(
+				l.key, operands[len(operands)-1], operand)
+		}
+		if ok {
+			operands[len(operands)-1] = merged
+		} else {
+			operands = append(operands, operand)
+		}
+	}
+
+	return encodeMerge(operands)
+}
@@ -0,0 +1,151 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+/*
+Err_SnapshotReleased indicates that a snapshot has already been released.
+*/
+var Err_SnapshotReleased = errors.New(
+	"Snapshot released")
+
+/*
+Snapshot is a consistent, read-only view of the database at the time it was
+created. Lookups and iterators using a snapshot are not affected by later
+writes, flushes or compactions.
+
+A snapshot pins the tables which were part of the database when it was
+created: tables compacted away in the meantime are only deleted once the
+snapshot, and all iterators created from it, have been released. Snapshots
+should therefore be released as soon as they're no longer needed. Memtables
+are only ever appended to, so a snapshot keeps the memtables it was created
+from and reads them as of the sequence number of the last write it includes.
+*/
+type Snapshot struct {
+	db      *DB
+	version *manifest.Version
+	// Memtables, from newest to oldest, and the sequence number to read
+	// them as of.
+	mems []*sstable.Memtable
+	seq  uint64
+}
+
+/*
+NewSnapshot creates a snapshot of the current contents of the database.
+*/
+func (db *DB) NewSnapshot(ctx context.Context) (*Snapshot, error) {
+	var s = &Snapshot{db: db}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, Err_Closed
+	}
+
+	s.mems = append(s.mems, db.mem)
+	if db.imm != nil {
+		s.mems = append(s.mems, db.imm)
+	}
+	s.seq = db.seq
+	s.version = db.manifest.Current()
+
+	return s, nil
+}
+
+/*
+Get looks up the value of the specified key as of the time the snapshot was
+created. Err_NotFound is returned if the key did not exist.
+*/
+func (s *Snapshot) Get(ctx context.Context, key string) (string, error) {
+	var l = newMergeLookup(s.db.opts.MergeOperator, key)
+	var mem *sstable.Memtable
+	var done bool
+	var err error
+
+	if s.version == nil {
+		return "", Err_SnapshotReleased
+	}
+
+	for _, mem = range s.mems {
+		if done, err = memtableLookup(mem, l, s.seq); err != nil {
+			return "", err
+		}
+		if done {
+			break
+		}
+	}
+	if !done {
+		if err = s.db.getFromTables(ctx, s.version, l); err != nil {
+			return "", err
+		}
+	}
+
+	return resolveLookup(l)
+}
+
+/*
+NewIterator creates an iterator over the contents of the database as of the
+time the snapshot was created, positioned before the first key. The iterator
+remains usable even if the snapshot is released before the iterator is
+closed.
+*/
+func (s *Snapshot) NewIterator(ctx context.Context) (*Iterator, error) {
+	var children []internalIterator
+	var mem *sstable.Memtable
+	var v = s.version
+	var it *Iterator
+	var i int
+
+	if v == nil {
+		return nil, Err_SnapshotReleased
+	}
+
+	for _, mem = range s.mems {
+		children = append(children, newMemIterator(
+			mem, s.seq, s.db.opts.MergeOperator))
+	}
+	for i = len(v.Level(0)) - 1; i >= 0; i-- {
+		children = append(children, newLevelIterator(
+			s.db.storage, v.Level(0)[i:i+1]))
+	}
+	for i = 1; i < v.NumLevels(); i++ {
+		if len(v.Level(i)) > 0 {
+			children = append(children, newLevelIterator(
+				s.db.storage, v.Level(i)))
+		}
+	}
+
+	v.Ref()
+	it = &Iterator{
+		version: v,
+		merged:  newMergingIterator(children),
+		op:      s.db.opts.MergeOperator,
+	}
+	it.Seek(ctx, "")
+	if it.err != nil {
+		var err = it.err
+
+		it.Close(ctx)
+		return nil, err
+	}
+
+	return it, nil
+}
+
+/*
+Release releases the tables pinned by the snapshot. The snapshot can't be
+used any more afterwards.
+*/
+func (s *Snapshot) Release(ctx context.Context) {
+	if s.version != nil {
+		s.version.Unref(ctx)
+		s.version = nil
+		s.mems = nil
+	}
+}
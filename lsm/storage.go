@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"context"
+	"net/url"
+	"path"
+
+	"github.com/childoftheuniverse/filesystem"
+)
+
+/*
+Storage provides access to the files of a database. All files of a database
+live in the same directory, so they are only identified by their names.
+*/
+type Storage interface {
+	/*
+		Create creates a new file with the specified name, replacing any
+		existing file of the same name.
+	*/
+	Create(ctx context.Context, name string) (filesystem.WriteCloser, error)
+
+	/*
+		Open opens an existing file for reading. Table files must support
+		seeking.
+	*/
+	Open(ctx context.Context, name string) (filesystem.ReadCloser, error)
+
+	/*
+		Remove deletes the file with the specified name.
+	*/
+	Remove(ctx context.Context, name string) error
+
+	/*
+		List returns the names of all files of the database.
+	*/
+	List(ctx context.Context) ([]string, error)
+}
+
+/*
+filesystemStorage implements Storage on top of the filesystem package, so
+that databases can be kept on any of its backends.
+*/
+type filesystemStorage struct {
+	base *url.URL
+}
+
+/*
+NewFilesystemStorage creates a Storage keeping all files in the directory
+specified by base, using whatever filesystem implementation is registered for
+its scheme.
+*/
+func NewFilesystemStorage(base *url.URL) Storage {
+	return &filesystemStorage{base: base}
+}
+
+/*
+fileURL determines the URL of the file with the specified name.
+*/
+func (s *filesystemStorage) fileURL(name string) *url.URL {
+	var u = *s.base
+	u.Path = path.Join(u.Path, name)
+	return &u
+}
+
+func (s *filesystemStorage) Create(ctx context.Context, name string) (
+	filesystem.WriteCloser, error) {
+	return filesystem.OpenWriter(ctx, s.fileURL(name))
+}
+
+func (s *filesystemStorage) Open(ctx context.Context, name string) (
+	filesystem.ReadCloser, error) {
+	return filesystem.OpenReader(ctx, s.fileURL(name))
+}
+
+func (s *filesystemStorage) Remove(ctx context.Context, name string) error {
+	return filesystem.Remove(ctx, s.fileURL(name))
+}
+
+func (s *filesystemStorage) List(ctx context.Context) ([]string, error) {
+	return filesystem.ListEntries(ctx, s.base)
+}
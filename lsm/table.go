@@ -0,0 +1,206 @@
+package lsm
+
+import (
+	"context"
+	"sync"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/sstable"
+	"github.com/childoftheuniverse/sstable/manifest"
+)
+
+/*
+Index settings for all tables written by the database.
+*/
+const (
+	tableIndexType = sstable.IndexType_EVERY_N_BYTES
+	tableIndexN    = 4096
+)
+
+/*
+table holds the reader used for point lookups in a single sstable belonging
+to the database. Which tables are part of the database is recorded by the
+manifest; tables are kept until the manifest reports them as obsolete.
+*/
+type table struct {
+	info *manifest.TableInfo
+
+	// Reader used for point lookups, opened on first use.
+	mu     sync.Mutex
+	data   filesystem.ReadCloser
+	idx    filesystem.ReadCloser
+	reader *sstable.Reader
+}
+
+/*
+newTable creates a table for the specified description.
+*/
+func newTable(info *manifest.TableInfo) *table {
+	return &table{info: info}
+}
+
+/*
+openTableReader opens a new reader for the table with the specified number,
+along with the files it reads from.
+*/
+func openTableReader(ctx context.Context, storage Storage, number uint64) (
+	*sstable.Reader, filesystem.ReadCloser, filesystem.ReadCloser, error) {
+	var data, idx filesystem.ReadCloser
+	var reader *sstable.Reader
+	var err error
+
+	data, err = storage.Open(ctx, tableFileName(number))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	idx, err = storage.Open(ctx, indexFileName(number))
+	if err != nil {
+		data.Close(ctx)
+		return nil, nil, nil, err
+	}
+
+	reader, err = sstable.NewReaderWithIdx(ctx, data, idx, true)
+	if err != nil {
+		data.Close(ctx)
+		idx.Close(ctx)
+		return nil, nil, nil, err
+	}
+
+	return reader, data, idx, nil
+}
+
+/*
+get looks up the encoded value of the specified key in the table.
+*/
+func (t *table) get(ctx context.Context, storage Storage, key string) (
+	string, bool, error) {
+	var encoded string
+	var err error
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reader == nil {
+		t.reader, t.data, t.idx, err = openTableReader(
+			ctx, storage, t.info.Number)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	encoded, err = t.reader.ReadString(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Encoded values are never empty, so this means the key wasn't found.
+	return encoded, len(encoded) > 0, nil
+}
+
+/*
+close closes the files of the reader used for point lookups, if any.
+*/
+func (t *table) close(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reader != nil {
+		t.data.Close(ctx)
+		t.idx.Close(ctx)
+		t.reader = nil
+	}
+}
+
+/*
+removeTableFiles deletes the files of the table with the specified number.
+*/
+func removeTableFiles(ctx context.Context, storage Storage,
+	number uint64) error {
+	var err error
+
+	if err = storage.Remove(ctx, indexFileName(number)); err != nil {
+		return err
+	}
+	return storage.Remove(ctx, tableFileName(number))
+}
+
+/*
+tableBuilder writes a new table and keeps track of its description.
+*/
+type tableBuilder struct {
+	writer *sstable.Writer
+	info   *manifest.TableInfo
+	empty  bool
+}
+
+/*
+newTableBuilder creates the files for a new table with the specified number
+and level.
+*/
+func newTableBuilder(ctx context.Context, storage Storage, number uint64,
+	level int) (*tableBuilder, error) {
+	var data, idx filesystem.WriteCloser
+	var err error
+
+	data, err = storage.Create(ctx, tableFileName(number))
+	if err != nil {
+		return nil, err
+	}
+	idx, err = storage.Create(ctx, indexFileName(number))
+	if err != nil {
+		data.Close(ctx)
+		return nil, err
+	}
+
+	return &tableBuilder{
+		writer: sstable.NewIndexedWriter(
+			ctx, data, idx, tableIndexType, tableIndexN),
+		info: &manifest.TableInfo{
+			Number: number,
+			Level:  int32(level),
+		},
+		empty: true,
+	}, nil
+}
+
+/*
+add appends a record with an encoded value to the table.
+*/
+func (b *tableBuilder) add(ctx context.Context, key, encoded string) error {
+	var err error
+
+	if err = b.writer.WriteString(ctx, key, encoded); err != nil {
+		return err
+	}
+
+	if b.empty {
+		b.info.SmallestKey = []byte(key)
+		b.empty = false
+	}
+	b.info.LargestKey = []byte(key)
+	b.info.Size += int64(len(key) + len(encoded))
+
+	return nil
+}
+
+/*
+finish closes the files of the table and returns its description.
+*/
+func (b *tableBuilder) finish(ctx context.Context) (
+	*manifest.TableInfo, error) {
+	var err error
+
+	if err = b.writer.Close(ctx); err != nil {
+		return nil, err
+	}
+
+	return b.info, nil
+}
+
+/*
+abandon closes and deletes the files of a table which couldn't be completed.
+*/
+func (b *tableBuilder) abandon(ctx context.Context, storage Storage) {
+	b.writer.Close(ctx)
+	removeTableFiles(ctx, storage, b.info.Number)
+}
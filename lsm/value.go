@@ -0,0 +1,98 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+Err_CorruptValue indicates that an encoded value could not be decoded.
+*/
+var Err_CorruptValue = errors.New(
+	"Corrupt encoded value")
+
+/*
+Values are stored in the memtable, log and tables in an internal encoding:
+the first byte holds the type of the value, followed by the value itself for
+regular values, or by the length-prefixed merge operands, oldest first, for
+merges.
+*/
+const (
+	typeDeletion byte = 0
+	typeValue    byte = 1
+	typeMerge    byte = 2
+)
+
+/*
+deletionMarker is the encoded value recording the deletion of a key.
+*/
+const deletionMarker = "\x00"
+
+/*
+encodeValue converts a value into the internal encoding.
+*/
+func encodeValue(value string) string {
+	return "\x01" + value
+}
+
+/*
+encodeMerge converts merge operands into the internal encoding.
+*/
+func encodeMerge(operands []string) string {
+	var encoded = []byte{typeMerge}
+	var length [binary.MaxVarintLen64]byte
+	var operand string
+
+	for _, operand = range operands {
+		var n = binary.PutUvarint(length[:], uint64(len(operand)))
+
+		encoded = append(encoded, length[:n]...)
+		encoded = append(encoded, operand...)
+	}
+
+	return string(encoded)
+}
+
+/*
+valueType determines the type of an encoded value.
+*/
+func valueType(encoded string) byte {
+	if len(encoded) == 0 {
+		return typeDeletion
+	}
+	return encoded[0]
+}
+
+/*
+decodeValue converts an encoded value back into the value, also reporting
+whether the encoded value records the deletion of the key. Merges must be
+decoded using decodeMerge instead.
+*/
+func decodeValue(encoded string) (string, bool) {
+	if valueType(encoded) == typeDeletion {
+		return "", true
+	}
+	return encoded[1:], false
+}
+
+/*
+decodeMerge converts an encoded merge back into its operands.
+*/
+func decodeMerge(encoded string) ([]string, error) {
+	var data = []byte(encoded[1:])
+	var operands []string
+
+	for len(data) > 0 {
+		var length uint64
+		var n int
+
+		length, n = binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, Err_CorruptValue
+		}
+		operands = append(operands, string(data[n:n+int(length)]))
+		data = data[n+int(length):]
+	}
+
+	return operands, nil
+}
@@ -0,0 +1,503 @@
+/*
+Package manifest keeps track of which tables form the current consistent set
+of a store made up of many sstables.
+
+Changes to the set of tables are recorded as edits, which are appended to a
+manifest file atomically: after a crash, the set of tables is recovered as of
+the last edit written completely. Readers access the set of tables through
+immutable, reference counted versions, so that tables can be replaced by
+newer ones without disturbing reads in progress.
+*/
+package manifest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/recordio"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Err_UnknownTable indicates that an edit removes a table which is not part of
+the current version.
+*/
+var Err_UnknownTable = errors.New(
+	"Removed table not in current version")
+
+/*
+Err_LevelOutOfRange indicates that an edit adds a table to a level which
+doesn't exist.
+*/
+var Err_LevelOutOfRange = errors.New(
+	"Table level out of range")
+
+/*
+Err_OverlappingTables indicates that an edit would leave overlapping tables
+in a level other than level 0.
+*/
+var Err_OverlappingTables = errors.New(
+	"Overlapping tables in level")
+
+/*
+Err_CorruptManifest indicates that manifest files exist, but none of them
+could be read.
+*/
+var Err_CorruptManifest = errors.New(
+	"No readable manifest")
+
+/*
+Err_Closed indicates that the manifest has already been closed.
+*/
+var Err_Closed = errors.New(
+	"Manifest closed")
+
+/*
+Storage provides access to the manifest files. All manifest files live in the
+same directory, so they are only identified by their names.
+*/
+type Storage interface {
+	/*
+		Create creates a new file with the specified name, replacing any
+		existing file of the same name.
+	*/
+	Create(ctx context.Context, name string) (filesystem.WriteCloser, error)
+
+	/*
+		Open opens an existing file for reading.
+	*/
+	Open(ctx context.Context, name string) (filesystem.ReadCloser, error)
+
+	/*
+		Remove deletes the file with the specified name.
+	*/
+	Remove(ctx context.Context, name string) error
+
+	/*
+		List returns the names of all files in the directory.
+	*/
+	List(ctx context.Context) ([]string, error)
+}
+
+/*
+Options configures the behavior of a manifest. Fields left at zero take the
+default values listed.
+*/
+type Options struct {
+	// Number of levels. 7.
+	NumLevels int
+
+	// Size in bytes beyond which the manifest file is rewritten to contain
+	// just the current version. 4 MB.
+	MaxFileSize int64
+
+	// Called for every table which is no longer part of any version, so
+	// that its files can be deleted. Optional.
+	Obsolete func(ctx context.Context, info *TableInfo)
+}
+
+/*
+withDefaults fills in the default values for all unset options.
+*/
+func (o Options) withDefaults() Options {
+	if o.NumLevels <= 0 {
+		o.NumLevels = 7
+	}
+	if o.MaxFileSize <= 0 {
+		o.MaxFileSize = 4 << 20
+	}
+	return o
+}
+
+/*
+Manifest records the current set of tables of a store. All methods are safe
+for concurrent use.
+*/
+type Manifest struct {
+	storage Storage
+	opts    Options
+
+	// mu protects the versions, reference counts and numbers.
+	mu               sync.Mutex
+	current          *Version
+	table_refs       map[uint64]int
+	next_file_number uint64
+	log_number       uint64
+
+	// write_mu serializes edits and protects the manifest file.
+	write_mu  sync.Mutex
+	number    uint64
+	out       filesystem.WriteCloser
+	rec       *recordio.RecordWriter
+	file_size int64
+	err       error
+}
+
+/*
+manifestFileName determines the name of the manifest file with the specified
+number.
+*/
+func manifestFileName(number uint64) string {
+	return fmt.Sprintf("%06d.manifest", number)
+}
+
+/*
+parseManifestFileName determines the number of a manifest file from its name.
+The flag returned indicates whether the name is that of a manifest file.
+*/
+func parseManifestFileName(name string) (uint64, bool) {
+	var number uint64
+	var err error
+
+	if !strings.HasSuffix(name, ".manifest") {
+		return 0, false
+	}
+	number, err = strconv.ParseUint(
+		strings.TrimSuffix(name, ".manifest"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+/*
+Open recovers the manifest kept in storage, or creates a new, empty one if
+there is none. The recovered state is written to a new manifest file, and
+older manifest files are removed.
+*/
+func Open(ctx context.Context, storage Storage, opts Options) (
+	*Manifest, error) {
+	var m = &Manifest{
+		storage:    storage,
+		opts:       opts.withDefaults(),
+		table_refs: make(map[uint64]int),
+	}
+	var names []string
+	var name string
+	var numbers []uint64
+	var number uint64
+	var v *Version
+	var err error
+
+	names, err = storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name = range names {
+		var ok bool
+
+		number, ok = parseManifestFileName(name)
+		if ok {
+			numbers = append(numbers, number)
+			if number >= m.next_file_number {
+				m.next_file_number = number + 1
+			}
+		}
+	}
+
+	// Use the most recent manifest which can be read; the last one may have
+	// been left incomplete by a crash while rewriting it.
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] > numbers[j]
+	})
+	v = newVersion(m, m.opts.NumLevels)
+	for _, number = range numbers {
+		v, err = m.readManifest(ctx, number)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, Err_CorruptManifest
+	}
+
+	m.install(v)
+
+	if err = m.rewrite(ctx); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+/*
+readManifest recovers the version recorded in the manifest file with the
+specified number. Reading stops at the first edit which is incomplete, since
+it was never acknowledged. The manifest file must start with a complete
+edit, though.
+*/
+func (m *Manifest) readManifest(ctx context.Context, number uint64) (
+	*Version, error) {
+	var in filesystem.ReadCloser
+	var rec *recordio.RecordReader
+	var v = newVersion(m, m.opts.NumLevels)
+	var first = true
+	var err error
+
+	in, err = m.storage.Open(ctx, manifestFileName(number))
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close(ctx)
+
+	rec = recordio.NewRecordReader(in)
+
+	for {
+		var edit Edit
+		var data []byte
+
+		data, err = rec.ReadRecord(ctx)
+		if err == nil {
+			err = proto.Unmarshal(data, &edit)
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && first {
+			return nil, err
+		}
+		if err == io.ErrUnexpectedEOF || (err != nil && data != nil) {
+			// Everything after the last complete edit is ignored.
+			return v, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if v, err = v.apply(&edit); err != nil {
+			return nil, err
+		}
+		m.updateNumbers(&edit)
+		first = false
+	}
+}
+
+/*
+updateNumbers takes over the file and log numbers recorded in an edit.
+*/
+func (m *Manifest) updateNumbers(edit *Edit) {
+	if edit.NextFileNumber > m.next_file_number {
+		m.next_file_number = edit.NextFileNumber
+	}
+	if edit.LogNumber > m.log_number {
+		m.log_number = edit.LogNumber
+	}
+}
+
+/*
+install makes the version current. The manifest mutex must be held, unless
+the manifest is not shared yet. The reference on the previous version is
+returned to the caller, who has to release it once the mutex is released.
+*/
+func (m *Manifest) install(v *Version) *Version {
+	var prev = m.current
+	var info *TableInfo
+
+	for _, info = range v.Tables() {
+		m.table_refs[info.Number]++
+	}
+	v.refs++
+	m.current = v
+
+	return prev
+}
+
+/*
+rewrite starts a new manifest file holding just the current version, and
+removes the previous manifest file. The write mutex must be held, unless the
+manifest is not shared yet.
+*/
+func (m *Manifest) rewrite(ctx context.Context) error {
+	var snapshot Edit
+	var out filesystem.WriteCloser
+	var rec *recordio.RecordWriter
+	var names []string
+	var name string
+	var number uint64
+	var data []byte
+	var err error
+
+	m.mu.Lock()
+	number = m.next_file_number
+	m.next_file_number++
+	snapshot.Added = m.current.Tables()
+	snapshot.NextFileNumber = m.next_file_number
+	snapshot.LogNumber = m.log_number
+	m.mu.Unlock()
+
+	if data, err = proto.Marshal(&snapshot); err != nil {
+		return err
+	}
+
+	if out, err = m.storage.Create(ctx, manifestFileName(number)); err != nil {
+		return err
+	}
+	rec = recordio.NewRecordWriter(out)
+	if _, err = rec.Write(ctx, data); err == nil {
+		err = syncFile(ctx, out)
+	}
+	if err != nil {
+		out.Close(ctx)
+		return err
+	}
+
+	if m.out != nil {
+		m.out.Close(ctx)
+	}
+	m.number = number
+	m.out = out
+	m.rec = rec
+	m.file_size = int64(len(data))
+
+	// The new manifest file is complete, so all others can go.
+	if names, err = m.storage.List(ctx); err != nil {
+		return err
+	}
+	for _, name = range names {
+		var old uint64
+		var ok bool
+
+		old, ok = parseManifestFileName(name)
+		if ok && old != number {
+			if err = m.storage.Remove(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+syncer is implemented by writers which can flush written data to stable
+storage.
+*/
+type syncer interface {
+	Sync(ctx context.Context) error
+}
+
+/*
+syncFile syncs the file to stable storage, if the writer supports it.
+*/
+func syncFile(ctx context.Context, out filesystem.WriteCloser) error {
+	var s syncer
+	var ok bool
+
+	s, ok = out.(syncer)
+	if !ok {
+		return nil
+	}
+	return s.Sync(ctx)
+}
+
+/*
+Apply records the edit in the manifest and installs the resulting version as
+the current one. Unless the edit sets a log number, the previous one is kept.
+Once Apply returns successfully, the edit will survive a crash.
+
+Errors writing the manifest file are sticky: since the state of the manifest
+file is unknown afterwards, all further edits fail.
+*/
+func (m *Manifest) Apply(ctx context.Context, edit *Edit) error {
+	var v, prev *Version
+	var data []byte
+	var err error
+
+	m.write_mu.Lock()
+	defer m.write_mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.mu.Lock()
+	v, err = m.current.apply(edit)
+	edit.NextFileNumber = m.next_file_number
+	if edit.LogNumber == 0 {
+		edit.LogNumber = m.log_number
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if data, err = proto.Marshal(edit); err != nil {
+		return err
+	}
+	if _, err = m.rec.Write(ctx, data); err == nil {
+		err = syncFile(ctx, m.out)
+	}
+	if err != nil {
+		m.err = err
+		return err
+	}
+	m.file_size += int64(len(data))
+
+	m.mu.Lock()
+	m.updateNumbers(edit)
+	prev = m.install(v)
+	m.mu.Unlock()
+
+	prev.Unref(ctx)
+
+	if m.file_size > m.opts.MaxFileSize {
+		// A failed rewrite leaves the current manifest file intact.
+		m.rewrite(ctx)
+	}
+
+	return nil
+}
+
+/*
+Current returns the current version, holding a reference on it which must be
+released using Unref.
+*/
+func (m *Manifest) Current() *Version {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current.refs++
+	return m.current
+}
+
+/*
+NewFileNumber allocates a new number for a table or other file.
+*/
+func (m *Manifest) NewFileNumber() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next_file_number++
+	return m.next_file_number - 1
+}
+
+/*
+LogNumber returns the number of the oldest log segment holding writes which
+are not in any table yet, as recorded by the last edit.
+*/
+func (m *Manifest) LogNumber() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log_number
+}
+
+/*
+Close closes the manifest file. Versions still referenced remain readable.
+*/
+func (m *Manifest) Close(ctx context.Context) error {
+	m.write_mu.Lock()
+	defer m.write_mu.Unlock()
+
+	var out = m.out
+
+	if out == nil {
+		return nil
+	}
+	m.err = Err_Closed
+	m.out, m.rec = nil, nil
+	return out.Close(ctx)
+}
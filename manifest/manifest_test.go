@@ -0,0 +1,219 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/childoftheuniverse/sstable/internal/memfs"
+)
+
+// tableNumbers lists the numbers of the tables in a version, by level.
+func tableNumbers(v *Version) [][]uint64 {
+	var numbers = make([][]uint64, v.NumLevels())
+	var info *TableInfo
+	var i int
+
+	for i = range numbers {
+		for _, info = range v.Level(i) {
+			numbers[i] = append(numbers[i], info.Number)
+		}
+	}
+	return numbers
+}
+
+// Apply edits, then recover them from the manifest.
+func TestApplyAndRecover(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var m *Manifest
+	var v *Version
+	var a, b, c uint64
+	var names []string
+	var err error
+
+	m, err = Open(ctx, storage, Options{NumLevels: 3})
+	if err != nil {
+		t.Fatal("Error creating manifest: ", err)
+	}
+
+	a, b, c = m.NewFileNumber(), m.NewFileNumber(), m.NewFileNumber()
+	err = m.Apply(ctx, &Edit{
+		Added: []*TableInfo{
+			{Number: a, Level: 0, SmallestKey: []byte("a"), LargestKey: []byte("z")},
+			{Number: b, Level: 1, SmallestKey: []byte("m"), LargestKey: []byte("p")},
+		},
+		LogNumber: 7,
+	})
+	if err != nil {
+		t.Fatal("Error applying edit: ", err)
+	}
+	err = m.Apply(ctx, &Edit{
+		Added: []*TableInfo{
+			{Number: c, Level: 1, SmallestKey: []byte("a"), LargestKey: []byte("f")},
+		},
+		Removed: []uint64{a},
+	})
+	if err != nil {
+		t.Fatal("Error applying edit: ", err)
+	}
+
+	// Overlapping tables are rejected, and leave the version alone.
+	err = m.Apply(ctx, &Edit{
+		Added: []*TableInfo{
+			{Number: m.NewFileNumber(), Level: 1, SmallestKey: []byte("e"),
+				LargestKey: []byte("n")},
+		},
+	})
+	if err != Err_OverlappingTables {
+		t.Error("Expected overlapping tables to be rejected, got ", err)
+	}
+	err = m.Apply(ctx, &Edit{Removed: []uint64{a}})
+	if err != Err_UnknownTable {
+		t.Error("Expected unknown table to be rejected, got ", err)
+	}
+	m.Close(ctx)
+
+	m, err = Open(ctx, storage, Options{NumLevels: 3})
+	if err != nil {
+		t.Fatal("Error recovering manifest: ", err)
+	}
+	defer m.Close(ctx)
+
+	v = m.Current()
+	defer v.Unref(ctx)
+
+	if len(v.Level(0)) != 0 || len(v.Level(1)) != 2 ||
+		v.Level(1)[0].Number != c || v.Level(1)[1].Number != b {
+		t.Error("Unexpected tables after recovery: ", tableNumbers(v))
+	}
+	if m.LogNumber() != 7 {
+		t.Error("Expected log number 7, got ", m.LogNumber())
+	}
+	if m.NewFileNumber() <= c {
+		t.Error("File numbers reused after recovery")
+	}
+	if len(v.TablesForKey("n")) != 1 || v.TablesForKey("n")[0].Number != b {
+		t.Error("Unexpected tables for key n")
+	}
+	if names, _ = storage.List(ctx); len(names) != 1 {
+		t.Error("Expected a single manifest file, got ", len(names))
+	}
+}
+
+// An edit written incompletely before a crash is ignored.
+func TestRecoverTornEdit(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var name string
+	var m *Manifest
+	var v *Version
+	var names []string
+	var err error
+
+	m, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error creating manifest: ", err)
+	}
+	m.Apply(ctx, &Edit{Added: []*TableInfo{
+		{Number: m.NewFileNumber(), SmallestKey: []byte("a"),
+			LargestKey: []byte("b")}}})
+	m.Apply(ctx, &Edit{Added: []*TableInfo{
+		{Number: m.NewFileNumber(), SmallestKey: []byte("c"),
+			LargestKey: []byte("d")}}})
+	m.Close(ctx)
+
+	names, _ = storage.List(ctx)
+	for _, name = range names {
+		var data = storage.Contents(name)
+
+		storage.SetContents(name, data[:len(data)-3])
+	}
+
+	m, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error recovering manifest: ", err)
+	}
+	defer m.Close(ctx)
+
+	v = m.Current()
+	defer v.Unref(ctx)
+	if len(v.Level(0)) != 1 || string(v.Level(0)[0].SmallestKey) != "a" {
+		t.Error("Expected only the first table, got ", tableNumbers(v))
+	}
+}
+
+// Tables are only obsolete once no version references them any more, and
+// the manifest file is rewritten once it gets too large.
+func TestVersionsAndObsoleteTables(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var obsolete []uint64
+	var m *Manifest
+	var old, v *Version
+	var a, b uint64
+	var i int
+	var names []string
+	var err error
+
+	m, err = Open(ctx, storage, Options{
+		MaxFileSize: 200,
+		Obsolete: func(ctx context.Context, info *TableInfo) {
+			obsolete = append(obsolete, info.Number)
+		},
+	})
+	if err != nil {
+		t.Fatal("Error creating manifest: ", err)
+	}
+	defer m.Close(ctx)
+
+	a = m.NewFileNumber()
+	m.Apply(ctx, &Edit{Added: []*TableInfo{
+		{Number: a, Level: 1, SmallestKey: []byte("a"), LargestKey: []byte("b")}}})
+
+	old = m.Current()
+
+	b = m.NewFileNumber()
+	err = m.Apply(ctx, &Edit{
+		Added: []*TableInfo{
+			{Number: b, Level: 2, SmallestKey: []byte("a"), LargestKey: []byte("b")}},
+		Removed: []uint64{a},
+	})
+	if err != nil {
+		t.Fatal("Error applying edit: ", err)
+	}
+
+	if len(obsolete) != 0 {
+		t.Error("Table reported obsolete while still referenced: ", obsolete)
+	}
+	if len(old.Level(1)) != 1 || old.Level(1)[0].Number != a {
+		t.Error("Old version changed: ", tableNumbers(old))
+	}
+
+	old.Unref(ctx)
+	if len(obsolete) != 1 || obsolete[0] != a {
+		t.Error("Expected table ", a, " to be obsolete, got ", obsolete)
+	}
+
+	for i = 0; i < 20; i++ {
+		var number = m.NewFileNumber()
+
+		m.Apply(ctx, &Edit{Added: []*TableInfo{
+			{Number: number, SmallestKey: []byte("x"), LargestKey: []byte("y")}}})
+	}
+	if names, _ = storage.List(ctx); len(names) != 1 {
+		t.Error("Expected a single manifest file, got ", len(names))
+	}
+	if m.file_size > 200+100 {
+		t.Error("Expected manifest to be rewritten, size is ", m.file_size)
+	}
+
+	v = m.Current()
+	defer v.Unref(ctx)
+	if len(v.Level(0)) != 20 || !sort.SliceIsSorted(v.Level(0),
+		func(i, j int) bool {
+			return v.Level(0)[i].Number < v.Level(0)[j].Number
+		}) {
+		t.Error("Unexpected tables in level 0: ", tableNumbers(v))
+	}
+}
@@ -0,0 +1,219 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+)
+
+/*
+Overlaps determines whether the key range of the table overlaps with the
+range from smallest to largest, inclusive.
+*/
+func (t *TableInfo) Overlaps(smallest, largest string) bool {
+	return string(t.SmallestKey) <= largest && string(t.LargestKey) >= smallest
+}
+
+/*
+Contains determines whether the key is within the key range of the table.
+*/
+func (t *TableInfo) Contains(key string) bool {
+	return t.Overlaps(key, key)
+}
+
+/*
+Version is an immutable set of tables, organized in levels. Level 0 may hold
+tables with overlapping key ranges and is sorted from oldest to newest table;
+all other levels hold non-overlapping tables sorted by key.
+
+Versions are reference counted. A version stays valid for as long as somebody
+holds a reference to it, even after newer versions have been installed, and
+tables are only reported as obsolete once no version referencing them is left.
+*/
+type Version struct {
+	m      *Manifest
+	levels [][]*TableInfo
+	// Protected by the manifest mutex.
+	refs int
+}
+
+/*
+newVersion creates an empty version with the specified number of levels.
+*/
+func newVersion(m *Manifest, num_levels int) *Version {
+	return &Version{m: m, levels: make([][]*TableInfo, num_levels)}
+}
+
+/*
+apply creates a new version from this one with the edit applied.
+*/
+func (v *Version) apply(edit *Edit) (*Version, error) {
+	var removed = make(map[uint64]bool)
+	var nv = newVersion(v.m, len(v.levels))
+	var info *TableInfo
+	var number uint64
+	var found int
+	var i int
+
+	for _, number = range edit.Removed {
+		removed[number] = true
+	}
+
+	for i = range v.levels {
+		for _, info = range v.levels[i] {
+			if removed[info.Number] {
+				found++
+				continue
+			}
+			nv.levels[i] = append(nv.levels[i], info)
+		}
+	}
+	if found != len(removed) {
+		return nil, Err_UnknownTable
+	}
+
+	for _, info = range edit.Added {
+		if info.Level < 0 || int(info.Level) >= len(nv.levels) {
+			return nil, Err_LevelOutOfRange
+		}
+		nv.levels[info.Level] = append(nv.levels[info.Level], info)
+	}
+
+	for i = range nv.levels {
+		var level = nv.levels[i]
+		var j int
+
+		if i == 0 {
+			sort.Slice(level, func(a, b int) bool {
+				return level[a].Number < level[b].Number
+			})
+			continue
+		}
+
+		sort.Slice(level, func(a, b int) bool {
+			return string(level[a].SmallestKey) < string(level[b].SmallestKey)
+		})
+		for j = 1; j < len(level); j++ {
+			if string(level[j].SmallestKey) <= string(level[j-1].LargestKey) {
+				return nil, Err_OverlappingTables
+			}
+		}
+	}
+
+	return nv, nil
+}
+
+/*
+NumLevels returns the number of levels of the version.
+*/
+func (v *Version) NumLevels() int {
+	return len(v.levels)
+}
+
+/*
+Level returns the tables in the specified level. The slice must not be
+modified.
+*/
+func (v *Version) Level(level int) []*TableInfo {
+	return v.levels[level]
+}
+
+/*
+Tables returns all tables of the version.
+*/
+func (v *Version) Tables() []*TableInfo {
+	var tables []*TableInfo
+	var level []*TableInfo
+
+	for _, level = range v.levels {
+		tables = append(tables, level...)
+	}
+
+	return tables
+}
+
+/*
+Overlapping determines the tables in the level overlapping with the key range
+from smallest to largest, inclusive.
+*/
+func (v *Version) Overlapping(
+	level int, smallest, largest string) []*TableInfo {
+	var tables []*TableInfo
+	var info *TableInfo
+
+	for _, info = range v.levels[level] {
+		if info.Overlaps(smallest, largest) {
+			tables = append(tables, info)
+		}
+	}
+
+	return tables
+}
+
+/*
+TablesForKey determines the tables which may contain the key, from newest to
+oldest.
+*/
+func (v *Version) TablesForKey(key string) []*TableInfo {
+	var tables []*TableInfo
+	var i int
+
+	// Tables in level 0 may overlap, so all of them need to be checked.
+	for i = len(v.levels[0]) - 1; i >= 0; i-- {
+		if v.levels[0][i].Contains(key) {
+			tables = append(tables, v.levels[0][i])
+		}
+	}
+
+	// In all other levels, at most a single table can contain the key.
+	for i = 1; i < len(v.levels); i++ {
+		var level = v.levels[i]
+		var pos int
+
+		pos = sort.Search(len(level), func(j int) bool {
+			return string(level[j].LargestKey) >= key
+		})
+		if pos < len(level) && level[pos].Contains(key) {
+			tables = append(tables, level[pos])
+		}
+	}
+
+	return tables
+}
+
+/*
+Ref takes another reference on the version.
+*/
+func (v *Version) Ref() {
+	v.m.mu.Lock()
+	defer v.m.mu.Unlock()
+	v.refs++
+}
+
+/*
+Unref releases a reference on the version. Once the last reference on a
+version which is no longer current has been released, all tables not part of
+any other version are passed to the Obsolete function of the manifest.
+*/
+func (v *Version) Unref(ctx context.Context) {
+	var obsolete []*TableInfo
+	var info *TableInfo
+
+	v.m.mu.Lock()
+	v.refs--
+	if v.refs == 0 {
+		for _, info = range v.Tables() {
+			v.m.table_refs[info.Number]--
+			if v.m.table_refs[info.Number] == 0 {
+				delete(v.m.table_refs, info.Number)
+				obsolete = append(obsolete, info)
+			}
+		}
+	}
+	v.m.mu.Unlock()
+
+	if v.m.opts.Obsolete != nil {
+		for _, info = range obsolete {
+			v.m.opts.Obsolete(ctx, info)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package sstable
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+)
+
+/*
+Parameters of the skiplist underlying the Memtable: the maximum number of
+levels, and the inverse of the probability of a node reaching the next level.
+*/
+const (
+	memtableMaxHeight = 12
+	memtableBranching = 4
+)
+
+/*
+memtableNodeOverhead approximates the memory used by a node of the skiplist
+besides its key, value and pointers.
+*/
+const memtableNodeOverhead = 48
+
+/*
+memtableNode is a single entry of the skiplist. Nodes are never removed from
+the list; deletions are recorded by marking the node as deleted.
+*/
+type memtableNode struct {
+	key     string
+	value   string
+	deleted bool
+	next    []*memtableNode
+}
+
+/*
+Memtable buffers records in memory, sorted by key, so they can be written to
+an sstable in one go. It is implemented as a skiplist. All methods are safe
+for concurrent use; iterators see writes made while iterating.
+*/
+type Memtable struct {
+	mu     sync.RWMutex
+	head   *memtableNode
+	height int
+	rnd    *rand.Rand
+	size   int64
+	count  int
+}
+
+/*
+NewMemtable creates a new, empty Memtable.
+*/
+func NewMemtable() *Memtable {
+	return &Memtable{
+		head:   &memtableNode{next: make([]*memtableNode, memtableMaxHeight)},
+		height: 1,
+		rnd:    rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+/*
+randomHeight picks the height of a new node. The write lock must be held.
+*/
+func (m *Memtable) randomHeight() int {
+	var height = 1
+
+	for height < memtableMaxHeight && m.rnd.Intn(memtableBranching) == 0 {
+		height++
+	}
+
+	return height
+}
+
+/*
+findGreaterOrEqual finds the first node with a key greater than or equal to
+the specified key. If prev is not nil, it is filled with the last node before
+that one on every level. A lock must be held.
+*/
+func (m *Memtable) findGreaterOrEqual(
+	key string, prev []*memtableNode) *memtableNode {
+	var n = m.head
+	var level = m.height - 1
+
+	for {
+		var next = n.next[level]
+
+		if next != nil && next.key < key {
+			n = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = n
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+/*
+set inserts or updates the node for the specified key.
+*/
+func (m *Memtable) set(key, value string, deleted bool) {
+	var prev [memtableMaxHeight]*memtableNode
+	var n *memtableNode
+	var height int
+	var i int
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n = m.findGreaterOrEqual(key, prev[:])
+	if n != nil && n.key == key {
+		if !n.deleted {
+			m.count--
+		}
+		if !deleted {
+			m.count++
+		}
+		m.size += int64(len(value) - len(n.value))
+		n.value = value
+		n.deleted = deleted
+		return
+	}
+
+	height = m.randomHeight()
+	for i = m.height; i < height; i++ {
+		prev[i] = m.head
+	}
+	if height > m.height {
+		m.height = height
+	}
+
+	n = &memtableNode{
+		key:     key,
+		value:   value,
+		deleted: deleted,
+		next:    make([]*memtableNode, height),
+	}
+	for i = 0; i < height; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+
+	if !deleted {
+		m.count++
+	}
+	m.size += int64(len(key)+len(value)+8*height) + memtableNodeOverhead
+}
+
+/*
+Put sets the value of the specified key, replacing any previous value.
+*/
+func (m *Memtable) Put(key, value string) {
+	m.set(key, value, false)
+}
+
+/*
+Delete removes the specified key. The memory used by the key is only released
+once the Memtable is discarded.
+*/
+func (m *Memtable) Delete(key string) {
+	m.set(key, "", true)
+}
+
+/*
+Get looks up the value of the specified key. The flag returned indicates
+whether the key was found.
+*/
+func (m *Memtable) Get(key string) (string, bool) {
+	var n *memtableNode
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n = m.findGreaterOrEqual(key, nil)
+	if n == nil || n.key != key || n.deleted {
+		return "", false
+	}
+	return n.value, true
+}
+
+/*
+Len returns the number of keys in the Memtable.
+*/
+func (m *Memtable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
+
+/*
+ApproximateSize estimates the memory used by the Memtable in bytes, including
+deleted keys.
+*/
+func (m *Memtable) ApproximateSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+/*
+MemtableIterator iterates over the keys of a Memtable in ascending order.
+*/
+type MemtableIterator struct {
+	m *Memtable
+	// The node the iterator is positioned at, or the node before the first
+	// one Next will move to.
+	prev  *memtableNode
+	key   string
+	value string
+}
+
+/*
+NewIterator creates an iterator over the Memtable, positioned before the
+first key.
+*/
+func (m *Memtable) NewIterator() *MemtableIterator {
+	return &MemtableIterator{m: m, prev: m.head}
+}
+
+/*
+Seek positions the iterator before the first key greater than or equal to the
+specified key, so that the following call to Next will move to it.
+*/
+func (it *MemtableIterator) Seek(key string) {
+	var prev [memtableMaxHeight]*memtableNode
+
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+
+	it.m.findGreaterOrEqual(key, prev[:])
+	it.prev = prev[0]
+}
+
+/*
+Next moves the iterator to the following key. False is returned once there
+are no more keys.
+*/
+func (it *MemtableIterator) Next() bool {
+	var n *memtableNode
+
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+
+	n = it.prev.next[0]
+	for n != nil && n.deleted {
+		n = n.next[0]
+	}
+	if n == nil {
+		return false
+	}
+
+	it.prev = n
+	it.key = n.key
+	it.value = n.value
+	return true
+}
+
+/*
+Key returns the key the iterator is positioned at.
+*/
+func (it *MemtableIterator) Key() string {
+	return it.key
+}
+
+/*
+Value returns the value of the key the iterator is positioned at.
+*/
+func (it *MemtableIterator) Value() string {
+	return it.value
+}
+
+/*
+FlushTo writes the contents of the Memtable to w in ascending key order, just
+like WriteStringMap would, but without having to sort anything. Indexes are
+created as configured for w. The writer is not closed.
+*/
+func (m *Memtable) FlushTo(ctx context.Context, w *Writer) error {
+	var it = m.NewIterator()
+	var err error
+
+	for it.Next() {
+		if err = w.WriteString(ctx, it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package sstable
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+Err_NoMergeOperator indicates that a merge record was read without a merge
+operator being set to combine its operands.
+*/
+var Err_NoMergeOperator = errors.New(
+	"Merge record without merge operator")
+
+/*
+Err_NoMergeOperands indicates that a merge record without any operands was to
+be written.
+*/
+var Err_NoMergeOperands = errors.New(
+	"Merge record without operands")
+
+/*
+Err_MergeAfterRecord indicates that a merge record was to be written after a
+record with the same key. The operands of a merge record can't be applied to
+a value in the same table.
+*/
+var Err_MergeAfterRecord = errors.New(
+	"Merge record following a record with the same key")
+
+/*
+MergeOperator combines merge operands into values. It allows for
+read-modify-write updates, such as appending to a list or incrementing a
+counter, to be recorded as operands without reading the current value first;
+the operands are only folded onto the value when it is read.
+
+Implementations must be deterministic, since the same operands may be merged
+more than once, and must be safe for concurrent use.
+*/
+type MergeOperator interface {
+	/*
+		FullMerge applies the operands, oldest first, to the existing value of
+		the key. has_existing is false if the key has no value, in which case
+		existing is empty. An error makes the read of the key fail.
+	*/
+	FullMerge(key, existing string, has_existing bool, operands []string) (
+		string, error)
+
+	/*
+		PartialMerge combines two consecutive operands, left being the older
+		one, into a single operand with the same effect. If that's not
+		possible without knowing the value they apply to, false is returned
+		and both operands are kept.
+	*/
+	PartialMerge(key, left, right string) (string, bool)
+}
+
+/*
+WriteMerge appends a merge record holding the specified operands, oldest
+first, to the sstable. The record takes the place of a value: when read, the
+operands are combined into the value of the key by the merge operator of the
+reader. All operands for a key need to be written as a single record, and it
+must not follow another record with the same key; Err_MergeAfterRecord is
+returned otherwise.
+
+Merge operands are never compressed.
+*/
+func (w *Writer) WriteMerge(
+	ctx context.Context, key string, operands ...string) error {
+	if len(operands) == 0 {
+		return Err_NoMergeOperands
+	}
+
+	return w.writeRecord(ctx, key, "", operands)
+}
+
+/*
+SetMergeOperator sets the merge operator used to combine the operands of merge
+records into values. Without one, reading a merge record fails with
+Err_NoMergeOperator.
+*/
+func (r *Reader) SetMergeOperator(op MergeOperator) {
+	r.merge_operator = op
+}
+
+/*
+ReadNextRecord reads the next record like ReadNextString, but returns the
+operands of merge records, oldest first, instead of combining them into a
+value. The value of a merge record is empty, and the operands of any other
+record are nil. This allows for merge records to be copied to other tables
+without a merge operator.
+*/
+func (r *Reader) ReadNextRecord(ctx context.Context) (
+	string, string, []string, error) {
+	var rdata KeyValue
+	var err error
+
+	if err = r.readRecord(ctx, &rdata); err != nil {
+		return "", "", nil, err
+	}
+
+	return string(rdata.Key), string(rdata.Value),
+		operandStrings(rdata.MergeOperands), nil
+}
+
+/*
+foldMergeOperands replaces the operands of a merge record with the value they
+amount to. Writers don't allow merge records to follow a record with the same
+key, so there is no value in the table for the operands to apply to.
+*/
+func (r *Reader) foldMergeOperands(rdata *KeyValue) error {
+	var value string
+	var err error
+
+	if r.merge_operator == nil {
+		return Err_NoMergeOperator
+	}
+
+	value, err = r.merge_operator.FullMerge(
+		string(rdata.Key), "", false, operandStrings(rdata.MergeOperands))
+	rdata.Value = []byte(value)
+	rdata.MergeOperands = nil
+	return err
+}
+
+/*
+operandBytes converts merge operands to the form they are stored in.
+*/
+func operandBytes(operands []string) [][]byte {
+	var stored = make([][]byte, len(operands))
+	var i int
+
+	for i = range operands {
+		stored[i] = []byte(operands[i])
+	}
+	return stored
+}
+
+/*
+operandStrings converts stored merge operands to the form merge operators
+take them in.
+*/
+func operandStrings(stored [][]byte) []string {
+	var operands []string
+	var i int
+
+	if stored == nil {
+		return nil
+	}
+	operands = make([]string, len(stored))
+	for i = range stored {
+		operands[i] = string(stored[i])
+	}
+	return operands
+}
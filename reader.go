@@ -1,14 +1,18 @@
 package sstable
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"errors"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/childoftheuniverse/filesystem"
 	"github.com/childoftheuniverse/recordio"
-	"github.com/golang/protobuf/proto"
-	"golang.org/x/net/context"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
 )
 
 /*
@@ -18,6 +22,14 @@ not support seeks.
 var Err_NotSeeker error = errors.New(
 	"Seeks not supported")
 
+/*
+Err_MissingKeyPrefix indicates that a record with a compressed key was read
+without the record holding the rest of its key being read before, e.g. after
+seeking to an offset which is not a restart point.
+*/
+var Err_MissingKeyPrefix error = errors.New(
+	"Compressed key without preceding full key")
+
 /*
 Reader implements various ways of reading data from an sstable file:
 indexed reads, or simple linear lookups.
@@ -30,13 +42,50 @@ type Reader struct {
 	orig_in_idx filesystem.ReadCloser
 	idx_offset  int64
 
-	cache_entry_index bool
-	entry_index_cache map[string]int64
+	// Last keys read from the data and index files, required for decoding
+	// compressed keys.
+	last_key     string
+	last_idx_key string
+
+	// Table header and the decoder and cipher for the records it describes.
+	// table_start is the offset of the table in the data file, data_start
+	// the offset of the first record following the header.
+	header         *TableHeader
+	header_checked bool
+	table_start    int64
+	data_start     int64
+	decoder        *zstd.Decoder
+	keys           KeyProvider
+	aead           cipher.AEAD
+	header_digest  []byte
+
+	// In-memory copy of the index, sorted by key.
+	cache_entry_index    bool
+	entry_index_keys     []string
+	entry_index_offsets  []int64
+	entry_index_records  []int64
+	entry_index_restarts [][]int64
+
+	// Top level of a two-level index, sorted by key.
+	top_index_keys    []string
+	top_index_offsets []int64
+
+	// Hash index for exact-key lookups, if any.
+	orig_in_hash filesystem.ReadCloser
+	hash_tables  []hashTable
+
+	// Operator applied to the operands of merge records.
+	merge_operator MergeOperator
+
+	// Error which stopped the last iteration.
+	iter_err error
 }
 
 /*
 NewReader creates a new, linear-lookup sstable reader around the specified
-ReadCloser.
+ReadCloser. The table is expected to start at the current position of in.
+The table header, if any, is read along with the first record read or the
+first seek.
 */
 func NewReader(in filesystem.ReadCloser) *Reader {
 	return &Reader{
@@ -45,20 +94,49 @@ func NewReader(in filesystem.ReadCloser) *Reader {
 	}
 }
 
+/*
+NewEncryptedReader creates a new, linear-lookup sstable reader around the
+specified ReadCloser, which can read tables encrypted with keys from the
+specified key provider. The table is expected to start at the current
+position of in.
+
+A working Reader is always going to be returned. The error will indicate only
+whether the table header could be loaded successfully.
+
+The context will only be used for reading the table header.
+*/
+func NewEncryptedReader(ctx context.Context, in filesystem.ReadCloser,
+	keys KeyProvider) (*Reader, error) {
+	var rd *Reader = NewReader(in)
+
+	rd.keys = keys
+	return rd, rd.readHeader(ctx)
+}
+
 /*
 NewReaderWithIdx creates a new, index-lookup sstable reader around the given
 ReadClosers for the data and index input streams. If requested using the
 create_cache flag, the index will be scanned entirely upon initialization and
-kept in memory in tree form in order to speed up future lookups.
+kept in memory in sorted form in order to speed up future lookups.
 
 A working Reader is always going to be returned. The error will indicate only
-whether the index could be loaded into memory successfully.
+whether the table header and the index could be loaded successfully.
 
-The context will only be used for reading the index.
+The context will only be used for reading the table header and the index.
 */
 func NewReaderWithIdx(
 	ctx context.Context, sst filesystem.ReadCloser, idx filesystem.ReadCloser,
 	create_cache bool) (*Reader, error) {
+	return NewEncryptedReaderWithIdx(ctx, sst, idx, create_cache, nil)
+}
+
+/*
+NewEncryptedReaderWithIdx is like NewReaderWithIdx, but can read tables
+encrypted with keys from the specified key provider.
+*/
+func NewEncryptedReaderWithIdx(
+	ctx context.Context, sst filesystem.ReadCloser, idx filesystem.ReadCloser,
+	create_cache bool, keys KeyProvider) (*Reader, error) {
 	var err error
 
 	var rd *Reader = &Reader{
@@ -67,7 +145,12 @@ func NewReaderWithIdx(
 		orig_in_idx:       idx,
 		in_idx:            recordio.NewRecordReader(idx),
 		cache_entry_index: create_cache,
-		entry_index_cache: make(map[string]int64),
+		keys:              keys,
+	}
+
+	// The header determines whether the index is encrypted.
+	if err = rd.readHeader(ctx); err != nil {
+		return rd, err
 	}
 
 	if create_cache {
@@ -77,6 +160,70 @@ func NewReaderWithIdx(
 	return rd, err
 }
 
+/*
+NewReaderWithPartitionedIdx creates a new sstable reader for tables written
+with a two-level index (see NewPartitionedIndexWriter). The top level index is
+read into memory entirely, while only a single partition of the index is read
+from idx for every lookup. idx must therefore support seeking.
+
+A working Reader is always going to be returned. The error will indicate only
+whether the table header and the top level index could be loaded successfully.
+
+The context will only be used for reading the table header and the top level
+index.
+*/
+func NewReaderWithPartitionedIdx(
+	ctx context.Context, sst filesystem.ReadCloser, idx filesystem.ReadCloser,
+	top_idx filesystem.ReadCloser) (*Reader, error) {
+	return NewEncryptedReaderWithPartitionedIdx(ctx, sst, idx, top_idx, nil)
+}
+
+/*
+NewEncryptedReaderWithPartitionedIdx is like NewReaderWithPartitionedIdx, but
+can read tables encrypted with keys from the specified key provider.
+*/
+func NewEncryptedReaderWithPartitionedIdx(
+	ctx context.Context, sst filesystem.ReadCloser, idx filesystem.ReadCloser,
+	top_idx filesystem.ReadCloser, keys KeyProvider) (*Reader, error) {
+	var in_top_idx = recordio.NewRecordReader(top_idx)
+	var err error
+
+	var rd *Reader = &Reader{
+		orig_in:           sst,
+		in:                recordio.NewRecordReader(sst),
+		orig_in_idx:       idx,
+		in_idx:            recordio.NewRecordReader(idx),
+		top_index_keys:    make([]string, 0),
+		top_index_offsets: make([]int64, 0),
+		keys:              keys,
+	}
+
+	// The header determines whether the index is encrypted.
+	if err = rd.readHeader(ctx); err != nil {
+		return rd, err
+	}
+
+	for {
+		var ir IndexRecord
+
+		if err = ctx.Err(); err != nil {
+			return rd, err
+		}
+
+		err = rd.readMessage(ctx, in_top_idx, &ir, aadTopIndex,
+			int64(len(rd.top_index_keys)))
+		if err == io.EOF {
+			return rd, nil
+		}
+		if err != nil {
+			return rd, err
+		}
+
+		rd.top_index_keys = append(rd.top_index_keys, string(ir.Key))
+		rd.top_index_offsets = append(rd.top_index_offsets, ir.Offset)
+	}
+}
+
 /*
 cacheEntryIndex is a helper which reads an sstable index file into memory for
 future lookups.
@@ -90,7 +237,10 @@ func (r *Reader) cacheEntryIndex(ctx context.Context) error {
 
 		sk, ok = r.orig_in_idx.(filesystem.Seeker)
 
-		r.entry_index_cache = make(map[string]int64)
+		r.entry_index_keys = make([]string, 0)
+		r.entry_index_offsets = make([]int64, 0)
+		r.entry_index_records = make([]int64, 0)
+		r.entry_index_restarts = make([][]int64, 0)
 
 		if r.idx_offset > 0 {
 			if !ok {
@@ -103,13 +253,14 @@ func (r *Reader) cacheEntryIndex(ctx context.Context) error {
 			}
 			r.idx_offset = 0
 		}
+		r.last_idx_key = ""
 
 		for {
 			if err = ctx.Err(); err != nil {
 				return err
 			}
 
-			err = r.in_idx.ReadMessage(ctx, &ir)
+			err = r.readIndexRecord(ctx, &ir)
 			if err != nil {
 				break
 			}
@@ -124,7 +275,11 @@ func (r *Reader) cacheEntryIndex(ctx context.Context) error {
 			} else {
 				r.idx_offset += int64(proto.Size(&ir))
 			}
-			r.entry_index_cache[ir.Key] = ir.Offset
+			r.entry_index_keys = append(r.entry_index_keys, string(ir.Key))
+			r.entry_index_offsets = append(r.entry_index_offsets, ir.Offset)
+			r.entry_index_records = append(r.entry_index_records, ir.Records)
+			r.entry_index_restarts = append(
+				r.entry_index_restarts, ir.Restarts)
 		}
 
 		if err != io.EOF {
@@ -135,6 +290,229 @@ func (r *Reader) cacheEntryIndex(ctx context.Context) error {
 	return nil
 }
 
+/*
+IndexEntry is a single entry of the index of a table: the offset in the data
+file of the record indexed under the key.
+*/
+type IndexEntry struct {
+	Key    string
+	Offset int64
+	// Number of records up to and including the indexed one, or 0 for tables
+	// written before the index recorded it.
+	Records int64
+	// Offsets of the restart points of the block starting at the indexed
+	// record, if keys are compressed.
+	Restarts []int64
+}
+
+/*
+ReadIndex returns all entries of the index, in the order they are stored. The
+in-memory copy of the index is used if there is one; otherwise, the index file
+is read from the start, which requires it to support seeking if it has been
+read from before. Tables without an index have no entries.
+*/
+func (r *Reader) ReadIndex(ctx context.Context) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	var err error
+
+	if r.cache_entry_index {
+		var i int
+
+		entries = make([]IndexEntry, len(r.entry_index_keys))
+		for i = range r.entry_index_keys {
+			entries[i] = IndexEntry{
+				Key:      r.entry_index_keys[i],
+				Offset:   r.entry_index_offsets[i],
+				Records:  r.entry_index_records[i],
+				Restarts: r.entry_index_restarts[i],
+			}
+		}
+		return entries, nil
+	}
+
+	if r.in_idx == nil {
+		return nil, nil
+	}
+
+	if r.idx_offset > 0 {
+		var sk filesystem.Seeker
+		var ok bool
+
+		sk, ok = r.orig_in_idx.(filesystem.Seeker)
+		if !ok {
+			return nil, Err_NotSeeker
+		}
+
+		// Go back to the beginning of the index.
+		if _, err = sk.Seek(ctx, 0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r.idx_offset = 0
+	}
+	r.last_idx_key = ""
+
+	for {
+		var ir IndexRecord
+
+		if err = ctx.Err(); err != nil {
+			return entries, err
+		}
+
+		err = r.readIndexRecord(ctx, &ir)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		r.idx_offset += int64(proto.Size(&ir))
+		entries = append(entries, IndexEntry{
+			Key:      string(ir.Key),
+			Offset:   ir.Offset,
+			Records:  ir.Records,
+			Restarts: ir.Restarts,
+		})
+	}
+}
+
+/*
+readKeyValue reads the next record from the data file, restoring its full key
+if the key has been compressed, decompressing its value if necessary and
+folding the operands of merge records.
+*/
+func (r *Reader) readKeyValue(ctx context.Context, rdata *KeyValue) error {
+	var err error
+
+	if err = r.readRecord(ctx, rdata); err != nil {
+		return err
+	}
+	if len(rdata.MergeOperands) > 0 {
+		return r.foldMergeOperands(rdata)
+	}
+
+	return nil
+}
+
+/*
+readRecord reads the next record from the data file like readKeyValue, but
+leaves the operands of merge records in place. Values split into chunks are
+joined back together.
+*/
+func (r *Reader) readRecord(ctx context.Context, rdata *KeyValue) error {
+	var err error
+
+	if err = r.readChunk(ctx, rdata); err != nil {
+		return err
+	}
+
+	for rdata.Continued {
+		var chunk KeyValue
+
+		if err = r.readChunk(ctx, &chunk); err == io.EOF {
+			return Err_IncompleteValue
+		} else if err != nil {
+			return err
+		}
+		if !bytes.Equal(chunk.Key, rdata.Key) {
+			return Err_IncompleteValue
+		}
+		rdata.Value = append(rdata.Value, chunk.Value...)
+		rdata.Continued = chunk.Continued
+	}
+
+	return nil
+}
+
+/*
+readChunk reads the next record from the data file as it is stored, i.e.
+possibly only a chunk of a value, restoring its full key and decompressing
+its value if necessary.
+*/
+func (r *Reader) readChunk(ctx context.Context, rdata *KeyValue) error {
+	var err error
+
+	if err = r.readHeader(ctx); err != nil {
+		return err
+	}
+
+	for {
+		var position int64
+
+		position, err = r.filePosition(ctx, r.orig_in, r.table_start)
+		if err != nil {
+			return err
+		}
+		err = r.readMessage(ctx, r.in, rdata, aadData, position)
+		if err != nil {
+			return err
+		}
+		if rdata.Header == nil {
+			break
+		}
+
+		// Not a data record, but the table header.
+		if err = r.applyHeader(ctx, rdata.Header); err != nil {
+			return err
+		}
+	}
+
+	if rdata.CompressedValue != nil {
+		var value []byte
+
+		if r.decoder == nil {
+			return Err_CompressionWithoutHeader
+		}
+		value, err = r.decoder.DecodeAll(rdata.CompressedValue, nil)
+		if err != nil {
+			return err
+		}
+		rdata.Value = value
+		rdata.CompressedValue = nil
+	}
+
+	if rdata.SharedPrefixLen > 0 {
+		if int(rdata.SharedPrefixLen) > len(r.last_key) {
+			return Err_MissingKeyPrefix
+		}
+		rdata.Key = append(
+			[]byte(r.last_key[:rdata.SharedPrefixLen]), rdata.Key...)
+		rdata.SharedPrefixLen = 0
+	}
+	r.last_key = string(rdata.Key)
+
+	return nil
+}
+
+/*
+readIndexRecord reads the next record from the index file, restoring its full
+key if the key has been compressed.
+*/
+func (r *Reader) readIndexRecord(ctx context.Context, ir *IndexRecord) error {
+	var position int64
+	var err error
+
+	if position, err = r.filePosition(ctx, r.orig_in_idx, 0); err != nil {
+		return err
+	}
+	err = r.readMessage(ctx, r.in_idx, ir, aadIndex, position)
+	if err != nil {
+		return err
+	}
+
+	if ir.SharedPrefixLen > 0 {
+		if int(ir.SharedPrefixLen) > len(r.last_idx_key) {
+			return Err_MissingKeyPrefix
+		}
+		ir.Key = append(
+			[]byte(r.last_idx_key[:ir.SharedPrefixLen]), ir.Key...)
+		ir.SharedPrefixLen = 0
+	}
+	r.last_idx_key = string(ir.Key)
+
+	return nil
+}
+
 /*
 Tell tries its best to determine the readers current position in the input
 stream.
@@ -149,7 +527,7 @@ func (r *Reader) Tell(ctx context.Context) int64 {
 		var err error
 		// Ask seeker for the current position.
 		offset, err = sk.Tell(ctx)
-		if err != nil {
+		if err == nil {
 			r.offset = offset
 		}
 	}
@@ -169,11 +547,23 @@ func (r *Reader) SeekTo(ctx context.Context, offset int64) error {
 	var sk filesystem.Seeker
 	var ok bool
 
+	// The table header needs to be known before reading from anywhere else,
+	// and precedes the data.
+	if err = r.readHeader(ctx); err != nil {
+		return err
+	}
+	if offset < r.data_start {
+		offset = r.data_start
+	}
+
+	// Compressed keys can only be decoded from the next restart point on.
+	r.last_key = ""
+
 	sk, ok = r.orig_in.(filesystem.Seeker)
 	if ok {
 		// Just tell the seeker to go to that position.
 		_, err = sk.Seek(ctx, offset, io.SeekStart)
-		if err != nil {
+		if err == nil {
 			r.offset = offset
 		}
 	} else {
@@ -211,7 +601,7 @@ func (r *Reader) ReadAllStrings(ctx context.Context, rv map[string]string) (
 	var rdata KeyValue
 
 	for {
-		err = r.in.ReadMessage(ctx, &rdata)
+		err = r.readKeyValue(ctx, &rdata)
 		if err == io.EOF {
 			return nil
 		}
@@ -219,7 +609,7 @@ func (r *Reader) ReadAllStrings(ctx context.Context, rv map[string]string) (
 			return
 		}
 
-		rv[rdata.Key] = rdata.Value
+		rv[string(rdata.Key)] = string(rdata.Value)
 	}
 }
 
@@ -227,6 +617,9 @@ func (r *Reader) ReadAllStrings(ctx context.Context, rv map[string]string) (
 ReadAllProto reads all records from the sstable into a map of keys to protocol
 buffers and return that. Please note that this may use up a lot of resources,
 since this will essentially read the entire file into memory.
+
+pb only determines the message type; a new message of that type is created
+for every record.
 */
 func (r *Reader) ReadAllProto(ctx context.Context, pb proto.Message,
 	rv map[string]proto.Message) (err error) {
@@ -235,7 +628,7 @@ func (r *Reader) ReadAllProto(ctx context.Context, pb proto.Message,
 	for {
 		var msg proto.Message
 
-		err = r.in.ReadMessage(ctx, &rdata)
+		err = r.readKeyValue(ctx, &rdata)
 		if err == io.EOF {
 			err = nil
 			return
@@ -244,10 +637,12 @@ func (r *Reader) ReadAllProto(ctx context.Context, pb proto.Message,
 			return
 		}
 
-		msg = proto.Clone(pb)
-		err = proto.Unmarshal([]byte(rdata.Value), msg)
+		msg = pb.ProtoReflect().New().Interface()
+		if err = proto.Unmarshal(rdata.Value, msg); err != nil {
+			return
+		}
 
-		rv[rdata.Key] = msg
+		rv[string(rdata.Key)] = msg
 	}
 }
 
@@ -257,28 +652,81 @@ key. The result is an offset which can be seeked to; it may however point to
 the next key which is greater than the requested one.
 */
 func (r *Reader) indexLookup(ctx context.Context, key string) (int64, error) {
+	var offset int64
+	var restarts []int64
+	var err error
+
+	if offset, restarts, err = r.indexBlock(ctx, key); err != nil {
+		return offset, err
+	}
+	return r.restartLookup(ctx, key, offset, restarts)
+}
+
+/*
+restartLookup narrows down the position of the specified key within the
+block starting at offset, by binary searching its restart points for the last
+one with a key less than the specified one. This requires the data file to
+support seeking; otherwise, offset is returned as it is.
+*/
+func (r *Reader) restartLookup(ctx context.Context, key string, offset int64,
+	restarts []int64) (int64, error) {
+	var i int
+	var err error
+	var ok bool
+
+	if _, ok = r.orig_in.(filesystem.Seeker); !ok || len(restarts) < 2 {
+		return offset, nil
+	}
+
+	// The first restart point is the start of the block itself, which is
+	// where to start if no other restart point qualifies.
+	i = sort.Search(len(restarts)-1, func(j int) bool {
+		var rdata KeyValue
+
+		if err != nil {
+			return true
+		}
+		if err = r.SeekTo(ctx, restarts[j+1]); err != nil {
+			return true
+		}
+		if err = r.readChunk(ctx, &rdata); err != nil {
+			return true
+		}
+		return string(rdata.Key) >= key
+	})
+	if err != nil {
+		return offset, err
+	}
+
+	return restarts[i], nil
+}
+
+/*
+indexBlock looks up the index record of the block of data records which can
+hold the specified key, and returns the offset of the block along with its
+restart points.
+*/
+func (r *Reader) indexBlock(ctx context.Context, key string) (
+	int64, []int64, error) {
 	if r.cache_entry_index {
-		var k, closest_k string
-		var v, closest_v int64
+		var i int
 
-		// Look up the key in the index.
-		for k, v = range r.entry_index_cache {
-			// Is the key we're looking for after the current key?
-			if strings.Compare(key, k) > 0 {
-				// Is it closer than the previous match?
-				if strings.Compare(k, closest_k) > 0 {
-					closest_k = k
-					closest_v = v
-				}
-			} else if strings.Compare(key, k) == 0 {
-				return v, nil
-			}
+		// Binary search for the key in the index.
+		i = sort.SearchStrings(r.entry_index_keys, key)
+		if i < len(r.entry_index_keys) && r.entry_index_keys[i] == key {
+			return r.entry_index_offsets[i], r.entry_index_restarts[i], nil
+		}
+		if i == 0 {
+			return 0, nil, nil
 		}
 
-		return closest_v, nil
+		return r.entry_index_offsets[i-1], r.entry_index_restarts[i-1], nil
+	} else if r.top_index_keys != nil {
+		return r.partitionedIndexLookup(ctx, key)
 	} else if r.in_idx != nil {
 		var closest_k string
 		var closest_v int64
+		var closest_restarts []int64
 
 		// Read the on-disk index instead and locate the key in it.
 		if r.idx_offset > 0 {
@@ -287,43 +735,105 @@ func (r *Reader) indexLookup(ctx context.Context, key string) (int64, error) {
 
 			sk, ok = r.orig_in_idx.(filesystem.Seeker)
 			if !ok {
-				return 0, Err_NotSeeker
+				return 0, nil, Err_NotSeeker
 			}
 
 			// Go back to the beginning of the index.
 			sk.Seek(ctx, 0, io.SeekStart)
 			r.idx_offset = 0
 		}
+		r.last_idx_key = ""
 
 		for {
 			var ir IndexRecord
+			var ir_key string
 			var err error
 
-			err = r.in_idx.ReadMessage(ctx, &ir)
+			err = r.readIndexRecord(ctx, &ir)
 			if err == io.EOF {
-				return closest_v, nil
+				return closest_v, closest_restarts, nil
 			}
 			if err != nil {
-				return closest_v, err
+				return closest_v, nil, err
 			}
 
 			r.idx_offset += int64(proto.Size(&ir))
+			ir_key = string(ir.Key)
 
 			// Is the key we're looking for after the current key?
-			if strings.Compare(key, ir.Key) > 0 {
+			if strings.Compare(key, ir_key) > 0 {
 				// Is it closer than the previous match?
-				if strings.Compare(ir.Key, closest_k) > 0 {
-					closest_k = ir.Key
+				if strings.Compare(ir_key, closest_k) > 0 {
+					closest_k = ir_key
 					closest_v = ir.Offset
+					closest_restarts = ir.Restarts
 				}
-			} else if strings.Compare(key, ir.Key) == 0 {
-				return ir.Offset, nil
+			} else if strings.Compare(key, ir_key) == 0 {
+				return ir.Offset, ir.Restarts, nil
 			}
 		}
-
-		return closest_v, nil
 	} else {
-		return r.idx_offset, nil
+		return r.idx_offset, nil, nil
+	}
+}
+
+/*
+partitionedIndexLookup is the equivalent of indexBlock for two-level indices.
+The top level index is used to determine the index partition which can contain
+the key, and only that partition is then read from the index file.
+*/
+func (r *Reader) partitionedIndexLookup(ctx context.Context, key string) (
+	int64, []int64, error) {
+	var sk filesystem.Seeker
+	var closest_v int64
+	var closest_restarts []int64
+	var i int
+	var err error
+	var ok bool
+
+	if len(r.top_index_keys) == 0 {
+		return 0, nil, nil
+	}
+
+	sk, ok = r.orig_in_idx.(filesystem.Seeker)
+	if !ok {
+		return 0, nil, Err_NotSeeker
+	}
+
+	// Find the last partition starting before the key we're looking for.
+	i = sort.SearchStrings(r.top_index_keys, key) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	if _, err = sk.Seek(ctx, r.top_index_offsets[i], io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	r.idx_offset = r.top_index_offsets[i]
+	r.last_idx_key = ""
+
+	for {
+		var ir IndexRecord
+
+		err = r.readIndexRecord(ctx, &ir)
+		if err == io.EOF {
+			return closest_v, closest_restarts, nil
+		}
+		if err != nil {
+			return closest_v, nil, err
+		}
+
+		r.idx_offset += int64(proto.Size(&ir))
+
+		if strings.Compare(key, string(ir.Key)) > 0 {
+			closest_v = ir.Offset
+			closest_restarts = ir.Restarts
+		} else if strings.Compare(key, string(ir.Key)) == 0 {
+			return ir.Offset, ir.Restarts, nil
+		} else {
+			// The index is sorted, so no closer match can follow.
+			return closest_v, closest_restarts, nil
+		}
 	}
 }
 
@@ -335,12 +845,12 @@ func (r *Reader) ReadNextString(ctx context.Context) (string, string, error) {
 	var rdata KeyValue
 	var err error
 
-	err = r.in.ReadMessage(ctx, &rdata)
+	err = r.readKeyValue(ctx, &rdata)
 	if err != nil {
 		return "", "", err
 	}
 
-	return rdata.Key, rdata.Value, nil
+	return string(rdata.Key), string(rdata.Value), nil
 }
 
 /*
@@ -360,7 +870,7 @@ func (r *Reader) ReadNextProto(ctx context.Context, pb proto.Message) (
 		return "", err
 	}
 
-	pb.Reset()
+	proto.Reset(pb)
 
 	// Fill the result into the specified protocol buffer.
 	err = proto.Unmarshal([]byte(val), pb)
@@ -395,7 +905,7 @@ func (r *Reader) ReadSubsequentString(ctx context.Context, key string) (
 	for {
 		var cv int
 
-		err = r.in.ReadMessage(ctx, &rdata)
+		err = r.readKeyValue(ctx, &rdata)
 		if err == io.EOF {
 			// End of file; record not found.
 			return "", "", nil
@@ -404,9 +914,9 @@ func (r *Reader) ReadSubsequentString(ctx context.Context, key string) (
 			return "", "", err
 		}
 
-		cv = strings.Compare(rdata.Key, key)
+		cv = strings.Compare(string(rdata.Key), key)
 		if cv == 0 || cv > 0 {
-			return rdata.Key, rdata.Value, nil
+			return string(rdata.Key), string(rdata.Value), nil
 		}
 	}
 }
@@ -427,7 +937,7 @@ func (r *Reader) ReadSubsequentProto(
 		return "", err
 	}
 
-	pb.Reset()
+	proto.Reset(pb)
 
 	// Fill the result into the specified protocol buffer.
 	err = proto.Unmarshal([]byte(val), pb)
@@ -436,46 +946,65 @@ func (r *Reader) ReadSubsequentProto(
 
 /*
 ReadString looks up and reads the record specified by the given key. It then
-returns the result as a string.
+returns the result as a string. If a hash index has been set, it is used to
+locate the record directly.
 */
 func (r *Reader) ReadString(ctx context.Context, key string) (string, error) {
+	var value string
+	var err error
+
+	value, _, err = r.lookup(ctx, key)
+	return value, err
+}
+
+/*
+lookup reads the value of the record with the given key, also reporting
+whether there is such a record at all.
+*/
+func (r *Reader) lookup(ctx context.Context, key string) (
+	string, bool, error) {
 	var rdata KeyValue
 	var offset int64
 	var err error
 
+	if r.hash_tables != nil {
+		// A single probe of the hash index is sufficient here.
+		return r.hashLookup(ctx, key)
+	}
+
 	// Determine the latest index record which suggests that searching
 	// from it might be useful.
 	offset, err = r.indexLookup(ctx, key)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	// Now go to that point.
 	err = r.SeekTo(ctx, offset)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	for {
 		var cv int
 
-		err = r.in.ReadMessage(ctx, &rdata)
+		err = r.readKeyValue(ctx, &rdata)
 		if err == io.EOF {
 			// End of file; record not found.
-			return "", nil
+			return "", false, nil
 		}
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
 
-		cv = strings.Compare(rdata.Key, key)
+		cv = strings.Compare(string(rdata.Key), key)
 		if cv == 0 {
-			return rdata.Value, nil
+			return string(rdata.Value), true, nil
 		}
 
 		if cv > 0 {
 			// We're well past the record now and it wasn't found.
-			return "", nil
+			return "", false, nil
 		}
 	}
 }
@@ -494,7 +1023,7 @@ func (r *Reader) ReadProto(
 		return err
 	}
 
-	pb.Reset()
+	proto.Reset(pb)
 
 	// Fill the result into the specified protocol buffer.
 	err = proto.Unmarshal([]byte(val), pb)
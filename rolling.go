@@ -0,0 +1,167 @@
+package sstable
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+RollingWriter writes records to a sequence of tables, starting a new table
+whenever the current one has reached a size or record limit. Records with the
+same key are never split across tables, so every key can be found in exactly
+one table, and the key ranges of the tables don't overlap.
+
+Like Writer, RollingWriter is not safe for concurrent use, and keys need to
+be written in ascending order.
+*/
+type RollingWriter struct {
+	create      ShardWriterFunc
+	max_size    int64
+	max_records int64
+
+	writer   *Writer
+	tables   []Shard
+	last_key string
+}
+
+/*
+NewRollingWriter creates a writer starting a new table once the current one
+holds max_size bytes or max_records records, whichever comes first; a limit
+of 0 disables it. The tables are created using create, numbered from 0, when
+the first record is written to them.
+*/
+func NewRollingWriter(
+	create ShardWriterFunc, max_size, max_records int64) *RollingWriter {
+	return &RollingWriter{
+		create:      create,
+		max_size:    max_size,
+		max_records: max_records,
+	}
+}
+
+/*
+WriteString appends a record to the current table, starting a new table
+first if the current one is full and the key differs from the last one.
+*/
+func (w *RollingWriter) WriteString(
+	ctx context.Context, key, value string) error {
+	return w.writeRecord(ctx, key, value, nil)
+}
+
+/*
+WriteProto encodes the specified protocol buffer and appends it as the value
+of a record, like WriteString.
+*/
+func (w *RollingWriter) WriteProto(
+	ctx context.Context, key string, value proto.Message) error {
+	var pbdata []byte
+	var err error
+
+	pbdata, err = proto.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteString(ctx, key, string(pbdata))
+}
+
+/*
+WriteMerge appends a merge record holding the specified operands, like
+Writer.WriteMerge.
+*/
+func (w *RollingWriter) WriteMerge(
+	ctx context.Context, key string, operands ...string) error {
+	if len(operands) == 0 {
+		return Err_NoMergeOperands
+	}
+
+	return w.writeRecord(ctx, key, "", operands)
+}
+
+/*
+writeRecord appends a record to the current table, rolling over to a new
+table if required.
+*/
+func (w *RollingWriter) writeRecord(
+	ctx context.Context, key, value string, operands []string) error {
+	var table *Shard
+	var err error
+
+	if len(w.tables) > 0 && key < w.last_key {
+		return Err_KeyOrderViolation
+	}
+
+	if w.writer != nil && key != w.last_key && w.full() {
+		if err = w.finishTable(ctx); err != nil {
+			return err
+		}
+	}
+	if w.writer == nil {
+		if w.writer, err = w.create(ctx, len(w.tables)); err != nil {
+			return err
+		}
+		w.tables = append(w.tables, Shard{FirstKey: key})
+	}
+
+	if err = w.writer.writeRecord(ctx, key, value, operands); err != nil {
+		return err
+	}
+
+	table = &w.tables[len(w.tables)-1]
+	table.LastKey = key
+	table.Records++
+	w.last_key = key
+	return nil
+}
+
+/*
+full determines whether the current table has reached one of the limits.
+Records held back for training the compression dictionary count towards the
+size with their uncompressed size, since they haven't been written yet.
+*/
+func (w *RollingWriter) full() bool {
+	var table = &w.tables[len(w.tables)-1]
+
+	if w.max_records > 0 && table.Records >= w.max_records {
+		return true
+	}
+	return w.max_size > 0 &&
+		w.writer.index_offset+w.writer.sample_size >= w.max_size
+}
+
+/*
+finishTable closes the writer of the current table.
+*/
+func (w *RollingWriter) finishTable(ctx context.Context) error {
+	var writer = w.writer
+	var err error
+
+	w.writer = nil
+	err = writer.Close(ctx)
+	w.tables[len(w.tables)-1].Size = writer.index_offset
+	return err
+}
+
+/*
+Tables returns descriptions of all tables written to so far, in order. The
+last one may still be written to.
+*/
+func (w *RollingWriter) Tables() []Shard {
+	return w.tables
+}
+
+/*
+Close finishes writing the current table, and returns descriptions of all
+tables written, in order. If no records have been written, no tables are
+created at all.
+*/
+func (w *RollingWriter) Close(ctx context.Context) ([]Shard, error) {
+	var err error
+
+	if w.writer != nil {
+		err = w.finishTable(ctx)
+	}
+
+	return w.tables, err
+}
@@ -0,0 +1,207 @@
+package sstable
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+/*
+quantileSamples is the number of keys sampled per quantile when quantiles
+have to be determined from the data rather than the index.
+*/
+const quantileSamples = 100
+
+/*
+SampleKeys returns up to n representative keys of the table, in ascending
+order. The keys are taken from evenly spaced index entries; note that index
+keys may only be prefixes of record keys for tables indexed by prefix.
+
+For tables without an index, a uniform random sample of the record keys is
+taken instead, which requires reading the entire table from its beginning.
+The sample is the same every time for the same table.
+*/
+func (r *Reader) SampleKeys(ctx context.Context, n int) ([]string, error) {
+	var entries []IndexEntry
+	var keys []string
+	var i int
+	var err error
+
+	if n < 1 {
+		return nil, nil
+	}
+	if entries, err = r.sortedIndex(ctx); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return r.sampleRecordKeys(ctx, n)
+	}
+
+	for i = 0; i < n && i < len(entries); i++ {
+		if len(entries) <= n {
+			keys = appendDistinct(keys, entries[i].Key)
+		} else {
+			keys = appendDistinct(keys, entries[i*len(entries)/n].Key)
+		}
+	}
+
+	return keys, nil
+}
+
+/*
+Quantiles returns up to k-1 keys splitting the table into k ranges holding
+roughly the same number of records, in ascending order; range i holds the
+keys from the (i-1)-th key up to, but not including, the i-th one, so the
+keys can be used directly with SplitAtKeys. Fewer keys are returned if the
+table is too small.
+
+The keys are derived from the record counts in the index, or from the
+spacing of the index entries if the index doesn't hold record counts. The
+number of records following the last indexed one is estimated from the size
+of the data file like ApproximateRecordCount does, unless the data file doesn't
+support seeking, in which case these records aren't accounted for. For
+tables without an index, they are derived from a random sample of the record
+keys, like SampleKeys.
+*/
+func (r *Reader) Quantiles(ctx context.Context, k int) ([]string, error) {
+	var entries []IndexEntry
+	var keys []string
+	var i int
+	var err error
+
+	if k < 1 {
+		return nil, Err_InvalidShardCount
+	}
+	if entries, err = r.sortedIndex(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		var sample []string
+
+		sample, err = r.sampleRecordKeys(ctx, k*quantileSamples)
+		if err != nil {
+			return nil, err
+		}
+		for i = 1; i < k && len(sample) > 0; i++ {
+			var key = sample[i*len(sample)/k]
+
+			if key > sample[0] {
+				keys = appendDistinct(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	if entries[len(entries)-1].Records > 0 {
+		// Pick the entries at which each k-th of the records starts. Parts
+		// starting after the last indexed record are split at it, since
+		// there are no keys known any closer.
+		var total = entries[len(entries)-1].Records
+		var layout *tableLayout
+
+		layout, err = r.readLayout(ctx)
+		if err == nil {
+			total = layout.records
+		} else if err != Err_NotSeeker {
+			return nil, err
+		}
+
+		for i = 1; i < k; i++ {
+			var target = int64(i) * total / int64(k)
+			var pos = sort.Search(len(entries), func(j int) bool {
+				return entries[j].Records-1 >= target
+			})
+
+			if pos == len(entries) {
+				pos--
+			}
+			if entries[pos].Records > 1 {
+				keys = appendDistinct(keys, entries[pos].Key)
+			}
+		}
+		return keys, nil
+	}
+
+	// Nothing sorts before the first entry, so it can't be used.
+	for i = 1; i < k; i++ {
+		var key = entries[i*len(entries)/k].Key
+
+		if key > entries[0].Key {
+			keys = appendDistinct(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+/*
+sortedIndex returns all index entries, sorted by key.
+*/
+func (r *Reader) sortedIndex(ctx context.Context) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	var err error
+
+	if entries, err = r.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+/*
+sampleRecordKeys reads all records of the table, keeping a uniform random
+sample of up to n of their keys using reservoir sampling. The keys are
+returned in ascending order, without duplicates.
+*/
+func (r *Reader) sampleRecordKeys(ctx context.Context, n int) (
+	[]string, error) {
+	var rnd = rand.New(rand.NewSource(1))
+	var sample, keys []string
+	var seen, pos int64
+	var key string
+	var err error
+
+	if err = r.SeekTo(ctx, 0); err != nil {
+		return nil, err
+	}
+
+	for {
+		var rdata KeyValue
+
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err = r.readRecord(ctx, &rdata); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		seen++
+		if len(sample) < n {
+			sample = append(sample, string(rdata.Key))
+		} else if pos = rnd.Int63n(seen); pos < int64(n) {
+			sample[pos] = string(rdata.Key)
+		}
+	}
+
+	sort.Strings(sample)
+	for _, key = range sample {
+		keys = appendDistinct(keys, key)
+	}
+	return keys, nil
+}
+
+/*
+appendDistinct appends key to the sorted keys unless it's the last one
+already.
+*/
+func appendDistinct(keys []string, key string) []string {
+	if len(keys) > 0 && keys[len(keys)-1] == key {
+		return keys
+	}
+	return append(keys, key)
+}
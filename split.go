@@ -0,0 +1,209 @@
+package sstable
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+/*
+Err_UnsortedSplitKeys indicates that the keys to split a table at were not in
+strictly ascending order.
+*/
+var Err_UnsortedSplitKeys = errors.New(
+	"Split keys not in ascending order")
+
+/*
+Err_InvalidShardCount indicates that a table was to be split into less than
+one shard.
+*/
+var Err_InvalidShardCount = errors.New(
+	"Number of shards must be positive")
+
+/*
+ShardWriterFunc creates the writer for the shard with the specified number,
+counting from 0. Shards are created in order, and the writer of a shard is
+closed before the next one is created.
+*/
+type ShardWriterFunc func(ctx context.Context, shard int) (*Writer, error)
+
+/*
+Shard describes one of the tables written by a split.
+*/
+type Shard struct {
+	// First and last key of the shard; both are empty if it has no records.
+	FirstKey string
+	LastKey  string
+	Records  int64
+	// Size of the data file in bytes, as far as the writer could tell.
+	Size int64
+}
+
+/*
+SplitAtKeys copies the records of the table into len(keys)+1 shards: shard i
+holds the records with keys from keys[i-1] up to, but not including, keys[i].
+keys must be in strictly ascending order. Shards without any records are
+still created.
+
+Records are copied as they are, including merge records, so no merge
+operator is required. Reading starts at the beginning of the table, which
+requires the input to support seeking if it has been read from before.
+*/
+func (r *Reader) SplitAtKeys(ctx context.Context, keys []string,
+	create ShardWriterFunc) ([]Shard, error) {
+	var i int
+
+	for i = 1; i < len(keys); i++ {
+		if keys[i] <= keys[i-1] {
+			return nil, Err_UnsortedSplitKeys
+		}
+	}
+
+	return r.split(ctx, create, len(keys)+1,
+		func(shard int, records int64, key string, offset int64) bool {
+			return shard < len(keys) && key >= keys[shard]
+		})
+}
+
+/*
+SplitBySize copies the records of the table into up to k shards of roughly
+equal size, size being the size of the table in bytes. A new shard is started
+at the first record after each k-th of the table, unless that record has the
+same key as the one before, so records with the same key always end up in the
+same shard. Fewer than k shards are created if the table has too few
+records.
+*/
+func (r *Reader) SplitBySize(ctx context.Context, k int, size int64,
+	create ShardWriterFunc) ([]Shard, error) {
+	if k < 1 {
+		return nil, Err_InvalidShardCount
+	}
+
+	return r.split(ctx, create, 1,
+		func(shard int, records int64, key string, offset int64) bool {
+			return records > 0 && shard+1 < k &&
+				offset >= int64(shard+1)*size/int64(k)
+		})
+}
+
+/*
+SplitAtIndexQuantiles copies the records of the table into up to k shards
+holding roughly the same number of records, using the keys returned by
+Quantiles as split keys. Shards are split as by SplitAtKeys. Fewer than k
+shards are created if the table is too small.
+*/
+func (r *Reader) SplitAtIndexQuantiles(ctx context.Context, k int,
+	create ShardWriterFunc) ([]Shard, error) {
+	var keys []string
+	var err error
+
+	if keys, err = r.Quantiles(ctx, k); err != nil {
+		return nil, err
+	}
+
+	return r.SplitAtKeys(ctx, keys, create)
+}
+
+/*
+split copies all records of the table into shards, starting a new shard
+whenever next returns true for the number and record count of the shard
+currently written to and the key and offset of the next record. At least
+min_shards shards are created.
+*/
+func (r *Reader) split(ctx context.Context, create ShardWriterFunc,
+	min_shards int,
+	next func(shard int, records int64, key string, offset int64) bool) (
+	[]Shard, error) {
+	var shards []Shard
+	var writer *Writer
+	var err error
+
+	// finishShard closes the writer of the current shard, if any.
+	var finishShard = func() error {
+		var w = writer
+		var err error
+
+		writer = nil
+		if w == nil {
+			return nil
+		}
+		err = w.Close(ctx)
+		shards[len(shards)-1].Size = w.index_offset
+		return err
+	}
+
+	// startShard finishes the current shard and starts the next one.
+	var startShard = func() error {
+		var err error
+
+		if err = finishShard(); err != nil {
+			return err
+		}
+		if writer, err = create(ctx, len(shards)); err != nil {
+			return err
+		}
+		shards = append(shards, Shard{})
+		return nil
+	}
+
+	if err = r.SeekTo(ctx, 0); err != nil {
+		return nil, err
+	}
+	if err = startShard(); err != nil {
+		return nil, err
+	}
+
+	for {
+		var rdata KeyValue
+		var offset = r.Tell(ctx)
+		var shard *Shard
+		var key string
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if err = r.readRecord(ctx, &rdata); err != nil {
+			break
+		}
+		key = string(rdata.Key)
+
+		shard = &shards[len(shards)-1]
+		for (shard.Records == 0 || key != shard.LastKey) &&
+			next(len(shards)-1, shard.Records, key, offset) {
+			if err = startShard(); err != nil {
+				break
+			}
+			shard = &shards[len(shards)-1]
+		}
+		if err != nil {
+			break
+		}
+
+		err = writer.writeRecord(
+			ctx, key, string(rdata.Value),
+			operandStrings(rdata.MergeOperands))
+		if err != nil {
+			break
+		}
+		if shard.Records == 0 {
+			shard.FirstKey = key
+		}
+		shard.LastKey = key
+		shard.Records++
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+	for err == nil && len(shards) < min_shards {
+		err = startShard()
+	}
+	if err == nil {
+		err = finishShard()
+	} else if writer != nil {
+		// Don't leave the file of the failed shard open.
+		writer.Close(ctx)
+	}
+
+	return shards, err
+}
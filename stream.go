@@ -0,0 +1,203 @@
+package sstable
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+/*
+Err_IncompleteValue indicates that a value which has been split into chunks
+ended before its last chunk.
+*/
+var Err_IncompleteValue = errors.New(
+	"Value ends before its last chunk")
+
+/*
+Err_KeyNotFound indicates that the record to be streamed doesn't exist.
+*/
+var Err_KeyNotFound = errors.New(
+	"Key not found")
+
+/*
+defaultChunkSize is the size of the chunks values are split into by
+WriteStream if no chunk size has been set.
+*/
+const defaultChunkSize = 1 << 20
+
+/*
+SetChunkSize makes the writer split values longer than chunk_size bytes into
+a series of records holding chunk_size bytes each. Readers join the chunks
+back together, or stream them using ReadStream without keeping the entire
+value in memory. Each chunk is compressed and encrypted on its own.
+
+Tables holding split values can't be read correctly by versions of this
+package which don't know about chunks.
+*/
+func (w *Writer) SetChunkSize(chunk_size int) {
+	if chunk_size < 0 {
+		chunk_size = 0
+	}
+	w.chunk_size = chunk_size
+}
+
+/*
+WriteStream appends a record with the specified key and the value read from
+value up to EOF to the sstable, like WriteString. The value is split into
+chunks of the size set using SetChunkSize, or 1 MiB if none has been set, and
+only one chunk is held in memory at a time.
+
+While samples for training a compression dictionary are collected, the value
+is read into memory entirely like any other sample.
+*/
+func (w *Writer) WriteStream(
+	ctx context.Context, key string, value io.Reader) error {
+	var chunk_size = w.chunk_size
+	var chunk, next []byte
+	var continuation bool
+	var n, m int
+	var err, write_err error
+
+	if strings.Compare(w.last_key, key) > 0 {
+		return Err_KeyOrderViolation
+	}
+
+	if w.sample_records > 0 {
+		var data []byte
+
+		if data, err = io.ReadAll(value); err != nil {
+			return err
+		}
+		return w.addCompressionSample(ctx, key, string(data), nil)
+	}
+
+	if chunk_size == 0 {
+		chunk_size = defaultChunkSize
+	}
+	chunk = make([]byte, chunk_size)
+	next = make([]byte, chunk_size)
+
+	n, err = io.ReadFull(value, chunk)
+	for err == nil {
+		// The chunk has been filled up; only write it once it's known whether
+		// anything follows.
+		m, err = io.ReadFull(value, next)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		write_err = w.writeChunk(
+			ctx, key, string(chunk[:n]), nil, continuation, true)
+		if write_err != nil {
+			return write_err
+		}
+		chunk, next, n = next, chunk, m
+		continuation = true
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	return w.writeChunk(ctx, key, string(chunk[:n]), nil, continuation, false)
+}
+
+/*
+ReadStream looks up the record with the specified key and returns a reader
+for its value, or Err_KeyNotFound if there is no such record. Values split
+into chunks by the writer are read one chunk at a time as the returned reader
+is read from; other values, including those of merge records, are read
+entirely upfront.
+
+The index, if any, is used to find the record, but the hash index isn't. The
+returned reader reads from r, so r must not be used for anything else until
+the value has been read completely.
+*/
+func (r *Reader) ReadStream(ctx context.Context, key string) (
+	io.Reader, error) {
+	var rdata KeyValue
+	var offset int64
+	var err error
+
+	if offset, err = r.indexLookup(ctx, key); err != nil {
+		return nil, err
+	}
+	if err = r.SeekTo(ctx, offset); err != nil {
+		return nil, err
+	}
+
+	for {
+		// Chunks following the first one of a value are skipped along with
+		// it, since they have the same key.
+		if err = r.readChunk(ctx, &rdata); err == io.EOF {
+			return nil, Err_KeyNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		if string(rdata.Key) == key {
+			break
+		}
+		if string(rdata.Key) > key {
+			return nil, Err_KeyNotFound
+		}
+	}
+
+	if len(rdata.MergeOperands) > 0 {
+		if err = r.foldMergeOperands(&rdata); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(rdata.Value), nil
+	}
+
+	return &valueReader{
+		ctx:    ctx,
+		reader: r,
+		key:    key,
+		data:   rdata.Value,
+		more:   rdata.Continued,
+	}, nil
+}
+
+/*
+valueReader streams a value split into chunks, reading the next chunk from
+the table whenever the current one has been consumed.
+*/
+type valueReader struct {
+	ctx    context.Context
+	reader *Reader
+	key    string
+	data   []byte
+	more   bool
+}
+
+func (v *valueReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+
+	for len(v.data) == 0 {
+		var chunk KeyValue
+
+		if !v.more {
+			return 0, io.EOF
+		}
+
+		if err = v.reader.readChunk(v.ctx, &chunk); err == io.EOF {
+			return 0, Err_IncompleteValue
+		} else if err != nil {
+			return 0, err
+		}
+		if string(chunk.Key) != v.key {
+			return 0, Err_IncompleteValue
+		}
+		v.data, v.more = chunk.Value, chunk.Continued
+	}
+
+	n = copy(p, v.data)
+	v.data = v.data[n:]
+	return n, nil
+}
@@ -0,0 +1,228 @@
+//go:build go1.18
+
+package sstable
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Codec converts values of type V to and from the bytes stored in a table.
+*/
+type Codec[V any] interface {
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+/*
+ProtoCodec encodes protocol buffers of the message type M, which has to be a
+pointer to a generated message struct, e.g. ProtoCodec[*pb.Entry].
+*/
+type ProtoCodec[M proto.Message] struct{}
+
+func (ProtoCodec[M]) Encode(value M) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (ProtoCodec[M]) Decode(data []byte) (M, error) {
+	var zero M
+	var msg = zero.ProtoReflect().Type().New().Interface().(M)
+
+	return msg, proto.Unmarshal(data, msg)
+}
+
+/*
+JSONCodec encodes values as JSON, using encoding/json.
+*/
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(value V) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	var err = json.Unmarshal(data, &value)
+
+	return value, err
+}
+
+/*
+GobCodec encodes values using encoding/gob. Every value is encoded on its
+own, including the description of its type, so values can be decoded in any
+order.
+*/
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Encode(value V) ([]byte, error) {
+	var buf bytes.Buffer
+	var err = gob.NewEncoder(&buf).Encode(value)
+
+	return buf.Bytes(), err
+}
+
+func (GobCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	var err = gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+
+	return value, err
+}
+
+/*
+BytesCodec stores byte slices as they are.
+*/
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+/*
+TypedWriter writes records with values of type V, encoded by a codec, to a
+Writer.
+*/
+type TypedWriter[V any] struct {
+	writer *Writer
+	codec  Codec[V]
+}
+
+/*
+NewTypedWriter creates a writer encoding values with codec and writing them
+to writer.
+*/
+func NewTypedWriter[V any](writer *Writer, codec Codec[V]) *TypedWriter[V] {
+	return &TypedWriter[V]{writer: writer, codec: codec}
+}
+
+/*
+Write encodes the value and appends it to the sstable together with the
+specified key, like Writer.WriteString.
+*/
+func (w *TypedWriter[V]) Write(
+	ctx context.Context, key string, value V) error {
+	var data []byte
+	var err error
+
+	if data, err = w.codec.Encode(value); err != nil {
+		return err
+	}
+	return w.writer.WriteString(ctx, key, string(data))
+}
+
+/*
+Close closes the underlying Writer.
+*/
+func (w *TypedWriter[V]) Close(ctx context.Context) error {
+	return w.writer.Close(ctx)
+}
+
+/*
+TypedReader reads records with values of type V, decoded by a codec, from a
+Reader.
+*/
+type TypedReader[V any] struct {
+	reader *Reader
+	codec  Codec[V]
+}
+
+/*
+NewTypedReader creates a reader reading from reader and decoding values with
+codec.
+*/
+func NewTypedReader[V any](reader *Reader, codec Codec[V]) *TypedReader[V] {
+	return &TypedReader[V]{reader: reader, codec: codec}
+}
+
+/*
+Read looks up the record with the specified key and decodes its value. The
+boolean result reports whether the record has been found.
+*/
+func (r *TypedReader[V]) Read(ctx context.Context, key string) (
+	V, bool, error) {
+	var value V
+	var data string
+	var found bool
+	var err error
+
+	data, found, err = r.reader.lookup(ctx, key)
+	if err != nil || !found {
+		return value, false, err
+	}
+	value, err = r.codec.Decode([]byte(data))
+	return value, true, err
+}
+
+/*
+ReadNext reads the next record from the current position in the sstable and
+decodes its value. io.EOF is returned at the end of the table.
+*/
+func (r *TypedReader[V]) ReadNext(ctx context.Context) (string, V, error) {
+	var value V
+	var key, data string
+	var err error
+
+	if key, data, err = r.reader.ReadNextString(ctx); err != nil {
+		return "", value, err
+	}
+	value, err = r.codec.Decode([]byte(data))
+	return key, value, err
+}
+
+/*
+ReadSubsequent reads the first record with a key greater than or equal to the
+specified one, like Reader.ReadSubsequentString, and decodes its value. An
+empty key and a zero value are returned if there is no such record.
+*/
+func (r *TypedReader[V]) ReadSubsequent(ctx context.Context, key string) (
+	string, V, error) {
+	var value V
+	var data string
+	var err error
+
+	key, data, err = r.reader.ReadSubsequentString(ctx, key)
+	if err != nil || (key == "" && data == "") {
+		return key, value, err
+	}
+	value, err = r.codec.Decode([]byte(data))
+	return key, value, err
+}
+
+/*
+ReadAll reads all records from the current position to the end of the table
+into a map, decoding their values. Please note that this may use up a lot of
+resources, since this will essentially read the entire table into memory.
+*/
+func (r *TypedReader[V]) ReadAll(ctx context.Context) (map[string]V, error) {
+	var values = make(map[string]V)
+	var key string
+	var value V
+	var err error
+
+	for {
+		key, value, err = r.ReadNext(ctx)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		values[key] = value
+	}
+}
+
+/*
+Reader returns the underlying Reader, e.g. for seeking.
+*/
+func (r *TypedReader[V]) Reader() *Reader {
+	return r.reader
+}
@@ -0,0 +1,64 @@
+//go:build go1.23
+
+package sstable
+
+import (
+	"context"
+	"iter"
+)
+
+/*
+All returns an iterator over all records of the table with their decoded
+values, like Reader.All. If a value doesn't decode, iteration stops and the
+error is returned by Err.
+*/
+func (r *TypedReader[V]) All(ctx context.Context) iter.Seq2[string, V] {
+	return r.decode(r.reader.All(ctx))
+}
+
+/*
+Range returns an iterator over the records with keys from start up to, but
+not including, end, like Reader.Range.
+*/
+func (r *TypedReader[V]) Range(
+	ctx context.Context, start, end string) iter.Seq2[string, V] {
+	return r.decode(r.reader.Range(ctx, start, end))
+}
+
+/*
+Prefix returns an iterator over the records with keys starting with the
+specified prefix, like Reader.Prefix.
+*/
+func (r *TypedReader[V]) Prefix(
+	ctx context.Context, prefix string) iter.Seq2[string, V] {
+	return r.decode(r.reader.Prefix(ctx, prefix))
+}
+
+/*
+decode decodes the values produced by an iterator of the underlying reader.
+*/
+func (r *TypedReader[V]) decode(seq iter.Seq2[string, string]) iter.Seq2[
+	string, V] {
+	return func(yield func(string, V) bool) {
+		var key, data string
+		var value V
+		var err error
+
+		for key, data = range seq {
+			if value, err = r.codec.Decode([]byte(data)); err != nil {
+				r.reader.iter_err = err
+				return
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Err returns the error which stopped the last iteration, like Reader.Err.
+*/
+func (r *TypedReader[V]) Err() error {
+	return r.reader.Err()
+}
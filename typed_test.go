@@ -0,0 +1,124 @@
+//go:build go1.23
+
+package sstable
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/childoftheuniverse/filesystem-internal"
+)
+
+// point is a value type for the JSON and gob codecs.
+type point struct {
+	X, Y int
+}
+
+// writeTyped writes the values to a new table using codec.
+func writeTyped[V any](t *testing.T, codec Codec[V], keys []string,
+	values []V) *Reader {
+	var ctx = context.Background()
+	var buf = internal.NewAnonymousFile()
+	var writer = NewTypedWriter(NewWriter(ctx, buf), codec)
+	var i int
+	var err error
+
+	for i = range keys {
+		if err = writer.Write(ctx, keys[i], values[i]); err != nil {
+			t.Fatal("Error writing record: ", err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal("Error closing writer: ", err)
+	}
+
+	return NewReader(buf)
+}
+
+func TestTypedTables(t *testing.T) {
+	var ctx = context.Background()
+	var keys = []string{"a", "b", "c"}
+	var codec Codec[point]
+	var reader *TypedReader[point]
+	var values map[string]point
+	var p point
+	var found bool
+	var key string
+	var n int
+	var err error
+
+	for _, codec = range []Codec[point]{JSONCodec[point]{}, GobCodec[point]{}} {
+		reader = NewTypedReader(writeTyped(t, codec, keys,
+			[]point{{1, 2}, {3, 4}, {5, 6}}), codec)
+		if p, found, err = reader.Read(ctx, "b"); err != nil || !found ||
+			p != (point{3, 4}) {
+			t.Error("Mismatched data for b: got ", p, ", ", found, ", ", err)
+		}
+		if p, found, err = reader.Read(ctx, "bb"); err != nil || found {
+			t.Error("Expected bb not to be found, got ", p, ", ", err)
+		}
+
+		reader.Reader().SeekTo(ctx, 0)
+		if values, err = reader.ReadAll(ctx); err != nil || len(values) != 3 ||
+			values["c"] != (point{5, 6}) {
+			t.Error("Unexpected values: ", values, ", ", err)
+		}
+
+		n = 0
+		for key, p = range reader.Range(ctx, "b", "") {
+			if (key == "b" && p.X != 3) || (key == "c" && p.X != 5) {
+				t.Error("Mismatched data for ", key, ": ", p)
+			}
+			n++
+		}
+		if reader.Err() != nil || n != 2 {
+			t.Error("Unexpected range: ", n, " records, ", reader.Err())
+		}
+	}
+}
+
+func TestTypedProtoAndBytes(t *testing.T) {
+	var ctx = context.Background()
+	var keys = []string{"x", "y"}
+	var protos *TypedReader[*IndexRecord]
+	var raw *TypedReader[[]byte]
+	var ir *IndexRecord
+	var data []byte
+	var key string
+	var err error
+
+	protos = NewTypedReader(writeTyped(t, ProtoCodec[*IndexRecord]{},
+		keys, []*IndexRecord{{Key: []byte("x"), Offset: 1},
+			{Key: []byte("y"), Offset: 2}}),
+		ProtoCodec[*IndexRecord]{})
+	for key, ir = range protos.All(ctx) {
+		if string(ir.Key) != key {
+			t.Error("Mismatched message for ", key, ": ", ir)
+		}
+	}
+	if protos.Err() != nil {
+		t.Error("Error iterating: ", protos.Err())
+	}
+	if key, ir, err = protos.ReadSubsequent(ctx, "xx"); err != nil ||
+		key != "y" || ir.Offset != 2 {
+		t.Error("Unexpected subsequent record: ", key, ", ", ir, ", ", err)
+	}
+
+	raw = NewTypedReader(writeTyped(t, BytesCodec{}, keys,
+		[][]byte{[]byte("1"), []byte("2")}), Codec[[]byte](BytesCodec{}))
+	if key, data, err = raw.ReadNext(ctx); err != nil || key != "x" ||
+		!bytes.Equal(data, []byte("1")) {
+		t.Error("Unexpected record: ", key, ", ", data, ", ", err)
+	}
+
+	// Values of the wrong type stop iteration with an error.
+	protos = NewTypedReader(writeTyped(t, BytesCodec{}, keys,
+		[][]byte{[]byte("\x07"), []byte("2")}), ProtoCodec[*IndexRecord]{})
+	for range protos.All(ctx) {
+		t.Error("Expected no messages")
+	}
+	if protos.Err() == nil {
+		t.Error("Expected undecodable value to fail")
+	}
+}
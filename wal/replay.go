@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/recordio"
+)
+
+/*
+crcTable is used to compute the checksums of records.
+*/
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+frameRecord prefixes the record with its checksum.
+*/
+func frameRecord(record []byte) []byte {
+	var framed = make([]byte, 4+len(record))
+
+	binary.BigEndian.PutUint32(framed, crc32.Checksum(record, crcTable))
+	copy(framed[4:], record)
+
+	return framed
+}
+
+/*
+unframeRecord verifies the checksum of a framed record and returns the
+record. The flag returned indicates whether the record is intact.
+*/
+func unframeRecord(framed []byte) ([]byte, bool) {
+	if len(framed) < 4 {
+		return nil, false
+	}
+	if binary.BigEndian.Uint32(framed) !=
+		crc32.Checksum(framed[4:], crcTable) {
+		return nil, false
+	}
+	return framed[4:], true
+}
+
+/*
+Replay reads all records from the segments of the log kept in storage whose
+numbers are at least first, in the order they were appended, and passes them
+to fn. This is how a memtable is rebuilt after a crash.
+
+A crash can leave the last records written incomplete or damaged. Replay
+therefore ends at the first record which cannot be read or fails its
+checksum, so that fn always sees a prefix of the records appended, without
+gaps. Errors returned by fn or by the storage abort the replay and are
+returned.
+*/
+func Replay(ctx context.Context, storage Storage, first uint64,
+	fn func(record []byte) error) error {
+	var names []string
+	var name string
+	var segments []uint64
+	var segment uint64
+	var complete bool
+	var err error
+
+	names, err = storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name = range names {
+		var ok bool
+
+		segment, ok = parseSegmentFileName(name)
+		if ok && segment >= first {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	for _, segment = range segments {
+		complete, err = replaySegment(ctx, storage, segment, fn)
+		if err != nil || !complete {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+replaySegment passes all records of a single segment to fn. The flag returned
+indicates whether the segment was read to its end without finding a damaged
+record.
+*/
+func replaySegment(ctx context.Context, storage Storage, segment uint64,
+	fn func(record []byte) error) (bool, error) {
+	var in filesystem.ReadCloser
+	var rec *recordio.RecordReader
+	var err error
+
+	in, err = storage.Open(ctx, segmentFileName(segment))
+	if err != nil {
+		return false, err
+	}
+	defer in.Close(ctx)
+
+	rec = recordio.NewRecordReader(in)
+
+	for {
+		var framed []byte
+		var record []byte
+		var ok bool
+
+		framed, err = rec.ReadRecord(ctx)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		record, ok = unframeRecord(framed)
+		if !ok {
+			return false, nil
+		}
+		if err = fn(record); err != nil {
+			return false, err
+		}
+	}
+}
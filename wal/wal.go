@@ -0,0 +1,589 @@
+/*
+Package wal implements a write-ahead log which makes writes durable before
+they are applied to in-memory data structures such as memtables.
+
+The log is a sequence of numbered segments, each of which is a recordio
+stream. Every record is prefixed by a checksum of its contents, so that
+records left incomplete or damaged by a crash can be recognized during
+replay. Concurrent appends are committed together in groups, so that a single
+write and sync covers many records.
+*/
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/recordio"
+)
+
+/*
+Policies determining when the log is synced to stable storage.
+*/
+const (
+	// Sync after every group of records committed. No acknowledged record is
+	// ever lost.
+	SyncPolicy_ALWAYS = iota
+
+	// Sync periodically, every SyncInterval. Records acknowledged during the
+	// last interval may be lost in a crash.
+	SyncPolicy_INTERVAL
+
+	// Never sync explicitly and leave it to the storage when data is
+	// written out.
+	SyncPolicy_NEVER
+)
+
+/*
+recordOverhead is a rough estimate of the space taken by the framing of a
+record, used to decide when to start a new segment.
+*/
+const recordOverhead = 16
+
+/*
+Err_Closed indicates that the log has already been closed.
+*/
+var Err_Closed = errors.New(
+	"Log closed")
+
+/*
+Err_NotSyncable indicates that the log is supposed to be synced, but the
+writers of its storage don't implement Syncer.
+*/
+var Err_NotSyncable = errors.New(
+	"Log segments can't be synced")
+
+/*
+Storage provides access to the segments of a log. All segments live in the
+same directory, so they are only identified by their names.
+*/
+type Storage interface {
+	/*
+		Create creates a new file with the specified name, replacing any
+		existing file of the same name.
+	*/
+	Create(ctx context.Context, name string) (filesystem.WriteCloser, error)
+
+	/*
+		Open opens an existing file for reading.
+	*/
+	Open(ctx context.Context, name string) (filesystem.ReadCloser, error)
+
+	/*
+		Remove deletes the file with the specified name.
+	*/
+	Remove(ctx context.Context, name string) error
+
+	/*
+		List returns the names of all files in the directory.
+	*/
+	List(ctx context.Context) ([]string, error)
+}
+
+/*
+Syncer is implemented by writers which can flush written data to stable
+storage. Writers which don't implement Syncer can only be used with
+SyncPolicy_NEVER.
+*/
+type Syncer interface {
+	Sync(ctx context.Context) error
+}
+
+/*
+Options configures the behavior of a log. Fields left at zero take the
+default values listed.
+*/
+type Options struct {
+	// When to sync the log; one of the SyncPolicy_ constants. ALWAYS.
+	SyncPolicy int
+
+	// Time between syncs with SyncPolicy_INTERVAL. 1 second.
+	SyncInterval time.Duration
+
+	// Approximate size in bytes at which a new segment is started. 64 MB.
+	SegmentSize int64
+}
+
+/*
+withDefaults fills in the default values for all unset options.
+*/
+func (o Options) withDefaults() Options {
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = time.Second
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = 64 << 20
+	}
+	return o
+}
+
+/*
+Commit tracks a record added to the log until it has been committed.
+*/
+type Commit struct {
+	log  *Log
+	data []byte
+	// If non-zero, this is not a record but marks the start of a new
+	// segment with this number.
+	segment uint64
+	done    chan struct{}
+	err     error
+}
+
+/*
+Log appends records to a sequence of segments. All methods are safe for
+concurrent use.
+*/
+type Log struct {
+	storage Storage
+	opts    Options
+
+	// mu protects the queue of records waiting to be committed, and the
+	// segment assignment of the records in it. cond signals the committer
+	// that records have been queued.
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []*Commit
+	closed       bool
+	segment      uint64
+	segment_size int64
+
+	// write_mu protects the segment currently being written.
+	write_mu    sync.Mutex
+	out_segment uint64
+	out         filesystem.WriteCloser
+	rec         *recordio.RecordWriter
+	dirty       bool
+	err         error
+
+	closing     chan struct{}
+	bg_done     chan struct{}
+	commit_done chan struct{}
+}
+
+/*
+segmentFileName determines the name of the segment with the specified number.
+*/
+func segmentFileName(number uint64) string {
+	return fmt.Sprintf("%06d.wal", number)
+}
+
+/*
+parseSegmentFileName determines the number of a segment from its file name.
+The flag returned indicates whether the name is that of a segment at all.
+*/
+func parseSegmentFileName(name string) (uint64, bool) {
+	var number uint64
+	var err error
+
+	if !strings.HasSuffix(name, ".wal") {
+		return 0, false
+	}
+	number, err = strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+/*
+Open opens the log kept in storage for appending. Records are appended to a
+new segment numbered after all existing ones, so existing segments can still
+be replayed after opening the log. Unless the sync policy is SyncPolicy_NEVER,
+the writers created by the storage must implement Syncer, or Err_NotSyncable
+is returned.
+*/
+func Open(ctx context.Context, storage Storage, opts Options) (*Log, error) {
+	var l = &Log{
+		storage:     storage,
+		opts:        opts.withDefaults(),
+		closing:     make(chan struct{}),
+		bg_done:     make(chan struct{}),
+		commit_done: make(chan struct{}),
+	}
+	var names []string
+	var name string
+	var err error
+
+	l.cond = sync.NewCond(&l.mu)
+
+	names, err = storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name = range names {
+		var number uint64
+		var ok bool
+
+		number, ok = parseSegmentFileName(name)
+		if ok && number > l.segment {
+			l.segment = number
+		}
+	}
+	l.segment++
+
+	if err = l.switchSegment(ctx, l.segment); err != nil {
+		return nil, err
+	}
+
+	go l.committer()
+	if l.opts.SyncPolicy == SyncPolicy_INTERVAL {
+		go l.background()
+	} else {
+		close(l.bg_done)
+	}
+
+	return l, nil
+}
+
+/*
+Segment returns the number of the segment records appended now will go to.
+*/
+func (l *Log) Segment() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segment
+}
+
+/*
+Enqueue adds the record to the queue of records to be committed, without
+waiting for it to be committed. Records are committed in the background in
+the order in which they were enqueued, whether or not anybody waits for them.
+The record must not be modified afterwards.
+*/
+func (l *Log) Enqueue(record []byte) *Commit {
+	var c = &Commit{
+		log:  l,
+		data: record,
+		done: make(chan struct{}),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		c.err = Err_Closed
+		close(c.done)
+		return c
+	}
+
+	if l.segment_size >= l.opts.SegmentSize {
+		l.rotate()
+	}
+	l.segment_size += int64(len(record)) + recordOverhead
+	l.queue = append(l.queue, c)
+	l.cond.Signal()
+
+	return c
+}
+
+/*
+Append adds the record to the log and waits for it to be committed.
+*/
+func (l *Log) Append(ctx context.Context, record []byte) error {
+	return l.Enqueue(record).Wait(ctx)
+}
+
+/*
+Rotate makes all records enqueued afterwards go to a new segment, and returns
+its number. Together with RemoveBefore, this allows discarding the parts of
+the log which are no longer needed.
+*/
+func (l *Log) Rotate() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotate()
+	return l.segment
+}
+
+/*
+rotate queues the start of a new segment. The queue mutex must be held.
+*/
+func (l *Log) rotate() {
+	l.segment++
+	l.segment_size = 0
+	l.queue = append(l.queue, &Commit{
+		log:     l,
+		segment: l.segment,
+		done:    make(chan struct{}),
+	})
+}
+
+/*
+Wait waits until the record has been committed, which means that it has been
+written and, depending on the sync policy, synced. The context only limits
+how long the caller waits; the record will still be committed if the context
+expires.
+*/
+func (c *Commit) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Done returns a channel which is closed once the record has been committed, or
+has failed to be.
+*/
+func (c *Commit) Done() <-chan struct{} {
+	return c.done
+}
+
+/*
+committer commits queued records until the log is closed and the queue is
+empty. All records queued while a group is being written are committed
+together in the next group.
+*/
+func (l *Log) committer() {
+	// Records are committed on behalf of many callers, so none of their
+	// contexts may cancel the writes.
+	var ctx = context.Background()
+
+	defer close(l.commit_done)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		var batch []*Commit
+		var c *Commit
+		var err error
+
+		for len(l.queue) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+		if len(l.queue) == 0 {
+			return
+		}
+
+		batch = l.queue
+		l.queue = nil
+		l.mu.Unlock()
+		err = l.commit(ctx, batch)
+		l.mu.Lock()
+
+		for _, c = range batch {
+			c.err = err
+			close(c.done)
+		}
+	}
+}
+
+/*
+commit writes a group of records and syncs them according to the sync policy.
+Errors are sticky: once a write has failed, all further commits fail too,
+since the contents of the segment are unknown.
+*/
+func (l *Log) commit(ctx context.Context, batch []*Commit) error {
+	var c *Commit
+
+	l.write_mu.Lock()
+	defer l.write_mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	for _, c = range batch {
+		if c.segment != 0 {
+			l.err = l.switchSegment(ctx, c.segment)
+		} else {
+			_, l.err = l.rec.Write(ctx, frameRecord(c.data))
+			l.dirty = true
+		}
+		if l.err != nil {
+			return l.err
+		}
+	}
+
+	if l.opts.SyncPolicy == SyncPolicy_ALWAYS {
+		l.err = l.sync(ctx)
+	}
+
+	return l.err
+}
+
+/*
+switchSegment closes the current segment, if any, and starts writing the
+segment with the specified number. The write mutex must be held, or the log
+not be shared yet.
+*/
+func (l *Log) switchSegment(ctx context.Context, number uint64) error {
+	var out filesystem.WriteCloser
+	var ok bool
+	var err error
+
+	if l.out != nil {
+		if l.opts.SyncPolicy != SyncPolicy_NEVER {
+			if err = l.sync(ctx); err != nil {
+				return err
+			}
+		}
+		if err = l.out.Close(ctx); err != nil {
+			return err
+		}
+		l.out = nil
+	}
+
+	out, err = l.storage.Create(ctx, segmentFileName(number))
+	if err != nil {
+		return err
+	}
+	_, ok = out.(Syncer)
+	if !ok && l.opts.SyncPolicy != SyncPolicy_NEVER {
+		out.Close(ctx)
+		return Err_NotSyncable
+	}
+
+	l.out_segment = number
+	l.out = out
+	l.rec = recordio.NewRecordWriter(out)
+	l.dirty = false
+	return nil
+}
+
+/*
+sync syncs the current segment if anything has been written to it since the
+last sync. The write mutex must be held.
+*/
+func (l *Log) sync(ctx context.Context) error {
+	var syncer Syncer
+	var ok bool
+
+	if !l.dirty {
+		return nil
+	}
+
+	syncer, ok = l.out.(Syncer)
+	if !ok {
+		return Err_NotSyncable
+	}
+	l.dirty = false
+	return syncer.Sync(ctx)
+}
+
+/*
+Sync syncs all records committed so far to stable storage, regardless of the
+sync policy. If the context expires, the log is left as it was, so the sync
+can be retried. Logs whose segments can't be synced return Err_NotSyncable
+without being affected otherwise.
+*/
+func (l *Log) Sync(ctx context.Context) error {
+	var err error
+
+	l.write_mu.Lock()
+	defer l.write_mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	err = l.sync(ctx)
+	if err == Err_NotSyncable {
+		return err
+	}
+	if err != nil && ctx.Err() != nil {
+		l.dirty = true
+		return err
+	}
+	l.err = err
+	return l.err
+}
+
+/*
+background syncs the log periodically for SyncPolicy_INTERVAL.
+*/
+func (l *Log) background() {
+	var ticker = time.NewTicker(l.opts.SyncInterval)
+
+	defer close(l.bg_done)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closing:
+			return
+		case <-ticker.C:
+			l.Sync(context.Background())
+		}
+	}
+}
+
+/*
+RemoveBefore deletes all segments with numbers lower than the specified one,
+except for the segment still being written.
+*/
+func (l *Log) RemoveBefore(ctx context.Context, number uint64) error {
+	var names []string
+	var name string
+	var err error
+
+	l.write_mu.Lock()
+	if l.out_segment < number {
+		number = l.out_segment
+	}
+	l.write_mu.Unlock()
+
+	names, err = l.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name = range names {
+		var segment uint64
+		var ok bool
+
+		segment, ok = parseSegmentFileName(name)
+		if ok && segment < number {
+			if err = l.storage.Remove(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Close commits all records still queued, syncs the log unless the sync policy
+is SyncPolicy_NEVER, and closes it.
+*/
+func (l *Log) Close(ctx context.Context) error {
+	var err error
+	var close_err error
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cond.Signal()
+	l.mu.Unlock()
+
+	// Wait for the committer to commit all queued records.
+	<-l.commit_done
+	close(l.closing)
+	<-l.bg_done
+
+	l.write_mu.Lock()
+	defer l.write_mu.Unlock()
+
+	err = l.err
+	if err == nil && l.opts.SyncPolicy != SyncPolicy_NEVER {
+		err = l.sync(ctx)
+	}
+	close_err = l.out.Close(ctx)
+	if err == nil {
+		err = close_err
+	}
+	l.err = Err_Closed
+	return err
+}
@@ -0,0 +1,419 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/childoftheuniverse/filesystem"
+	"github.com/childoftheuniverse/sstable/internal/memfs"
+)
+
+// crashAt simulates a crash after offset bytes of the whole log have been
+// written: the segment containing the offset is truncated, and all following
+// segments are dropped.
+func crashAt(s *memfs.Storage, offset int) *memfs.Storage {
+	var crashed = memfs.NewStorage()
+	var names []string
+	var name string
+
+	names, _ = s.List(context.Background())
+	for _, name = range names {
+		var data = s.Contents(name)
+
+		if offset <= 0 {
+			break
+		}
+		if len(data) > offset {
+			data = data[:offset]
+		}
+		crashed.SetContents(name, append([]byte(nil), data...))
+		offset -= len(data)
+	}
+
+	return crashed
+}
+
+// logSize determines the total size of all segments of the log.
+func logSize(s *memfs.Storage) int {
+	var names []string
+	var name string
+	var size int
+
+	names, _ = s.List(context.Background())
+	for _, name = range names {
+		size += len(s.Contents(name))
+	}
+	return size
+}
+
+// replayAll replays the whole log into a slice.
+func replayAll(t *testing.T, storage Storage) []string {
+	var records []string
+	var err error
+
+	err = Replay(context.Background(), storage, 0, func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Error replaying log: ", err)
+	}
+
+	return records
+}
+
+// Append records spread over a number of segments and replay them.
+func TestAppendAndReplay(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var expected []string
+	var records []string
+	var l *Log
+	var i int
+	var names []string
+	var err error
+
+	l, err = Open(ctx, storage, Options{SegmentSize: 256})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	for i = 0; i < 100; i++ {
+		var record = fmt.Sprintf("record %d", i)
+
+		if err = l.Append(ctx, []byte(record)); err != nil {
+			t.Fatal("Error appending record: ", err)
+		}
+		expected = append(expected, record)
+	}
+	if err = l.Close(ctx); err != nil {
+		t.Fatal("Error closing log: ", err)
+	}
+
+	if names, _ = storage.List(ctx); len(names) < 5 {
+		t.Error("Expected the log to be split into segments, got ",
+			len(names))
+	}
+
+	records = replayAll(t, storage)
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		t.Error("Mismatched records: expected ", expected, ", got ", records)
+	}
+
+	// Records appended after reopening go to a new segment.
+	l, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error reopening log: ", err)
+	}
+	if err = l.Append(ctx, []byte("more")); err != nil {
+		t.Fatal("Error appending record: ", err)
+	}
+	l.Close(ctx)
+
+	records = replayAll(t, storage)
+	if len(records) != 101 || records[100] != "more" {
+		t.Error("Record appended after reopening missing: ", records)
+	}
+}
+
+// Rotate and discard old segments.
+func TestRotateAndRemoveBefore(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var records []string
+	var segment uint64
+	var l *Log
+	var err error
+
+	l, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	defer l.Close(ctx)
+
+	l.Append(ctx, []byte("old"))
+	segment = l.Rotate()
+	if segment != l.Segment() {
+		t.Error("Expected current segment to be ", segment, ", got ",
+			l.Segment())
+	}
+	l.Append(ctx, []byte("new"))
+
+	if err = l.RemoveBefore(ctx, segment); err != nil {
+		t.Fatal("Error removing segments: ", err)
+	}
+
+	records = replayAll(t, storage)
+	if len(records) != 1 || records[0] != "new" {
+		t.Error("Expected only the new record to be left, got ", records)
+	}
+}
+
+// Append records from many goroutines at once.
+func TestGroupCommit(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var seen = make(map[string]bool)
+	var records []string
+	var record string
+	var wg sync.WaitGroup
+	var l *Log
+	var i int
+	var err error
+
+	l, err = Open(ctx, storage, Options{SegmentSize: 4096})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+
+	for i = 0; i < 20; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			var j int
+
+			defer wg.Done()
+			for j = 0; j < 50; j++ {
+				var err = l.Append(ctx, []byte(fmt.Sprintf("%d/%d", writer, j)))
+				if err != nil {
+					t.Error("Error appending record: ", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err = l.Close(ctx); err != nil {
+		t.Fatal("Error closing log: ", err)
+	}
+
+	if storage.Syncs() > 1000 {
+		t.Error("Expected at most one sync per record, got ", storage.Syncs())
+	}
+
+	records = replayAll(t, storage)
+	if len(records) != 1000 {
+		t.Error("Expected 1000 records, got ", len(records))
+	}
+	for _, record = range records {
+		if seen[record] {
+			t.Error("Duplicate record ", record)
+		}
+		seen[record] = true
+	}
+}
+
+// Records are committed without anybody waiting for them, and callers giving
+// up on waiting don't affect the log.
+func TestEnqueueWithoutWait(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var cancelled, cancel = context.WithCancel(ctx)
+	var records []string
+	var c *Commit
+	var l *Log
+	var err error
+
+	l, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+
+	c = l.Enqueue([]byte("a"))
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Error("Expected the record to be committed without waiting")
+	}
+
+	cancel()
+	l.Enqueue([]byte("b"))
+	if err = l.Enqueue([]byte("c")).Wait(cancelled); err != context.Canceled &&
+		err != nil {
+		t.Error("Expected waiting to be cancelled, got ", err)
+	}
+	if err = l.Append(ctx, []byte("d")); err != nil {
+		t.Error("Error appending record after cancelled wait: ", err)
+	}
+	if err = l.Close(ctx); err != nil {
+		t.Fatal("Error closing log: ", err)
+	}
+
+	records = replayAll(t, storage)
+	if len(records) != 4 || records[0] != "a" || records[3] != "d" {
+		t.Error("Expected all records to be replayed, got ", records)
+	}
+}
+
+// Check when the different sync policies sync the log.
+func TestSyncPolicies(t *testing.T) {
+	var ctx = context.Background()
+	var storage *memfs.Storage
+	var l *Log
+	var err error
+
+	storage = memfs.NewStorage()
+	l, err = Open(ctx, storage, Options{SyncPolicy: SyncPolicy_ALWAYS})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	l.Append(ctx, []byte("a"))
+	l.Append(ctx, []byte("b"))
+	if storage.Syncs() != 2 {
+		t.Error("Expected 2 syncs with SyncPolicy_ALWAYS, got ", storage.Syncs())
+	}
+	l.Close(ctx)
+
+	storage = memfs.NewStorage()
+	l, err = Open(ctx, storage, Options{SyncPolicy: SyncPolicy_NEVER})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	l.Append(ctx, []byte("a"))
+	l.Close(ctx)
+	if storage.Syncs() != 0 {
+		t.Error("Expected no syncs with SyncPolicy_NEVER, got ", storage.Syncs())
+	}
+
+	storage = memfs.NewStorage()
+	l, err = Open(ctx, storage, Options{
+		SyncPolicy:   SyncPolicy_INTERVAL,
+		SyncInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	l.Append(ctx, []byte("a"))
+	if storage.Syncs() != 0 {
+		t.Error("Expected no immediate sync with SyncPolicy_INTERVAL")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if storage.Syncs() != 1 {
+		t.Error("Expected a single periodic sync, got ", storage.Syncs())
+	}
+	l.Close(ctx)
+}
+
+// unsyncableStorage hides the Sync method of the writers it creates.
+type unsyncableStorage struct {
+	*memfs.Storage
+}
+
+func (s unsyncableStorage) Create(ctx context.Context, name string) (
+	filesystem.WriteCloser, error) {
+	var w filesystem.WriteCloser
+	var err error
+
+	w, err = s.Storage.Create(ctx, name)
+	return struct{ filesystem.WriteCloser }{w}, err
+}
+
+// Check that logs which have to be synced refuse writers without Sync.
+func TestUnsyncableStorage(t *testing.T) {
+	var ctx = context.Background()
+	var storage = unsyncableStorage{memfs.NewStorage()}
+	var l *Log
+	var err error
+
+	_, err = Open(ctx, storage, Options{SyncPolicy: SyncPolicy_ALWAYS})
+	if err != Err_NotSyncable {
+		t.Error("Expected SyncPolicy_ALWAYS to fail, got ", err)
+	}
+	_, err = Open(ctx, storage, Options{SyncPolicy: SyncPolicy_INTERVAL})
+	if err != Err_NotSyncable {
+		t.Error("Expected SyncPolicy_INTERVAL to fail, got ", err)
+	}
+
+	l, err = Open(ctx, storage, Options{SyncPolicy: SyncPolicy_NEVER})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	if err = l.Append(ctx, []byte("a")); err != nil {
+		t.Error("Error appending record: ", err)
+	}
+	if err = l.Sync(ctx); err != Err_NotSyncable {
+		t.Error("Expected explicit sync to fail, got ", err)
+	}
+	if err = l.Append(ctx, []byte("b")); err != nil {
+		t.Error("Error appending record after failed sync: ", err)
+	}
+	if err = l.Close(ctx); err != nil {
+		t.Error("Error closing log: ", err)
+	}
+}
+
+// Simulate crashes at random offsets of the log and verify that replay
+// recovers exactly the records written completely before the crash.
+func TestReplayAfterCrash(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var expected []string
+	var ends []int
+	var l *Log
+	var i int
+	var err error
+
+	l, err = Open(ctx, storage, Options{SegmentSize: 512})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	for i = 0; i < 200; i++ {
+		var record = fmt.Sprintf("record %d %s", i,
+			make([]byte, rand.Intn(40)))
+
+		if err = l.Append(ctx, []byte(record)); err != nil {
+			t.Fatal("Error appending record: ", err)
+		}
+		expected = append(expected, record)
+		ends = append(ends, logSize(storage))
+	}
+	l.Close(ctx)
+
+	for i = 0; i < 500; i++ {
+		var offset = rand.Intn(logSize(storage) + 1)
+		var records = replayAll(t, crashAt(storage, offset))
+		var complete = sort.SearchInts(ends, offset+1)
+		var j int
+
+		if len(records) != complete {
+			t.Error("Crash at ", offset, ": expected ", complete,
+				" records, got ", len(records))
+		}
+		for j = range records {
+			if j >= len(expected) || records[j] != expected[j] {
+				t.Error("Crash at ", offset, ": mismatched record ", j)
+				break
+			}
+		}
+	}
+}
+
+// A damaged record ends the replay.
+func TestReplayCorrupted(t *testing.T) {
+	var ctx = context.Background()
+	var storage = memfs.NewStorage()
+	var records []string
+	var data []byte
+	var l *Log
+	var err error
+
+	l, err = Open(ctx, storage, Options{})
+	if err != nil {
+		t.Fatal("Error opening log: ", err)
+	}
+	l.Append(ctx, []byte("first"))
+	l.Append(ctx, []byte("second"))
+	l.Append(ctx, []byte("third"))
+	l.Close(ctx)
+
+	// Flip a bit in the middle of the log.
+	data = storage.Contents(segmentFileName(1))
+	data[len(data)/2] ^= 1
+
+	records = replayAll(t, storage)
+	if len(records) != 1 || records[0] != "first" {
+		t.Error("Expected only the first record to be replayed, got ", records)
+	}
+}
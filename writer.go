@@ -1,19 +1,23 @@
 package sstable
 
 import (
+	"context"
+	"crypto/cipher"
 	"errors"
 	"github.com/childoftheuniverse/filesystem"
 	"github.com/childoftheuniverse/recordio"
-	"github.com/golang/protobuf/proto"
-	"golang.org/x/net/context"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
 	IndexType_NONE = iota
 	IndexType_EVERY_N
 	IndexType_PREFIXLEN
+	IndexType_EVERY_N_BYTES
 )
 
 /*
@@ -38,19 +42,76 @@ The code itself doesn't care a lot about whether the destination
 is a file or something else.
 */
 type Writer struct {
-	out      *recordio.RecordWriter
-	out_seek filesystem.Seeker
-	out_idx  *recordio.RecordWriter
+	out              *recordio.RecordWriter
+	orig_out         filesystem.WriteCloser
+	out_seek         filesystem.Seeker
+	out_idx          *recordio.RecordWriter
+	orig_out_idx     filesystem.WriteCloser
+	out_idx_seek     filesystem.Seeker
+	out_top_idx      *recordio.RecordWriter
+	orig_out_top_idx filesystem.WriteCloser
+	out_hash         filesystem.WriteCloser
 
 	index_type int
 	index_n    int
 
 	last_key string
+	// Number of records written to the data file so far.
+	records int64
 
 	// index_offset points to the offset of the following record in the data file.
 	index_offset      int64
 	prev_index_ctr    int
 	prev_index_prefix string
+	prev_index_offset int64
+	have_index_offset bool
+
+	// idx_offset points to the offset of the following record in the index file.
+	idx_offset     int64
+	partition_size int
+	partition_ctr  int
+
+	// Entries of the hash index, which is only written out on Close.
+	hash_entries []hashEntry
+
+	// Key compression; restart_offset points to the last record in the data
+	// file which holds a full key, prev_index_key is the last indexed key.
+	restart_interval int
+	restart_ctr      int
+	restart_offset   int64
+	prev_index_key   string
+
+	// Index record of the current block of records when keys are compressed,
+	// which is only written once the block is complete and all its restart
+	// points are known.
+	index_block *IndexRecord
+
+	// Value compression. While sample_records is non-zero, records are
+	// collected for training the compression dictionary rather than written.
+	// sample_size is the uncompressed size of the records collected.
+	header_written bool
+	sample_records int
+	max_dict_size  int
+	sample_keys    []string
+	sample_values  []string
+	sample_merges  [][]string
+	sample_size    int64
+	encoder        *zstd.Encoder
+
+	// Encryption of all records. Records are authenticated along with the
+	// digest of the table header and their position; table_start is the
+	// offset of the table in the data file, top_records the number of top
+	// level index records written.
+	aead              cipher.AEAD
+	encryption_key_id string
+	table_id          []byte
+	header_digest     []byte
+	table_start       int64
+	top_records       int64
+
+	// Maximum size of the values of individual records; longer values are
+	// split into chunks. 0 means values are never split.
+	chunk_size int
 }
 
 /*
@@ -75,10 +136,12 @@ func NewWriter(ctx context.Context, out filesystem.WriteCloser) *Writer {
 
 	return &Writer{
 		out:        writer,
+		orig_out:   out,
 		out_seek:   seeker,
 		index_type: IndexType_NONE,
 
 		index_offset: offset,
+		table_start:  offset,
 	}
 }
 
@@ -106,11 +169,252 @@ func NewIndexedWriter(ctx context.Context, out filesystem.WriteCloser,
 
 	return &Writer{
 		out:          writer,
+		orig_out:     out,
 		out_seek:     seeker,
 		out_idx:      recordio.NewRecordWriter(out_idx),
+		orig_out_idx: out_idx,
 		index_type:   index_type,
 		index_n:      n,
 		index_offset: offset,
+		table_start:  offset,
+	}
+}
+
+/*
+NewPartitionedIndexWriter creates a new sstable writer which writes a two-level
+index: out_idx receives the index records as usual, but they are grouped into
+partitions of partition_size records each. For every partition, a record is
+written to out_top_idx which associates the first key of the partition with
+its offset in the index file.
+
+This allows readers to keep only the top level index in memory and fetch a
+single partition of the index per lookup.
+*/
+func NewPartitionedIndexWriter(ctx context.Context, out filesystem.WriteCloser,
+	out_idx filesystem.WriteCloser, out_top_idx filesystem.WriteCloser,
+	index_type int, n int, partition_size int) *Writer {
+	var writer = NewIndexedWriter(ctx, out, out_idx, index_type, n)
+	var seeker filesystem.Seeker
+	var offset int64
+	var err error
+	var ok bool
+
+	seeker, ok = out_idx.(filesystem.Seeker)
+	if ok {
+		// Same as above, but for the index file.
+		offset, err = seeker.Tell(ctx)
+		if err != nil {
+			offset = 0
+		}
+	}
+
+	if partition_size < 1 {
+		partition_size = 1
+	}
+
+	writer.out_idx_seek = seeker
+	writer.out_top_idx = recordio.NewRecordWriter(out_top_idx)
+	writer.orig_out_top_idx = out_top_idx
+	writer.idx_offset = offset
+	writer.partition_size = partition_size
+
+	return writer
+}
+
+/*
+flushIndexBlock writes the index record of the current block of records, if
+any.
+*/
+func (w *Writer) flushIndexBlock(ctx context.Context) error {
+	var block = w.index_block
+
+	if block == nil {
+		return nil
+	}
+	w.index_block = nil
+
+	return w.writeIndexRecord(ctx, block)
+}
+
+/*
+writeIndexRecord appends the index record of a block to the index file,
+compressing its key if necessary. If a two-level index has been requested,
+the top level index is updated whenever a new partition of the index is
+started.
+*/
+func (w *Writer) writeIndexRecord(
+	ctx context.Context, block *IndexRecord) error {
+	var key = string(block.Key)
+	var ir = IndexRecord{
+		Key:      block.Key,
+		Offset:   block.Offset,
+		Records:  block.Records,
+		Restarts: block.Restarts,
+	}
+	var idxdata []byte
+	var new_offset int64
+	var length int
+	var err error
+
+	if w.out_top_idx != nil {
+		if w.partition_ctr == 0 {
+			var top IndexRecord
+
+			// Start of a new partition; point the top level index at it.
+			top.Key = []byte(key)
+			top.Offset = w.idx_offset
+
+			idxdata, err = proto.Marshal(&top)
+			if err != nil {
+				return err
+			}
+			idxdata, err = w.sealRecord(idxdata, aadTopIndex, w.top_records)
+			if err != nil {
+				return err
+			}
+			_, err = w.out_top_idx.Write(ctx, idxdata)
+			if err != nil {
+				return err
+			}
+			w.top_records++
+
+			// Partitions are read individually, so they need to start with a
+			// full key.
+			w.prev_index_key = ""
+		}
+		w.partition_ctr = (w.partition_ctr + 1) % w.partition_size
+	}
+
+	if w.restart_interval > 0 {
+		var shared = sharedPrefixLen(w.prev_index_key, key)
+
+		ir.Key = []byte(key[shared:])
+		ir.SharedPrefixLen = uint32(shared)
+		w.prev_index_key = key
+	}
+
+	idxdata, err = proto.Marshal(&ir)
+	if err != nil {
+		return err
+	}
+	idxdata, err = w.sealRecord(idxdata, aadIndex, w.idx_offset)
+	if err != nil {
+		return err
+	}
+	length, err = w.out_idx.Write(ctx, idxdata)
+	if err != nil {
+		return err
+	}
+
+	if w.out_idx_seek != nil {
+		new_offset, err = w.out_idx_seek.Tell(ctx)
+		if err == nil {
+			w.idx_offset = new_offset
+			return nil
+		}
+	}
+	w.idx_offset += int64(length)
+
+	return nil
+}
+
+/*
+sharedPrefixLen determines the length of the common prefix of two keys. The
+prefix will never end in the middle of a UTF-8 encoded character, so that
+the remaining suffix is still a valid string.
+*/
+func sharedPrefixLen(a, b string) int {
+	var l int
+
+	for l < len(a) && l < len(b) && a[l] == b[l] {
+		l++
+	}
+	for l > 0 && l < len(b) && !utf8.RuneStart(b[l]) {
+		l--
+	}
+
+	return l
+}
+
+/*
+SetKeyCompression enables prefix compression of keys: every record only
+stores the length of the prefix its key shares with the key of the previous
+record, followed by the remaining suffix. Every restart_interval records, and
+at every indexed record, the full key is stored again so that reads can start
+from there. The index records list these restart points for the records up
+to the next indexed record, so lookups can binary search them. Index records
+are compressed in the same way. Since the restart points of a block are only
+known once the next block starts, the index record of the last block is only
+written by Close.
+
+This must be called before the first record is written.
+*/
+func (w *Writer) SetKeyCompression(restart_interval int) {
+	if restart_interval < 1 {
+		restart_interval = 1
+	}
+	w.restart_interval = restart_interval
+}
+
+/*
+indexKey determines whether the record with the specified key is going to be
+indexed, and if so, under which key. The index state is only updated by
+advanceIndex once the record has been written.
+*/
+func (w *Writer) indexKey(key string) (string, bool, error) {
+	if w.out_idx == nil || w.index_type == IndexType_NONE {
+		return "", false, nil
+	}
+
+	switch w.index_type {
+	case IndexType_PREFIXLEN:
+		var prefix string
+		if len(key) <= w.index_n {
+			prefix = key
+		} else {
+			prefix = key[:w.index_n]
+		}
+
+		if prefix != w.prev_index_prefix {
+			return prefix, true, nil
+		}
+		break
+	case IndexType_EVERY_N:
+		if (w.prev_index_ctr+1)%w.index_n == 0 {
+			return key, true, nil
+		}
+		break
+	case IndexType_EVERY_N_BYTES:
+		// Index the current record if at least index_n bytes of data have been
+		// written since the last indexed record started.
+		if !w.have_index_offset ||
+			w.index_offset-w.prev_index_offset >= int64(w.index_n) {
+			return key, true, nil
+		}
+		break
+	default:
+		return "", false, Err_UnsupportedIndexType
+	}
+
+	return "", false, nil
+}
+
+/*
+advanceIndex updates the index state after a record starting at offset has
+been written, with index_key and indexed as determined by indexKey.
+*/
+func (w *Writer) advanceIndex(index_key string, indexed bool, offset int64) {
+	if w.out_idx == nil || w.index_type == IndexType_NONE {
+		return
+	}
+
+	if w.index_type == IndexType_EVERY_N {
+		w.prev_index_ctr = (w.prev_index_ctr + 1) % w.index_n
+	}
+	if indexed {
+		w.prev_index_prefix = index_key
+		w.prev_index_offset = offset
+		w.have_index_offset = true
 	}
 }
 
@@ -123,23 +427,106 @@ Write errors may indicate that the data has been written successfully to the
 data file but not the index; it might be a complete failure too though.
 */
 func (w *Writer) WriteString(ctx context.Context, key, value string) error {
+	return w.writeRecord(ctx, key, value, nil)
+}
+
+/*
+writeRecord appends a record to the sstable: a regular record holding the
+value, or, if operands are specified, a merge record holding those instead.
+Values longer than the chunk size, if set, are split into chunks.
+*/
+func (w *Writer) writeRecord(
+	ctx context.Context, key, value string, operands []string) error {
+	var continuation bool
+	var err error
+
+	if strings.Compare(w.last_key, key) > 0 {
+		return Err_KeyOrderViolation
+	}
+	if operands != nil && w.last_key == key &&
+		(w.records > 0 || len(w.sample_keys) > 0) {
+		return Err_MergeAfterRecord
+	}
+
+	if w.sample_records > 0 {
+		// Still collecting samples for training the compression dictionary.
+		return w.addCompressionSample(ctx, key, value, operands)
+	}
+
+	for w.chunk_size > 0 && operands == nil && len(value) > w.chunk_size {
+		err = w.writeChunk(
+			ctx, key, value[:w.chunk_size], nil, continuation, true)
+		if err != nil {
+			return err
+		}
+		value = value[w.chunk_size:]
+		continuation = true
+	}
+
+	return w.writeChunk(ctx, key, value, operands, continuation, false)
+}
+
+/*
+writeChunk appends a single record to the sstable. Records continuing the
+value of the previous one are neither indexed nor counted, and never start
+with a full key, so that reads can't start in the middle of a value. more
+marks records whose value is continued by the next record.
+*/
+func (w *Writer) writeChunk(ctx context.Context, key, value string,
+	operands []string, continuation, more bool) error {
 	var rdata KeyValue
-	var new_offset int64
+	var index_key string
 	var record []byte
+	var offset int64
 	var length int
+	var indexed, full_key bool
 	var err error
 
-	if strings.Compare(w.last_key, key) > 0 {
-		return Err_KeyOrderViolation
+	if w.aead != nil && !w.header_written {
+		// Encrypted tables need the header to record the key used.
+		if err = w.writeHeader(ctx, w.tableHeader()); err != nil {
+			return err
+		}
+	}
+
+	// Determine whether the record will be indexed first, since indexed records
+	// need to be restart points if keys are compressed.
+	if !continuation {
+		index_key, indexed, err = w.indexKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	rdata.Key = []byte(key)
+	rdata.Continued = more
+	if operands != nil {
+		rdata.MergeOperands = operandBytes(operands)
+	} else if w.encoder != nil {
+		rdata.CompressedValue = w.encoder.EncodeAll([]byte(value), nil)
+	} else {
+		rdata.Value = []byte(value)
 	}
 
-	rdata.Key = key
-	rdata.Value = value
+	// Records holding the full key are restart points; reads can start there.
+	full_key = w.restart_interval == 0 ||
+		(!continuation && (indexed || w.restart_ctr == 0))
+	if !full_key {
+		var shared = sharedPrefixLen(w.last_key, key)
+
+		rdata.Key = []byte(key[shared:])
+		rdata.SharedPrefixLen = uint32(shared)
+	}
 
 	record, err = proto.Marshal(&rdata)
 	if err != nil {
 		return err
 	}
+	offset = w.index_offset
+	record, err = w.sealRecord(record, aadData, offset-w.table_start)
+	if err != nil {
+		return err
+	}
 
 	// Then, write out the actual data.
 	length, err = w.out.Write(ctx, record)
@@ -147,80 +534,79 @@ func (w *Writer) WriteString(ctx context.Context, key, value string) error {
 		return err
 	}
 	w.last_key = key
+	if !continuation {
+		w.records++
+		w.advanceIndex(index_key, indexed, offset)
+	}
 
-	// Now, generate the index entry.
-	if w.out_idx != nil && w.index_type != IndexType_NONE {
-		switch w.index_type {
-		case IndexType_PREFIXLEN:
-			var prefix string
-			if len(key) <= w.index_n {
-				prefix = key
-			} else {
-				prefix = key[:w.index_n]
-			}
-
-			if prefix != w.prev_index_prefix {
-				var ir IndexRecord
-				var idxdata []byte
+	if full_key {
+		w.restart_offset = offset
+		if w.restart_interval > 0 {
+			w.restart_ctr = 1 % w.restart_interval
+		}
+	} else if !continuation {
+		w.restart_ctr = (w.restart_ctr + 1) % w.restart_interval
+	}
 
-				ir.Key = prefix
-				ir.Offset = w.index_offset
+	if w.out_hash != nil && !continuation {
+		// Point the hash index at the last restart point, from where the key
+		// can be decoded.
+		w.hash_entries = append(w.hash_entries, hashEntry{
+			hash:   hashKey(key),
+			offset: w.restart_offset,
+		})
+	}
 
-				idxdata, err = proto.Marshal(&ir)
-				if err != nil {
-					return err
-				}
-				_, err = w.out_idx.Write(ctx, idxdata)
-				if err != nil {
-					return err
-				}
+	// Now, update the index: the record starts a new block if it's indexed.
+	// Without key compression there are no restart points to collect, so the
+	// index record is written right away.
+	if indexed {
+		var block = &IndexRecord{
+			Key:     []byte(index_key),
+			Offset:  offset,
+			Records: w.records,
+		}
 
-				w.prev_index_prefix = prefix
-			}
-			break
-		case IndexType_EVERY_N:
-			w.prev_index_ctr = (w.prev_index_ctr + 1) % w.index_n
-
-			if w.prev_index_ctr == 0 {
-				var ir IndexRecord
-				var idxdata []byte
-
-				ir.Key = key
-				ir.Offset = w.index_offset
-
-				idxdata, err = proto.Marshal(&ir)
-				if err != nil {
-					return err
-				}
-				_, err = w.out_idx.Write(ctx, idxdata)
-				if err != nil {
-					return err
-				}
-
-				w.prev_index_prefix = key
-			}
-			break
-		default:
-			return Err_UnsupportedIndexType
+		if err = w.flushIndexBlock(ctx); err != nil {
+			return err
 		}
+		if w.restart_interval > 0 {
+			w.index_block = block
+		} else if err = w.writeIndexRecord(ctx, block); err != nil {
+			return err
+		}
+	}
+	if full_key && w.restart_interval > 0 && w.index_block != nil {
+		w.index_block.Restarts = append(w.index_block.Restarts, offset)
 	}
 
+	// Finally, update counters.
+	w.advanceOffset(ctx, length)
+
+	return nil
+}
+
+/*
+advanceOffset updates the writers idea of the current position in the data
+file after length bytes have been written to it.
+*/
+func (w *Writer) advanceOffset(ctx context.Context, length int) {
+	var new_offset int64
+	var err error
+
 	if w.out_seek != nil {
-		// Finally, update counters.
 		new_offset, err = w.out_seek.Tell(ctx)
-		if err == nil {
-			// Underlying object supports seeks, just use the known current position in
-			// the underlying file.
-			w.index_offset = new_offset
-		} else {
-			// No seek support; we will just assume the position in the underlying data
-			// store has advanced by the length of the data written. Please note this
-			// can be wrong (e.g. when using compression).
-			w.index_offset += int64(length)
-		}
 	}
-
-	return nil
+	if w.out_seek != nil && err == nil {
+		// Underlying object supports seeks, just use the known current position in
+		// the underlying file.
+		w.index_offset = new_offset
+	} else {
+		// No seek support; we will just assume the position in the underlying data
+		// store has advanced by the length of the data written. Please note this
+		// can be wrong (e.g. when using compression).
+		w.index_offset += int64(length)
+	}
 }
 
 /*
@@ -283,3 +669,49 @@ func (w *Writer) WriteProtoMap(
 
 	return nil
 }
+
+/*
+Close finishes writing the sstable: any outstanding data, such as records
+buffered for training the compression dictionary or the hash index, is written
+out and all underlying writers are closed.
+*/
+func (w *Writer) Close(ctx context.Context) error {
+	var err error
+
+	if w.sample_records > 0 {
+		// Not enough samples were collected; train on what there is.
+		if err = w.startCompression(ctx); err != nil {
+			return err
+		}
+	}
+	if w.aead != nil && !w.header_written {
+		// Even empty encrypted tables have a header, so readers can tell
+		// them from unencrypted ones.
+		if err = w.writeHeader(ctx, w.tableHeader()); err != nil {
+			return err
+		}
+	}
+	if err = w.flushIndexBlock(ctx); err != nil {
+		return err
+	}
+	if w.out_hash != nil {
+		if err = w.writeHashIndex(ctx); err != nil {
+			return err
+		}
+		if err = w.out_hash.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if w.orig_out_top_idx != nil {
+		if err = w.orig_out_top_idx.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if w.orig_out_idx != nil {
+		if err = w.orig_out_idx.Close(ctx); err != nil {
+			return err
+		}
+	}
+
+	return w.orig_out.Close(ctx)
+}